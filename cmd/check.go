@@ -9,13 +9,11 @@ import (
 	"sync"
 	"time"
 
-	"github.com/fatih/color"
 	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/telegram/query"
 	"github.com/gotd/td/telegram/query/messages"
 	"github.com/gotd/td/tg"
 	"github.com/jedib0t/go-pretty/v6/progress"
-	"github.com/jedib0t/go-pretty/v6/text"
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
 	"github.com/tgdrive/teldrive/internal/api"
@@ -27,20 +25,10 @@ import (
 	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/term"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
-var termWidth = func() (width int, err error) {
-	width, _, err = term.GetSize(int(os.Stdout.Fd()))
-	if err == nil {
-		return width, nil
-	}
-
-	return 0, err
-}
-
 type file struct {
 	ID        string
 	Name      string
@@ -337,37 +325,42 @@ func (cp *channelProcessor) loadFiles() ([]file, error) {
 func (cp *channelProcessor) loadChannelMessages() (msgs []messages.Elem, total int, err error) {
 
 	err = tgc.RunWithAuth(cp.ctx, cp.client, "", func(ctx context.Context) error {
-		var channel *tg.InputChannel
-		channel, err = tgc.GetChannelById(ctx, cp.client.API(), cp.id)
-		if err != nil {
-			return err
-		}
+		msgs, total, err = cp.channelMessages(ctx)
+		return err
+	})
+	return
+}
 
-		q := query.NewQuery(cp.client.API()).Messages().GetHistory(&tg.InputPeerChannel{
-			ChannelID:  cp.id,
-			AccessHash: channel.AccessHash,
-		})
+// channelMessages loads the messages of the channel with a running client.
+func (cp *channelProcessor) channelMessages(ctx context.Context) (msgs []messages.Elem, total int, err error) {
+	channel, err := tgc.GetChannelById(ctx, cp.client.API(), cp.id)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		msgiter := messages.NewIterator(q, 100)
-		total, err = msgiter.Total(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to get total messages: %w", err)
-		}
+	q := query.NewQuery(cp.client.API()).Messages().GetHistory(&tg.InputPeerChannel{
+		ChannelID:  cp.id,
+		AccessHash: channel.AccessHash,
+	})
+
+	msgiter := messages.NewIterator(q, 100)
+	total, err = msgiter.Total(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get total messages: %w", err)
+	}
 
-		processed := 0
-		for msgiter.Next(ctx) {
-			msg := msgiter.Value()
-			msgs = append(msgs, msg)
-			processed++
+	processed := 0
+	for msgiter.Next(ctx) {
+		msg := msgiter.Value()
+		msgs = append(msgs, msg)
+		processed++
 
-			if processed%100 == 0 {
-				progress := (float64(processed) / float64(total)) * 100
-				cp.updateStatus(fmt.Sprintf("Loading messages: %d/%d", processed, total), int64(progress))
-			}
+		if processed%100 == 0 {
+			progress := (float64(processed) / float64(total)) * 100
+			cp.updateStatus(fmt.Sprintf("Loading messages: %d/%d", processed, total), int64(progress))
 		}
-		return nil
-	})
-	return
+	}
+	return msgs, total, nil
 }
 
 func runCheckCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig) {
@@ -419,24 +412,7 @@ func runCheckCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig) {
 	clean, _ := cmd.Flags().GetBool("clean")
 	concurrent, _ := cmd.Flags().GetInt("concurrent")
 
-	pw := progress.NewWriter()
-	pw.SetAutoStop(false)
-	width := 75
-	if size, err := termWidth(); err == nil {
-		width = int((float32(3) / float32(4)) * float32(size))
-	}
-	pw.SetTrackerLength(width / 5)
-	pw.SetMessageLength(width * 3 / 5)
-	pw.SetStyle(progress.StyleDefault)
-	pw.SetTrackerPosition(progress.PositionRight)
-	pw.SetUpdateFrequency(time.Millisecond * 100)
-	pw.Style().Colors = progress.StyleColorsExample
-	pw.Style().Colors.Message = text.Colors{text.FgBlue}
-	pw.Style().Options.PercentFormat = "%4.1f%%"
-	pw.Style().Visibility.Value = false
-	pw.Style().Options.TimeInProgressPrecision = time.Millisecond
-	pw.Style().Options.ErrorString = color.RedString("failed!")
-	pw.Style().Options.DoneString = color.GreenString("done!")
+	pw := newProgressWriter()
 
 	var channelExports []channelExport
 	var mutex sync.Mutex
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/dedupe"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func NewDedupeCmd() *cobra.Command {
+	var cfg config.ServerCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "dedupe",
+		Short: "Find duplicate files and reclaim wasted space",
+		Run: func(cmd *cobra.Command, args []string) {
+			runDedupeCmd(cmd, &cfg)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			if err := checkRequiredCheckFlags(&cfg); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	loader.RegisterPlags(cmd.Flags(), "", cfg, true)
+	cmd.Flags().String("user", "", "Telegram User Name")
+	cmd.Flags().String("action", "report", "Action to apply on duplicates (report, delete, reference)")
+	cmd.Flags().String("keep", "oldest", "File to keep in every group (oldest, newest)")
+	return cmd
+}
+
+func runDedupeCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig) {
+	ctx := cmd.Context()
+
+	lg := logging.DefaultLogger().Sugar()
+
+	defer logging.DefaultLogger().Sync()
+
+	action, _ := cmd.Flags().GetString("action")
+	keep, _ := cmd.Flags().GetString("keep")
+	if keep != "oldest" && keep != "newest" {
+		lg.Fatalw("invalid keep policy", "keep", keep)
+	}
+
+	cfg.DB.LogLevel = "fatal"
+	db, err := database.NewDatabase(&cfg.DB, lg)
+	if err != nil {
+		lg.Fatalw("failed to create database", "err", err)
+	}
+
+	users := []models.User{}
+	if err := db.Model(&models.User{}).Find(&users).Error; err != nil {
+		lg.Fatalw("failed to get users", "err", err)
+	}
+
+	userName, _ := cmd.Flags().GetString("user")
+	user, err := selectUser(userName, users)
+	if err != nil {
+		lg.Fatalw("failed to select user", "err", err)
+	}
+
+	session := models.Session{}
+	if err := db.Model(&models.Session{}).
+		Where("user_id = ?", user.UserId).
+		Order("created_at desc").
+		First(&session).Error; err != nil {
+		lg.Fatalw("failed to get session", "err", err)
+	}
+
+	middlewares := tgc.NewMiddleware(&cfg.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+	client, err := tgc.AuthClient(ctx, &cfg.TG, session.Session, middlewares...)
+	if err != nil {
+		lg.Fatalw("failed to create client", "err", err)
+	}
+
+	report, err := dedupe.Find(ctx, db, client, user.UserId)
+	if err != nil {
+		lg.Fatalw("failed to find duplicates", "err", err)
+	}
+
+	tw := table.NewWriter()
+	tw.SetOutputMirror(os.Stdout)
+	tw.SetStyle(table.StyleLight)
+	tw.AppendHeader(table.Row{"Group", "Size", "Copies", "Wasted", "Path"})
+	for i, group := range report.Groups {
+		for j, f := range group.Files {
+			if j == 0 {
+				tw.AppendRow(table.Row{i + 1, progress.FormatBytes(group.Size), len(group.Files),
+					progress.FormatBytes(group.WastedBytes), f.Path})
+			} else {
+				tw.AppendRow(table.Row{"", "", "", "", f.Path})
+			}
+		}
+		tw.AppendSeparator()
+	}
+	tw.AppendFooter(table.Row{report.TotalGroups, "", report.TotalFiles, progress.FormatBytes(report.WastedBytes), ""})
+	tw.Render()
+
+	if action == "report" || len(report.Groups) == 0 {
+		return
+	}
+
+	resolutions := utils.Map(report.Groups, func(group dedupe.Group) dedupe.Resolution {
+		kept := group.Files[0]
+		if keep == "newest" {
+			kept = group.Files[len(group.Files)-1]
+		}
+		return dedupe.Resolution{
+			Keep:  kept.ID,
+			Files: utils.Map(group.Files, func(f dedupe.File) string { return f.ID }),
+		}
+	})
+
+	// The keys of the groups are checked again before anything is removed,
+	// with a client of its own as the one of Find has stopped.
+	client, err = tgc.AuthClient(ctx, &cfg.TG, session.Session, middlewares...)
+	if err != nil {
+		lg.Fatalw("failed to create client", "err", err)
+	}
+
+	recorder := events.NewRecorder(ctx, db, logging.DefaultLogger())
+
+	res, err := dedupe.Resolve(ctx, db, client, cache.NewCache(ctx, &cfg.Cache), recorder, user.UserId,
+		dedupe.Action(action), resolutions)
+
+	recorder.Shutdown()
+
+	if err != nil {
+		lg.Fatalw("failed to resolve duplicates", "err", err)
+	}
+
+	fmt.Printf("Deleted: %d, Referenced: %d, Reclaimed: %s, Failed: %d\n", res.Deleted, res.Referenced,
+		progress.FormatBytes(res.Reclaimed), len(res.FailedFiles))
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"golang.org/x/sync/errgroup"
+)
+
+func NewExportCmd() *cobra.Command {
+	var cfg config.ServerCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "export <remote-path> <local-dir>",
+		Short: "Download a remote folder to a local directory",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			runExportCmd(cmd, &cfg, args[0], args[1])
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			if err := checkRequiredCheckFlags(&cfg); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	loader.RegisterPlags(cmd.Flags(), "", cfg, true)
+	cmd.Flags().String("user", "", "Telegram User Name")
+	cmd.Flags().Int("concurrent", 4, "Number of files downloaded at once")
+	cmd.Flags().Int("threads", 4, "Number of download threads per file when the channel has bots")
+	cmd.Flags().Int("retries", 3, "Number of retries of a failed download")
+	cmd.Flags().Bool("verify", true, "Verify downloads against the stored sha256 hash")
+	cmd.Flags().String("state", "", "State file to resume from (default $HOME/.teldrive/export-<id>.json)")
+	return cmd
+}
+
+type remoteFile struct {
+	rel  string
+	file models.File
+}
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func runExportCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig, remotePath, localDir string) {
+	ctx := cmd.Context()
+
+	lg := logging.DefaultLogger().Sugar()
+
+	defer logging.DefaultLogger().Sync()
+
+	concurrent, _ := cmd.Flags().GetInt("concurrent")
+	threads, _ := cmd.Flags().GetInt("threads")
+	retries, _ := cmd.Flags().GetInt("retries")
+	verify, _ := cmd.Flags().GetBool("verify")
+	stateFile, _ := cmd.Flags().GetString("state")
+
+	root, err := filepath.Abs(localDir)
+	if err != nil {
+		lg.Fatalw("invalid local directory", "err", err)
+	}
+	remotePath = path.Clean("/" + remotePath)
+
+	db, user := openUser(cmd, cfg, lg)
+	transfer, shutdown := newTransfer(ctx, cfg, db, user.UserId, lg)
+	defer shutdown()
+
+	top, err := transfer.Stat(remotePath)
+	if err != nil {
+		lg.Fatalw("remote path not found", "path", remotePath, "err", err)
+	}
+
+	var (
+		dirs  = []string{"."}
+		files []remoteFile
+		total int64
+	)
+	if top.Type == "folder" {
+		var walk func(id, rel string) error
+		walk = func(id, rel string) error {
+			children, err := transfer.Children(id)
+			if err != nil {
+				return err
+			}
+			for _, child := range children {
+				childRel := path.Join(rel, child.Name)
+				if child.Type == "folder" {
+					dirs = append(dirs, childRel)
+					if err := walk(child.ID, childRel); err != nil {
+						return err
+					}
+					continue
+				}
+				files = append(files, remoteFile{rel: childRel, file: child})
+				if child.Size != nil {
+					total += *child.Size
+				}
+			}
+			return nil
+		}
+		if err := walk(top.ID, "."); err != nil {
+			lg.Fatalw("failed to list remote folder", "err", err)
+		}
+	} else {
+		files = append(files, remoteFile{rel: top.Name, file: *top})
+		if top.Size != nil {
+			total = *top.Size
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			lg.Fatalw("failed to create directory", "dir", dir, "err", err)
+		}
+	}
+
+	state, err := loadTransferState(stateFile, "export", remotePath, root)
+	if err != nil {
+		lg.Fatalw("failed to load state", "err", err)
+	}
+
+	pw := newProgressWriter()
+	go pw.Render()
+	overall := &progress.Tracker{
+		Message: fmt.Sprintf("Exporting %d files from %s", len(files), remotePath),
+		Total:   total,
+		Units:   progress.UnitsBytes,
+	}
+	pw.AppendTracker(overall)
+
+	var (
+		downloaded, skipped atomic.Int64
+		mu                  sync.Mutex
+		failures            = map[string]error{}
+	)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrent)
+
+	for _, f := range files {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var size int64
+			if f.file.Size != nil {
+				size = *f.file.Size
+			}
+			modTime := f.file.UpdatedAt
+			target := filepath.Join(root, filepath.FromSlash(f.rel))
+			entry := transferEntry{Size: size, ModTime: modTime.Unix(), FileId: f.file.ID}
+
+			if info, err := os.Stat(target); err == nil && info.Mode().IsRegular() && info.Size() == size {
+				recorded, ok := state.get(f.rel)
+				if (ok && recorded == entry) || info.ModTime().Unix() == modTime.Unix() {
+					if !ok {
+						state.set(f.rel, entry)
+					}
+					skipped.Add(1)
+					overall.Increment(size)
+					return nil
+				}
+			}
+
+			tracker := &progress.Tracker{Message: f.rel, Total: size, Units: progress.UnitsBytes}
+			pw.AppendTracker(tracker)
+			var hash string
+			if verify && f.file.Hash != nil && sha256Hex.MatchString(*f.file.Hash) {
+				hash = *f.file.Hash
+			}
+			var err error
+			for attempt := 0; ; attempt++ {
+				err = downloadFile(ctx, transfer, &f.file, target, hash, threads, tracker, overall)
+				if err == nil || attempt >= retries || ctx.Err() != nil {
+					break
+				}
+				overall.Increment(-tracker.Value())
+				tracker.SetValue(0)
+				select {
+				case <-time.After(time.Duration(attempt+1) * 2 * time.Second):
+				case <-ctx.Done():
+				}
+			}
+			if err != nil {
+				tracker.MarkAsErrored()
+				mu.Lock()
+				failures[f.rel] = err
+				mu.Unlock()
+				return nil
+			}
+			tracker.MarkAsDone()
+			downloaded.Add(1)
+			if err := state.set(f.rel, entry); err != nil {
+				lg.Warnw("failed to save state", "err", err)
+			}
+			return nil
+		})
+	}
+
+	err = g.Wait()
+	if len(failures) == 0 && err == nil {
+		overall.MarkAsDone()
+	} else {
+		overall.MarkAsErrored()
+	}
+	pw.Stop()
+
+	fmt.Printf("Downloaded: %d, Skipped: %d, Failed: %d\n", downloaded.Load(), skipped.Load(), len(failures))
+	for rel, err := range failures {
+		fmt.Printf("  %s: %v\n", rel, err)
+	}
+	if err != nil {
+		lg.Fatalw("export interrupted", "err", err)
+	}
+	if len(failures) > 0 {
+		lg.Fatal("some files failed to download, run the export again to retry them")
+	}
+}
+
+// downloadFile downloads into a temporary file next to target and moves it in
+// place once the hash matches, so target is either complete or untouched.
+func downloadFile(ctx context.Context, transfer *services.Transfer, file *models.File, target, hash string,
+	threads int, trackers ...*progress.Tracker) error {
+	tmp := target + ".teldrive-part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	sum := sha256.New()
+	err = transfer.Download(ctx, file, io.MultiWriter(&trackedWriter{w: out, trackers: trackers}, sum), threads)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if hash != "" && hex.EncodeToString(sum.Sum(nil)) != hash {
+		return fmt.Errorf("hash mismatch, expected %s", hash)
+	}
+	if err := os.Chtimes(tmp, file.UpdatedAt, file.UpdatedAt); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
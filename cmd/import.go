@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"golang.org/x/sync/errgroup"
+)
+
+func NewImportCmd() *cobra.Command {
+	var cfg config.ServerCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "import <local-dir> <remote-path>",
+		Short: "Upload a local directory tree",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			runImportCmd(cmd, &cfg, args[0], args[1])
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			if err := checkRequiredCheckFlags(&cfg); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	loader.RegisterPlags(cmd.Flags(), "", cfg, true)
+	cmd.Flags().String("user", "", "Telegram User Name")
+	cmd.Flags().Int("concurrent", 4, "Number of files uploaded at once")
+	cmd.Flags().Bool("encrypt", false, "Encrypt uploaded files")
+	cmd.Flags().Bool("hash", true, "Compare hashes of files whose size matches but modification time differs")
+	cmd.Flags().String("state", "", "State file to resume from (default $HOME/.teldrive/import-<id>.json)")
+	return cmd
+}
+
+type localFile struct {
+	rel  string
+	path string
+	info fs.FileInfo
+}
+
+func runImportCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig, localDir, remoteDir string) {
+	ctx := cmd.Context()
+
+	lg := logging.DefaultLogger().Sugar()
+
+	defer logging.DefaultLogger().Sync()
+
+	encrypt, _ := cmd.Flags().GetBool("encrypt")
+	checkHash, _ := cmd.Flags().GetBool("hash")
+	concurrent, _ := cmd.Flags().GetInt("concurrent")
+	stateFile, _ := cmd.Flags().GetString("state")
+
+	if encrypt && cfg.TG.Uploads.EncryptionKey == "" {
+		lg.Fatal("encryption needs tg.uploads.encryption-key to be configured")
+	}
+	root, err := filepath.Abs(localDir)
+	if err != nil {
+		lg.Fatalw("invalid local directory", "err", err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		lg.Fatalw("local directory does not exist", "dir", root)
+	}
+	remoteDir = path.Clean("/" + remoteDir)
+
+	state, err := loadTransferState(stateFile, "import", root, remoteDir)
+	if err != nil {
+		lg.Fatalw("failed to load state", "err", err)
+	}
+
+	var (
+		dirs  []string
+		files []localFile
+		total int64
+	)
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, rel)
+		case d.Type().IsRegular() && p != state.file:
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, localFile{rel: rel, path: p, info: info})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		lg.Fatalw("failed to walk local directory", "err", err)
+	}
+
+	db, user := openUser(cmd, cfg, lg)
+	transfer, shutdown := newTransfer(ctx, cfg, db, user.UserId, lg)
+	defer shutdown()
+
+	folders := map[string]string{}
+	existing := map[string]map[string]models.File{}
+	for _, dir := range dirs {
+		id, err := transfer.Mkdir(path.Join(remoteDir, filepath.ToSlash(dir)))
+		if err != nil {
+			lg.Fatalw("failed to create folder", "dir", dir, "err", err)
+		}
+		children, err := transfer.Children(id)
+		if err != nil {
+			lg.Fatalw("failed to list folder", "dir", dir, "err", err)
+		}
+		folders[dir] = id
+		existing[dir] = map[string]models.File{}
+		for _, child := range children {
+			existing[dir][child.Name] = child
+		}
+	}
+
+	pw := newProgressWriter()
+	go pw.Render()
+	overall := &progress.Tracker{
+		Message: fmt.Sprintf("Importing %d files into %s", len(files), remoteDir),
+		Total:   total,
+		Units:   progress.UnitsBytes,
+	}
+	pw.AppendTracker(overall)
+
+	var (
+		uploaded, skipped atomic.Int64
+		mu                sync.Mutex
+		failures          = map[string]error{}
+	)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrent)
+
+	for _, f := range files {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			dir := filepath.Dir(f.rel)
+			size, modTime := f.info.Size(), f.info.ModTime()
+
+			skip := false
+			if entry, ok := state.get(f.rel); ok && entry.Size == size && entry.ModTime == modTime.Unix() {
+				skip = true
+			} else if remote, ok := existing[dir][f.info.Name()]; ok && remote.Type == "file" &&
+				remote.Size != nil && *remote.Size == size {
+				switch {
+				case remote.UpdatedAt.Unix() == modTime.Unix():
+					skip = true
+				case checkHash && remote.Hash != nil:
+					hash, err := services.FileHash(f.path)
+					skip = err == nil && hash == *remote.Hash
+				}
+				if skip {
+					state.set(f.rel, transferEntry{Size: size, ModTime: modTime.Unix(), FileId: remote.ID})
+				}
+			}
+			if skip {
+				skipped.Add(1)
+				overall.Increment(size)
+				return nil
+			}
+
+			tracker := &progress.Tracker{Message: f.rel, Total: size, Units: progress.UnitsBytes}
+			pw.AppendTracker(tracker)
+			file, err := func() (*models.File, error) {
+				r, err := os.Open(f.path)
+				if err != nil {
+					return nil, err
+				}
+				defer r.Close()
+				return transfer.Upload(ctx, folders[dir], f.info.Name(),
+					&trackedReader{r: r, trackers: []*progress.Tracker{tracker, overall}}, size, modTime, encrypt)
+			}()
+			if err != nil {
+				tracker.MarkAsErrored()
+				mu.Lock()
+				failures[f.rel] = err
+				mu.Unlock()
+				return nil
+			}
+			tracker.MarkAsDone()
+			uploaded.Add(1)
+			if err := state.set(f.rel, transferEntry{Size: size, ModTime: modTime.Unix(), FileId: file.ID}); err != nil {
+				lg.Warnw("failed to save state", "err", err)
+			}
+			return nil
+		})
+	}
+
+	err = g.Wait()
+	if len(failures) == 0 && err == nil {
+		overall.MarkAsDone()
+	} else {
+		overall.MarkAsErrored()
+	}
+	pw.Stop()
+
+	fmt.Printf("Uploaded: %d, Skipped: %d, Failed: %d\n", uploaded.Load(), skipped.Load(), len(failures))
+	for rel, err := range failures {
+		fmt.Printf("  %s: %v\n", rel, err)
+	}
+	if err != nil {
+		lg.Fatalw("import interrupted", "err", err)
+	}
+	if len(failures) > 0 {
+		lg.Fatal("some files failed to upload, run the import again to retry them")
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/jedib0t/go-pretty/v6/text"
+	"golang.org/x/term"
+)
+
+var termWidth = func() (width int, err error) {
+	width, _, err = term.GetSize(int(os.Stdout.Fd()))
+	if err == nil {
+		return width, nil
+	}
+
+	return 0, err
+}
+
+func newProgressWriter() progress.Writer {
+	pw := progress.NewWriter()
+	pw.SetAutoStop(false)
+	width := 75
+	if size, err := termWidth(); err == nil {
+		width = int((float32(3) / float32(4)) * float32(size))
+	}
+	pw.SetTrackerLength(width / 5)
+	pw.SetMessageLength(width * 3 / 5)
+	pw.SetStyle(progress.StyleDefault)
+	pw.SetTrackerPosition(progress.PositionRight)
+	pw.SetUpdateFrequency(time.Millisecond * 100)
+	pw.Style().Colors = progress.StyleColorsExample
+	pw.Style().Colors.Message = text.Colors{text.FgBlue}
+	pw.Style().Options.PercentFormat = "%4.1f%%"
+	pw.Style().Visibility.Value = false
+	pw.Style().Options.TimeInProgressPrecision = time.Millisecond
+	pw.Style().Options.ErrorString = color.RedString("failed!")
+	pw.Style().Options.DoneString = color.GreenString("done!")
+	return pw
+}
+
+// trackedReader advances trackers by the bytes read.
+type trackedReader struct {
+	r        io.Reader
+	trackers []*progress.Tracker
+}
+
+func (t *trackedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for _, tracker := range t.trackers {
+		tracker.Increment(int64(n))
+	}
+	return n, err
+}
+
+// trackedWriter advances trackers by the bytes written.
+type trackedWriter struct {
+	w        io.Writer
+	trackers []*progress.Tracker
+}
+
+func (t *trackedWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	for _, tracker := range t.trackers {
+		tracker.Increment(int64(n))
+	}
+	return n, err
+}
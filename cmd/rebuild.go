@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/telegram/query/messages"
+	"github.com/gotd/td/tg"
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"golang.org/x/sync/errgroup"
+)
+
+func NewRebuildCmd() *cobra.Command {
+	var cfg config.ServerCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "rebuild",
+		Short: "Recover files from storage channels which are missing in the database",
+		Run: func(cmd *cobra.Command, args []string) {
+			runRebuildCmd(cmd, &cfg)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			if err := checkRequiredCheckFlags(&cfg); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	loader.RegisterPlags(cmd.Flags(), "", cfg, true)
+	cmd.Flags().String("user", "", "Telegram User Name")
+	cmd.Flags().Int64Slice("channel", nil, "Channel to scan besides the channels of the user")
+	cmd.Flags().String("folder", "/Recovered", "Folder recovered files are created in, one subfolder per channel")
+	cmd.Flags().Bool("dry-run", false, "Only report what would be recovered")
+	cmd.Flags().Int("concurrent", 4, "Number of concurrent channel processing")
+	return cmd
+}
+
+// partName matches the messages of files uploaded in several parts.
+var partName = regexp.MustCompile(`^(.+)\.part\.(\d{3,})$`)
+
+type channelDocument struct {
+	id   int
+	name string
+	size int64
+	date time.Time
+	doc  *tg.Document
+}
+
+// recoveredFile is a file put back together from the messages of a channel.
+// reason tells why it cannot be recovered.
+type recoveredFile struct {
+	channelId int64
+	name      string
+	size      int64
+	parts     []int
+	date      time.Time
+	reason    string
+	partSizes []int64
+	first     *channelDocument
+	next      int
+}
+
+// groupDocuments puts the parts of uploads back together. Parts of one upload
+// are named name.part.001, name.part.002 and so on and are sent in order,
+// though parts of uploads running at the same time interleave. Parts only
+// carry their number, so a missing last part is only noticed when it leaves
+// the parts with different sizes.
+func groupDocuments(channelId int64, docs []channelDocument) []*recoveredFile {
+	sort.Slice(docs, func(i, j int) bool { return docs[i].id < docs[j].id })
+	var (
+		files []*recoveredFile
+		open  = map[string]*recoveredFile{}
+	)
+	for i := range docs {
+		d := &docs[i]
+		m := partName.FindStringSubmatch(d.name)
+		if m == nil {
+			files = append(files, &recoveredFile{channelId: channelId, name: d.name, size: d.size,
+				parts: []int{d.id}, date: d.date, first: d})
+			continue
+		}
+		base := m[1]
+		no, _ := strconv.Atoi(m[2])
+		f := open[base]
+		if no == 1 || f == nil || f.next != no {
+			if f != nil && no != 1 && f.reason == "" {
+				f.reason = fmt.Sprintf("part %d is missing", f.next)
+			}
+			f = &recoveredFile{channelId: channelId, name: base, first: d}
+			if no != 1 {
+				f.reason = fmt.Sprintf("parts before %d are missing", no)
+			}
+			open[base] = f
+			files = append(files, f)
+		}
+		f.parts = append(f.parts, d.id)
+		f.partSizes = append(f.partSizes, d.size)
+		f.size += d.size
+		f.date = d.date
+		f.next = no + 1
+	}
+	for _, f := range files {
+		if f.reason != "" || len(f.partSizes) < 2 {
+			continue
+		}
+		// All parts but the last have the part size of the upload.
+		for i, size := range f.partSizes {
+			if (i < len(f.partSizes)-1 && size != f.partSizes[0]) || size > f.partSizes[0] {
+				f.reason = "part sizes differ, parts are missing"
+				break
+			}
+		}
+	}
+	return files
+}
+
+func runRebuildCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig) {
+	ctx := cmd.Context()
+
+	lg := logging.DefaultLogger().Sugar()
+
+	defer logging.DefaultLogger().Sync()
+
+	extraChannels, _ := cmd.Flags().GetInt64Slice("channel")
+	folder, _ := cmd.Flags().GetString("folder")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	concurrent, _ := cmd.Flags().GetInt("concurrent")
+
+	db, user := openUser(cmd, cfg, lg)
+	userId := user.UserId
+	transfer, shutdown := newTransfer(ctx, cfg, db, userId, lg)
+	defer shutdown()
+
+	session := models.Session{}
+	if err := db.Model(&models.Session{}).
+		Where("user_id = ?", userId).
+		Order("created_at desc").
+		First(&session).Error; err != nil {
+		lg.Fatalw("failed to get session", "err", err)
+	}
+
+	channelIds := []int64{}
+	if err := db.Model(&models.Channel{}).
+		Where("user_id = ?", userId).
+		Pluck("channel_id", &channelIds).Error; err != nil {
+		lg.Fatalw("failed to get channels", "err", err)
+	}
+	for _, id := range extraChannels {
+		if !slices.Contains(channelIds, id) {
+			channelIds = append(channelIds, id)
+		}
+	}
+	if len(channelIds) == 0 {
+		lg.Fatal("no channels found, pass them with --channel")
+	}
+
+	middlewares := tgc.NewMiddleware(&cfg.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+
+	pw := newProgressWriter()
+	go pw.Render()
+
+	var (
+		recovered []*recoveredFile
+		mu        sync.Mutex
+	)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrent)
+
+	for _, id := range channelIds {
+		g.Go(func() error {
+			client, err := tgc.AuthClient(ctx, &cfg.TG, session.Session, middlewares...)
+			if err != nil {
+				return fmt.Errorf("failed to create client for channel %d: %w", id, err)
+			}
+			tracker := &progress.Tracker{
+				Message: fmt.Sprintf("Channel %d: Initializing", id),
+				Total:   100,
+				Units:   progress.UnitsDefault,
+			}
+			pw.AppendTracker(tracker)
+
+			cp := &channelProcessor{id: id, client: client, ctx: ctx, db: db, userId: userId, pw: pw, tracker: tracker}
+			files, err := rebuildChannel(cp)
+			if err != nil {
+				tracker.MarkAsErrored()
+				return fmt.Errorf("channel %d: %w", id, err)
+			}
+			mu.Lock()
+			recovered = append(recovered, files...)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		pw.Stop()
+		lg.Fatalw("failed to scan channels", "err", err)
+	}
+	pw.Stop()
+
+	sort.Slice(recovered, func(i, j int) bool {
+		if recovered[i].channelId != recovered[j].channelId {
+			return recovered[i].channelId < recovered[j].channelId
+		}
+		return recovered[i].parts[0] < recovered[j].parts[0]
+	})
+
+	var (
+		created, skipped, failed int
+		size                     int64
+	)
+	folders := map[int64]string{}
+	tw := table.NewWriter()
+	tw.SetOutputMirror(os.Stdout)
+	tw.SetStyle(table.StyleLight)
+	tw.AppendHeader(table.Row{"Channel", "Name", "Parts", "Size", "Status"})
+	for _, f := range recovered {
+		status := "recover"
+		switch {
+		case f.reason != "":
+			status = f.reason
+			skipped++
+		case dryRun:
+			created++
+			size += f.size
+		default:
+			err := func() error {
+				parentId, ok := folders[f.channelId]
+				if !ok {
+					id, err := transfer.Mkdir(path.Join(folder, strconv.FormatInt(f.channelId, 10)))
+					if err != nil {
+						return err
+					}
+					parentId, folders[f.channelId] = id, id
+				}
+				_, err := transfer.Recover(ctx, parentId, f.name, f.channelId, f.parts, f.size, f.date)
+				return err
+			}()
+			if err != nil {
+				status = "failed: " + err.Error()
+				failed++
+			} else {
+				status = "recovered"
+				created++
+				size += f.size
+			}
+		}
+		tw.AppendRow(table.Row{f.channelId, f.name, len(f.parts), progress.FormatBytes(f.size), status})
+	}
+	tw.Render()
+
+	if dryRun {
+		fmt.Printf("Recoverable: %d (%s), Not recoverable: %d\n", created, progress.FormatBytes(size), skipped)
+		return
+	}
+	fmt.Printf("Recovered: %d (%s) into %s, Not recoverable: %d, Failed: %d\n", created, progress.FormatBytes(size),
+		folder, skipped, failed)
+	if failed > 0 {
+		lg.Fatal("some files failed to be recovered")
+	}
+}
+
+// rebuildChannel finds the files in a channel whose messages no file or
+// upload refers to.
+func rebuildChannel(cp *channelProcessor) ([]*recoveredFile, error) {
+	cp.updateStatus("Loading files", 0)
+	files, err := cp.loadFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+	known := map[int]bool{}
+	for _, f := range files {
+		for _, p := range f.Parts {
+			known[p.ID] = true
+		}
+	}
+	uploadPartIds := []int{}
+	if err := cp.db.Model(&models.Upload{}).
+		Where("user_id = ?", cp.userId).
+		Where("channel_id = ?", cp.id).
+		Pluck("part_id", &uploadPartIds).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range uploadPartIds {
+		known[id] = true
+	}
+
+	// The client runs once, messages are loaded and checked in the same run.
+	var recovered []*recoveredFile
+	err = tgc.RunWithAuth(cp.ctx, cp.client, "", func(ctx context.Context) error {
+		cp.updateStatus("Loading messages from Telegram", 0)
+		msgs, total, err := cp.channelMessages(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load messages: %w", err)
+		}
+		if len(msgs) < total {
+			return fmt.Errorf("found %d messages out of %d", len(msgs), total)
+		}
+
+		var docs []channelDocument
+		for _, m := range msgs {
+			if known[m.Msg.GetID()] {
+				continue
+			}
+			if d, ok := channelDocumentOf(m); ok {
+				docs = append(docs, d)
+			}
+		}
+
+		cp.updateStatus("Checking recovered files", 0)
+		recovered = groupDocuments(cp.id, docs)
+		for i, f := range recovered {
+			if f.reason != "" {
+				continue
+			}
+			// The salt of encrypted parts is only stored in the database.
+			head, err := tgc.GetChunk(ctx, cp.client.API(), f.first.doc.AsInputDocumentFileLocation(), 0, 4096)
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(head, []byte("TELDRIVE\x00\x00")) {
+				f.reason = "encrypted, the salt is lost with the database"
+			}
+			cp.updateStatus(fmt.Sprintf("Checking recovered files: %d/%d", i+1, len(recovered)),
+				int64(float64(i+1)/float64(len(recovered))*100))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cp.updateStatus(fmt.Sprintf("Found %d files", len(recovered)), 100)
+	return recovered, nil
+}
+
+func channelDocumentOf(m messages.Elem) (channelDocument, bool) {
+	doc, ok := m.Document()
+	if !ok {
+		return channelDocument{}, false
+	}
+	msg, ok := m.Msg.(*tg.Message)
+	if !ok {
+		return channelDocument{}, false
+	}
+	for _, attr := range doc.Attributes {
+		if name, ok := attr.(*tg.DocumentAttributeFilename); ok {
+			return channelDocument{id: msg.ID, name: name.FileName, size: doc.Size,
+				date: time.Unix(int64(msg.Date), 0).UTC(), doc: doc}, true
+		}
+	}
+	return channelDocument{}, false
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGroupDocuments(t *testing.T) {
+	docs := []channelDocument{
+		{id: 1, name: "a.mkv.part.001", size: 100},
+		{id: 2, name: "b.zip.part.001", size: 50},
+		{id: 3, name: "a.mkv.part.002", size: 100},
+		{id: 4, name: "notes.txt", size: 7},
+		{id: 5, name: "b.zip.part.002", size: 20},
+		{id: 6, name: "a.mkv.part.003", size: 30},
+		{id: 7, name: "c.iso.part.002", size: 100},
+		{id: 8, name: "c.iso.part.003", size: 10},
+		{id: 9, name: "d.bin.part.001", size: 100},
+		{id: 10, name: "d.bin.part.003", size: 10},
+		{id: 11, name: "e.tar.part.001", size: 100},
+		{id: 12, name: "e.tar.part.002", size: 60},
+		{id: 13, name: "e.tar.part.003", size: 100},
+		{id: 14, name: "f.img.part.001", size: 50},
+		{id: 15, name: "f.img.part.002", size: 100},
+		{id: 16, name: "g.mp4.part.001", size: 100},
+		{id: 17, name: "g.mp4.part.002", size: 100},
+	}
+	// Shuffle the order the messages were loaded in.
+	slices.Reverse(docs)
+
+	want := []struct {
+		name   string
+		parts  []int
+		size   int64
+		reason string
+	}{
+		{name: "a.mkv", parts: []int{1, 3, 6}, size: 230},
+		{name: "b.zip", parts: []int{2, 5}, size: 70},
+		{name: "notes.txt", parts: []int{4}, size: 7},
+		{name: "c.iso", parts: []int{7, 8}, size: 110, reason: "parts before 2 are missing"},
+		{name: "d.bin", parts: []int{9}, size: 100, reason: "part 2 is missing"},
+		{name: "d.bin", parts: []int{10}, size: 10, reason: "parts before 3 are missing"},
+		{name: "e.tar", parts: []int{11, 12, 13}, size: 260, reason: "part sizes differ, parts are missing"},
+		{name: "f.img", parts: []int{14, 15}, size: 150, reason: "part sizes differ, parts are missing"},
+		// A missing last part leaves parts of one size, it is not noticed.
+		{name: "g.mp4", parts: []int{16, 17}, size: 200},
+	}
+
+	files := groupDocuments(42, docs)
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(files), len(want))
+	}
+	for i, f := range files {
+		w := want[i]
+		if f.channelId != 42 || f.name != w.name || !slices.Equal(f.parts, w.parts) || f.size != w.size ||
+			f.reason != w.reason {
+			t.Errorf("file %d = %s %v %d %q, want %s %v %d %q", i, f.name, f.parts, f.size, f.reason,
+				w.name, w.parts, w.size, w.reason)
+		}
+	}
+}
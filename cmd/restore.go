@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/backup"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+func NewRestoreMetadataCmd() *cobra.Command {
+	var cfg config.ServerCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "restore-metadata [backup-file]",
+		Short: "Restore a metadata backup into an empty database",
+		Long: "Restore a metadata backup into an empty database.\n" +
+			"Without a backup file the latest backup of the user is downloaded from the backup channel (backup.channel-id),\n" +
+			"which needs the user to have logged in to the new database.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			runRestoreMetadataCmd(cmd, &cfg, args)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			if err := checkRequiredCheckFlags(&cfg); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	loader.RegisterPlags(cmd.Flags(), "", cfg, true)
+	cmd.Flags().String("user", "", "Telegram User Name")
+	return cmd
+}
+
+func runRestoreMetadataCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig, args []string) {
+	ctx := cmd.Context()
+
+	lg := logging.DefaultLogger().Sugar()
+
+	defer logging.DefaultLogger().Sync()
+
+	var (
+		db   *gorm.DB
+		data []byte
+		err  error
+	)
+	if len(args) == 1 {
+		if data, err = os.ReadFile(args[0]); err != nil {
+			lg.Fatalw("failed to read backup", "err", err)
+		}
+		cfg.DB.LogLevel = "fatal"
+		if db, err = database.NewDatabase(&cfg.DB, lg); err != nil {
+			lg.Fatalw("failed to create database", "err", err)
+		}
+	} else {
+		if cfg.Backup.ChannelId == 0 {
+			lg.Fatal("pass a backup file or set backup.channel-id")
+		}
+		var user *models.User
+		db, user = openUser(cmd, cfg, lg)
+		session := models.Session{}
+		if err := db.Model(&models.Session{}).
+			Where("user_id = ?", user.UserId).
+			Order("created_at desc").
+			First(&session).Error; err != nil {
+			lg.Fatalw("failed to get session", "err", err)
+		}
+		middlewares := tgc.NewMiddleware(&cfg.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+		client, err := tgc.AuthClient(ctx, &cfg.TG, session.Session, middlewares...)
+		if err != nil {
+			lg.Fatalw("failed to create client", "err", err)
+		}
+		var name string
+		if name, data, err = backup.Latest(ctx, client, cfg.Backup.ChannelId, user.UserId); err != nil {
+			lg.Fatalw("failed to download backup", "err", err)
+		}
+		lg.Infow("downloaded backup", "name", name)
+	}
+
+	m, err := backup.Decode(bytes.NewReader(data), cfg.Backup.EncryptionKey)
+	if err != nil {
+		lg.Fatalw("failed to read backup", "err", err)
+	}
+	if err := backup.Restore(db, m); err != nil {
+		lg.Fatalw("failed to restore backup", "err", err)
+	}
+	fmt.Printf("Restored %d files, %d shares, %d bots and %d channels of %s from %s\n", len(m.Files), len(m.Shares),
+		len(m.Bots), len(m.Channels), m.User.UserName, m.CreatedAt.Format("2006-01-02 15:04:05"))
+}
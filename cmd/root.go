@@ -12,6 +12,6 @@ func New() *cobra.Command {
 			cmd.Help()
 		},
 	}
-	cmd.AddCommand(NewRun(), NewCheckCmd(), NewUpdateCmd(), NewVersion())
+	cmd.AddCommand(NewRun(), NewCheckCmd(), NewDedupeCmd(), NewImportCmd(), NewExportCmd(), NewWatchCmd(), NewRebuildCmd(), NewRestoreMetadataCmd(), NewUpdateCmd(), NewVersion())
 	return cmd
 }
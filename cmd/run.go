@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"time"
 
@@ -24,11 +25,14 @@ import (
 	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/logging"
 	"github.com/tgdrive/teldrive/internal/middleware"
+	"github.com/tgdrive/teldrive/internal/reader"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/tgstorage"
+	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/ui"
 
 	"github.com/tgdrive/teldrive/pkg/cron"
+	"github.com/tgdrive/teldrive/pkg/jobs"
 	"github.com/tgdrive/teldrive/pkg/services"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -95,10 +99,22 @@ func runApplication(ctx context.Context, conf *config.ServerCmdConfig) {
 		conf.Server.Port = port
 	}
 
+	if conf.TG.Uploads.SpoolDir == "" {
+		conf.TG.Uploads.SpoolDir = filepath.Join(utils.DataDir(), "uploads")
+	}
+
 	scheduler := gocron.NewScheduler(time.UTC)
 
 	cacher := cache.NewCache(ctx, &conf.Cache)
 
+	if conf.Cache.DiskPath != "" {
+		chunkCache, err := cache.NewDiskCache(conf.Cache.DiskPath, conf.Cache.DiskSize)
+		if err != nil {
+			lg.Fatalw("failed to open disk chunk cache", "err", err)
+		}
+		reader.SetChunkCache(chunkCache)
+	}
+
 	db, err := database.NewDatabase(&conf.DB, lg)
 	if err != nil {
 		lg.Fatalw("failed to connect to database", "err", err)
@@ -178,14 +194,20 @@ func runApplication(ctx context.Context, conf *config.ServerCmdConfig) {
 
 	worker := tgc.NewBotWorker()
 
+	clients := tgc.NewClientManager(ctx, tgdb, &conf.TG, worker)
+
 	logger := logging.DefaultLogger()
 
 	eventRecorder := events.NewRecorder(ctx, db, logger)
 
-	srv := setupServer(conf, db, cacher, logger, tgdb, worker, eventRecorder)
+	jobManager := jobs.NewManager(db, eventRecorder, &conf.Jobs)
+
+	srv, s3Srv, sftpSrv := setupServer(ctx, conf, db, cacher, logger, tgdb, worker, clients, eventRecorder, jobManager)
 
 	cron.StartCronJobs(ctx, scheduler, db, conf)
 
+	jobManager.Start(ctx)
+
 	go func() {
 		lg.Infof("Server started at http://localhost:%d", conf.Server.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -193,10 +215,30 @@ func runApplication(ctx context.Context, conf *config.ServerCmdConfig) {
 		}
 	}()
 
+	if s3Srv != nil {
+		go func() {
+			lg.Infof("S3 API started at http://localhost:%d", conf.S3.Port)
+			if err := s3Srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				lg.Errorw("failed to start s3 server", "err", err)
+			}
+		}()
+	}
+
+	if sftpSrv != nil {
+		go func() {
+			lg.Infof("SFTP server started at sftp://localhost:%d", conf.SFTP.Port)
+			if err := sftpSrv.ListenAndServe(); err != nil {
+				lg.Errorw("failed to start sftp server", "err", err)
+			}
+		}()
+	}
+
 	<-ctx.Done()
 
 	lg.Info("Shutting down server...")
 
+	jobManager.Wait()
+
 	eventRecorder.Shutdown()
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), conf.Server.GracefulShutdown)
@@ -207,12 +249,26 @@ func runApplication(ctx context.Context, conf *config.ServerCmdConfig) {
 		lg.Errorw("server shutdown failed", "err", err)
 	}
 
+	if s3Srv != nil {
+		if err := s3Srv.Shutdown(shutdownCtx); err != nil {
+			lg.Errorw("s3 server shutdown failed", "err", err)
+		}
+	}
+
+	if sftpSrv != nil {
+		if err := sftpSrv.Shutdown(shutdownCtx); err != nil {
+			lg.Errorw("sftp server shutdown failed", "err", err)
+		}
+	}
+
 	lg.Info("Server stopped")
 }
 
-func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, lg *zap.Logger, tgdb *gorm.DB, worker *tgc.BotWorker, eventRecorder *events.Recorder) *http.Server {
+func setupServer(ctx context.Context, cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, lg *zap.Logger, tgdb *gorm.DB, worker *tgc.BotWorker, clients *tgc.ClientManager, eventRecorder *events.Recorder, jobManager *jobs.Manager) (*http.Server, *http.Server, *services.SFTPServer) {
+
+	apiSrv := services.NewApiService(db, cfg, cache, tgdb, worker, clients, eventRecorder, jobManager)
 
-	apiSrv := services.NewApiService(db, cfg, cache, tgdb, worker, eventRecorder)
+	services.StartContentIndexer(ctx, apiSrv)
 
 	srv, err := api.NewServer(apiSrv, auth.NewSecurityHandler(db, cache, &cfg.JWT))
 
@@ -220,7 +276,9 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 		lg.Fatal("failed to create server", zap.Error(err))
 	}
 
-	extendedSrv := services.NewExtendedMiddleware(srv, services.NewExtendedService(apiSrv))
+	extendedApi := services.NewExtendedService(apiSrv)
+
+	extendedSrv := services.NewExtendedMiddleware(srv, extendedApi)
 
 	mux := chi.NewRouter()
 
@@ -228,7 +286,10 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "HEAD"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type",
+			"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset"},
+		ExposedHeaders: []string{"X-Next-Cursor", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+			"Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Metadata"},
 		MaxAge:         86400,
 	}))
 	mux.Use(chimiddleware.RealIP)
@@ -242,8 +303,35 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 	}))
 	mux.Use(appcontext.Middleware)
 	mux.Mount("/api/", http.StripPrefix("/api", extendedSrv))
+	mux.Handle("/dav", extendedApi.WebDAV())
+	mux.Handle("/dav/*", extendedApi.WebDAV())
 	mux.Handle("/*", middleware.SPAHandler(ui.StaticFS))
 
+	var s3Srv *http.Server
+	if cfg.S3.Enable {
+		s3Mux := chi.NewRouter()
+		s3Mux.Use(chimiddleware.Recoverer)
+		s3Mux.Use(middleware.InjectLogger(lg))
+		s3Mux.Use(chizap.ChizapWithConfig(lg, &chizap.Config{TimeFormat: time.RFC3339, UTC: true}))
+		s3Mux.Handle("/*", services.NewS3Handler(apiSrv))
+		s3Srv = &http.Server{
+			Addr:              fmt.Sprintf(":%d", cfg.S3.Port),
+			Handler:           s3Mux,
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+		}
+	}
+
+	var sftpSrv *services.SFTPServer
+	if cfg.SFTP.Enable {
+		sftpSrv, err = services.NewSFTPServer(apiSrv)
+		if err != nil {
+			lg.Fatal("failed to create sftp server", zap.Error(err))
+		}
+	}
+
 	return &http.Server{
 		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
 		Handler:           mux,
@@ -251,5 +339,5 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 		WriteTimeout:      cfg.Server.WriteTimeout,
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       60 * time.Second,
-	}
+	}, s3Srv, sftpSrv
 }
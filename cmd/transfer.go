@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/md5"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/tgstorage"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/jobs"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// openUser connects to the database and picks the user chosen with --user.
+func openUser(cmd *cobra.Command, cfg *config.ServerCmdConfig, lg *zap.SugaredLogger) (*gorm.DB, *models.User) {
+	cfg.DB.LogLevel = "fatal"
+	db, err := database.NewDatabase(&cfg.DB, lg)
+	if err != nil {
+		lg.Fatalw("failed to create database", "err", err)
+	}
+
+	users := []models.User{}
+	if err := db.Model(&models.User{}).Find(&users).Error; err != nil {
+		lg.Fatalw("failed to get users", "err", err)
+	}
+
+	userName, _ := cmd.Flags().GetString("user")
+	user, err := selectUser(userName, users)
+	if err != nil {
+		lg.Fatalw("failed to select user", "err", err)
+	}
+	return db, user
+}
+
+// newTransfer sets up what the server would to move files of a user. The
+// returned func releases it.
+func newTransfer(ctx context.Context, cfg *config.ServerCmdConfig, db *gorm.DB, userId int64, lg *zap.SugaredLogger) (*services.Transfer, func()) {
+	tgdb, err := tgstorage.NewDatabase(cfg.TG.StorageFile)
+	if err != nil {
+		lg.Fatalw("failed to create tg db", "err", err)
+	}
+	if err := tgstorage.MigrateDB(tgdb); err != nil {
+		lg.Fatalw("failed to migrate tg db", "err", err)
+	}
+
+	worker := tgc.NewBotWorker()
+	clients := tgc.NewClientManager(ctx, tgdb, &cfg.TG, worker)
+	recorder := events.NewRecorder(ctx, db, logging.DefaultLogger())
+	apiSrv := services.NewApiService(db, cfg, cache.NewCache(ctx, &cfg.Cache), tgdb, worker, clients, recorder,
+		jobs.NewManager(db, recorder, &cfg.Jobs))
+
+	transfer, err := services.NewTransfer(apiSrv, userId)
+	if err != nil {
+		lg.Fatalw("failed to get session", "err", err)
+	}
+	return transfer, recorder.Shutdown
+}
+
+// transferState remembers the files a transfer has finished so an interrupted
+// run picks up where it stopped. Entries are keyed by relative path.
+type transferState struct {
+	file  string
+	mu    sync.Mutex
+	Files map[string]transferEntry `json:"files"`
+}
+
+type transferEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	FileId  string `json:"fileId"`
+}
+
+// loadTransferState reads the state file, by default one per source and
+// destination in the teldrive directory.
+func loadTransferState(file, kind, src, dst string) (*transferState, error) {
+	if file == "" {
+		file = filepath.Join(utils.DataDir(), fmt.Sprintf("%s-%s.json", kind, md5.FromString(src + "\x00" + dst)[:12]))
+	}
+	st := &transferState{file: file, Files: map[string]transferEntry{}}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", file, err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]transferEntry{}
+	}
+	return st, nil
+}
+
+func (st *transferState) get(rel string) (transferEntry, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry, ok := st.Files[rel]
+	return entry, ok
+}
+
+// set records a finished file and writes the state, through a temporary file
+// so a crash never leaves it truncated.
+func (st *transferState) set(rel string, entry transferEntry) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Files[rel] = entry
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := st.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.file)
+}
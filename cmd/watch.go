@@ -0,0 +1,378 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"go.uber.org/zap"
+)
+
+func NewWatchCmd() *cobra.Command {
+	var cfg config.ServerCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "watch <local-dir>[=<remote-path>]...",
+		Short: "Upload files appearing in local directories",
+		Long: "Upload files appearing in local directories once nobody has written to them for a while.\n" +
+			"Directories without a remote path are uploaded to the folder of the channel bot (bot.parent-id).",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			runWatchCmd(cmd, &cfg, args)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			if err := checkRequiredCheckFlags(&cfg); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	loader.RegisterPlags(cmd.Flags(), "", cfg, true)
+	cmd.Flags().String("user", "", "Telegram User Name")
+	cmd.Flags().Duration("stable", 10*time.Second, "Time without writes before a file is uploaded")
+	cmd.Flags().Int("concurrent", 2, "Number of files uploaded at once")
+	cmd.Flags().Bool("encrypt", false, "Encrypt uploaded files")
+	cmd.Flags().String("after", "keep", "What to do with local files after a verified upload: keep, delete or move")
+	cmd.Flags().String("move-to", "", "Directory uploaded files are moved to with --after move")
+	return cmd
+}
+
+type watchRoot struct {
+	local  string
+	remote string
+}
+
+type watchResult struct {
+	path string
+	err  error
+}
+
+// watcher uploads the files of the watched roots. pending holds the time a
+// file is due for upload, every write pushes it back by the stable duration.
+type watcher struct {
+	transfer *services.Transfer
+	fsw      *fsnotify.Watcher
+	roots    []watchRoot
+	stable   time.Duration
+	encrypt  bool
+	after    string
+	moveTo   string
+	lg       *zap.SugaredLogger
+	pending  map[string]time.Time
+	inflight map[string]bool
+	mu       sync.Mutex
+	folders  map[string]string
+}
+
+func runWatchCmd(cmd *cobra.Command, cfg *config.ServerCmdConfig, args []string) {
+	ctx := cmd.Context()
+
+	lg := logging.DefaultLogger().Sugar()
+
+	defer logging.DefaultLogger().Sync()
+
+	stable, _ := cmd.Flags().GetDuration("stable")
+	concurrent, _ := cmd.Flags().GetInt("concurrent")
+	encrypt, _ := cmd.Flags().GetBool("encrypt")
+	after, _ := cmd.Flags().GetString("after")
+	moveTo, _ := cmd.Flags().GetString("move-to")
+
+	if encrypt && cfg.TG.Uploads.EncryptionKey == "" {
+		lg.Fatal("encryption needs tg.uploads.encryption-key to be configured")
+	}
+	switch after {
+	case "keep", "delete":
+	case "move":
+		if moveTo == "" {
+			lg.Fatal("--after move needs --move-to")
+		}
+		var err error
+		if moveTo, err = filepath.Abs(moveTo); err != nil {
+			lg.Fatalw("invalid move-to directory", "err", err)
+		}
+	default:
+		lg.Fatalw("invalid --after, expected keep, delete or move", "after", after)
+	}
+
+	db, user := openUser(cmd, cfg, lg)
+	transfer, shutdown := newTransfer(ctx, cfg, db, user.UserId, lg)
+	defer shutdown()
+
+	// Like files posted to the channel, files go to the bot folder by default.
+	defaultRemote := "/"
+	if cfg.Bot.ParentId != "" {
+		p, err := transfer.PathOf(cfg.Bot.ParentId)
+		if err != nil {
+			lg.Fatalw("failed to find bot parent folder", "id", cfg.Bot.ParentId, "err", err)
+		}
+		defaultRemote = p
+	}
+
+	var roots []watchRoot
+	for _, arg := range args {
+		local, remote, ok := strings.Cut(arg, "=")
+		if !ok {
+			remote = defaultRemote
+		}
+		local, err := filepath.Abs(local)
+		if err != nil {
+			lg.Fatalw("invalid local directory", "dir", local, "err", err)
+		}
+		if info, err := os.Stat(local); err != nil || !info.IsDir() {
+			lg.Fatalw("local directory does not exist", "dir", local)
+		}
+		if moveTo != "" && isWithin(local, moveTo) {
+			lg.Fatalw("move-to directory must be outside of watched directories", "dir", local)
+		}
+		roots = append(roots, watchRoot{local: local, remote: path.Clean("/" + remote)})
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		lg.Fatalw("failed to create watcher", "err", err)
+	}
+	defer fsw.Close()
+
+	w := &watcher{
+		transfer: transfer,
+		fsw:      fsw,
+		roots:    roots,
+		stable:   stable,
+		encrypt:  encrypt,
+		after:    after,
+		moveTo:   moveTo,
+		lg:       lg,
+		pending:  map[string]time.Time{},
+		inflight: map[string]bool{},
+		folders:  map[string]string{},
+	}
+	for _, root := range roots {
+		if err := w.addTree(root.local); err != nil {
+			lg.Fatalw("failed to watch directory", "dir", root.local, "err", err)
+		}
+		lg.Infow("watching", "dir", root.local, "remote", root.remote)
+	}
+	w.run(ctx, concurrent)
+}
+
+func isWithin(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// addTree watches dir and its subdirectories and queues the files in them.
+func (w *watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return w.fsw.Add(p)
+		}
+		if d.Type().IsRegular() {
+			w.pending[p] = time.Now()
+		}
+		return nil
+	})
+}
+
+func (w *watcher) run(ctx context.Context, concurrent int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	results := make(chan watchResult)
+
+	for {
+		select {
+		case <-ctx.Done():
+			for len(w.inflight) > 0 {
+				res := <-results
+				delete(w.inflight, res.path)
+			}
+			return
+		case ev := <-w.fsw.Events:
+			w.handleEvent(ev)
+		case err := <-w.fsw.Errors:
+			w.lg.Warnw("watch error", "err", err)
+		case res := <-results:
+			delete(w.inflight, res.path)
+			if res.err != nil && ctx.Err() == nil {
+				w.lg.Errorw("upload failed, retrying in a minute", "file", res.path, "err", res.err)
+				if _, ok := w.pending[res.path]; !ok {
+					w.pending[res.path] = time.Now().Add(time.Minute)
+				}
+			}
+		case now := <-ticker.C:
+			for p, due := range w.pending {
+				if len(w.inflight) >= concurrent {
+					break
+				}
+				if now.Before(due) || w.inflight[p] {
+					continue
+				}
+				info, err := os.Lstat(p)
+				if err != nil || !info.Mode().IsRegular() {
+					delete(w.pending, p)
+					continue
+				}
+				// Writes may have been missed while the watch was set up.
+				if ready := info.ModTime().Add(w.stable); now.Before(ready) {
+					w.pending[p] = ready
+					continue
+				}
+				delete(w.pending, p)
+				w.inflight[p] = true
+				go func() {
+					results <- watchResult{path: p, err: w.upload(ctx, p)}
+				}()
+			}
+		}
+	}
+}
+
+func (w *watcher) handleEvent(ev fsnotify.Event) {
+	switch {
+	case ev.Has(fsnotify.Create):
+		info, err := os.Lstat(ev.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err := w.addTree(ev.Name); err != nil {
+				w.lg.Warnw("failed to watch directory", "dir", ev.Name, "err", err)
+			}
+			return
+		}
+		if info.Mode().IsRegular() {
+			w.pending[ev.Name] = time.Now().Add(w.stable)
+		}
+	case ev.Has(fsnotify.Write) || ev.Has(fsnotify.Chmod):
+		if _, ok := w.pending[ev.Name]; ok || w.inflight[ev.Name] {
+			w.pending[ev.Name] = time.Now().Add(w.stable)
+			return
+		}
+		if info, err := os.Lstat(ev.Name); err == nil && info.Mode().IsRegular() {
+			w.pending[ev.Name] = time.Now().Add(w.stable)
+		}
+	case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+		delete(w.pending, ev.Name)
+	}
+}
+
+func (w *watcher) rootOf(p string) (watchRoot, string) {
+	for _, root := range w.roots {
+		if isWithin(root.local, p) {
+			rel, _ := filepath.Rel(root.local, p)
+			return root, rel
+		}
+	}
+	return watchRoot{}, ""
+}
+
+func (w *watcher) folder(dir string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if id, ok := w.folders[dir]; ok {
+		return id, nil
+	}
+	id, err := w.transfer.Mkdir(dir)
+	if err != nil {
+		return "", err
+	}
+	w.folders[dir] = id
+	return id, nil
+}
+
+// upload stores a local file and verifies the stored hash before the local
+// file is deleted or moved. A file already stored with the same content is
+// not uploaded again, another file of the same name keeps its name and the
+// new one gets a unique name as with files posted to the channel.
+func (w *watcher) upload(ctx context.Context, p string) error {
+	root, rel := w.rootOf(p)
+	info, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir := path.Join(root.remote, filepath.ToSlash(filepath.Dir(rel)))
+	parentId, err := w.folder(dir)
+	if err != nil {
+		return err
+	}
+	size, modTime := info.Size(), info.ModTime()
+
+	name := info.Name()
+	existing, err := w.transfer.Stat(path.Join(dir, name))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case existing.Type == "file" && existing.Size != nil && *existing.Size == size:
+		if existing.UpdatedAt.Unix() == modTime.Unix() {
+			return w.finish(p, rel)
+		}
+		if existing.Hash != nil {
+			if hash, err := services.FileHash(p); err == nil && hash == *existing.Hash {
+				return w.finish(p, rel)
+			}
+		}
+		name = tgc.UniqueFileName(name, time.Now())
+	default:
+		name = tgc.UniqueFileName(name, time.Now())
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, err := w.transfer.Upload(ctx, parentId, name, f, size, modTime, w.encrypt)
+	if err != nil {
+		return err
+	}
+	hash, err := services.FileHash(p)
+	if err != nil {
+		return err
+	}
+	if file.Hash == nil || *file.Hash != hash {
+		// The retry uploads again, a kept copy would leave one more file each time.
+		if err := w.transfer.Delete(ctx, file.ID); err != nil {
+			w.lg.Warnw("failed to delete mismatched upload", "file", p, "err", err)
+		}
+		return fmt.Errorf("file changed during upload")
+	}
+	w.lg.Infow("uploaded", "file", p, "remote", path.Join(dir, name))
+	return w.finish(p, rel)
+}
+
+// finish deletes or moves a file whose upload was verified.
+func (w *watcher) finish(p, rel string) error {
+	switch w.after {
+	case "delete":
+		return os.Remove(p)
+	case "move":
+		target := filepath.Join(w.moveTo, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Rename(p, target)
+	}
+	return nil
+}
@@ -53,6 +53,10 @@ func GetJWTUser(c context.Context) *types.JWTClaims {
 	return authUser
 }
 
+func WithUser(c context.Context, claims *types.JWTClaims) context.Context {
+	return context.WithValue(c, authKey, claims)
+}
+
 func VerifyUser(db *gorm.DB, cache cache.Cacher, secret, authCookie string) (*types.JWTClaims, error) {
 	claims, err := Decode(secret, authCookie)
 
@@ -109,7 +113,7 @@ func (s *securityHandler) handleAuth(ctx context.Context, token string) (context
 	if err != nil {
 		return nil, &ogenerrors.SecurityError{Err: err}
 	}
-	return context.WithValue(ctx, authKey, claims), nil
+	return WithUser(ctx, claims), nil
 }
 
 func NewSecurityHandler(db *gorm.DB, cache cache.Cacher, cfg *config.JWTConfig) api.SecurityHandler {
@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const pinsFile = "pins.json"
+
+// DiskCache keeps chunks on disk up to a size cap, evicting the least recently
+// used ones. Keys under a pinned prefix are never evicted.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	pins    []string
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+type diskEntry struct {
+	key  string
+	size int64
+}
+
+type DiskStats struct {
+	Hits    int64    `json:"hits"`
+	Misses  int64    `json:"misses"`
+	Entries int      `json:"entries"`
+	Size    int64    `json:"size"`
+	MaxSize int64    `json:"maxSize"`
+	Pinned  []string `json:"pinned"`
+}
+
+// NewDiskCache opens the cache in dir and indexes the chunks left there by a
+// previous run, treating the most recently written ones as most recently used.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{dir: dir, maxSize: maxSize, lru: list.New(), entries: map[string]*list.Element{}}
+
+	if data, err := os.ReadFile(filepath.Join(dir, pinsFile)); err == nil {
+		if err := json.Unmarshal(data, &c.pins); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type chunk struct {
+		diskEntry
+		modTime int64
+	}
+	chunks := []chunk{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".chunk") {
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, chunk{diskEntry{key: strings.TrimSuffix(name, ".chunk"), size: info.Size()},
+			info.ModTime().UnixNano()})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].modTime > chunks[j].modTime })
+	for _, ch := range chunks {
+		c.entries[ch.key] = c.lru.PushBack(&diskEntry{key: ch.key, size: ch.size})
+		c.size += ch.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".chunk")
+}
+
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		c.remove(key)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return data, true
+}
+
+// Put stores a chunk. Chunks which do not fit next to the pinned ones are dropped.
+func (c *DiskCache) Put(key string, data []byte) error {
+	size := int64(len(data))
+	if size > c.maxSize {
+		return nil
+	}
+	// Every writer gets its own temp file, concurrent puts of a key then
+	// publish one complete chunk each.
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*diskEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[key] = c.lru.PushFront(&diskEntry{key: key, size: size})
+		c.size += size
+	}
+	c.evict()
+	return nil
+}
+
+func (c *DiskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*diskEntry).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// evict drops least recently used chunks until the cache fits. The caller holds mu.
+func (c *DiskCache) evict() {
+	for el := c.lru.Back(); el != nil && c.size > c.maxSize; {
+		prev := el.Prev()
+		entry := el.Value.(*diskEntry)
+		if !c.pinned(entry.key) {
+			os.Remove(c.path(entry.key))
+			c.size -= entry.size
+			c.lru.Remove(el)
+			delete(c.entries, entry.key)
+		}
+		el = prev
+	}
+}
+
+func (c *DiskCache) pinned(key string) bool {
+	return slices.ContainsFunc(c.pins, func(prefix string) bool { return strings.HasPrefix(key, prefix) })
+}
+
+// Pin keeps every chunk whose key starts with one of the prefixes.
+func (c *DiskCache) Pin(prefixes ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, prefix := range prefixes {
+		if !slices.Contains(c.pins, prefix) {
+			c.pins = append(c.pins, prefix)
+		}
+	}
+	return c.savePins()
+}
+
+func (c *DiskCache) Unpin(prefixes ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pins = slices.DeleteFunc(c.pins, func(prefix string) bool { return slices.Contains(prefixes, prefix) })
+	c.evict()
+	return c.savePins()
+}
+
+func (c *DiskCache) savePins() error {
+	data, err := json.Marshal(c.pins)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.dir, pinsFile), data, 0o644)
+}
+
+func (c *DiskCache) Stats() DiskStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return DiskStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: len(c.entries),
+		Size:    c.size,
+		MaxSize: c.maxSize,
+		Pinned:  slices.Clone(c.pins),
+	}
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir, 10)
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Put("a", []byte("1234")))
+	assert.NoError(t, c.Put("b", []byte("1234")))
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	// b is the least recently used chunk and makes room for c.
+	assert.NoError(t, c.Put("c", []byte("1234")))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	data, ok := c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1234"), data)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(8), stats.Size)
+
+	reopened, err := NewDiskCache(dir, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reopened.Stats().Entries)
+}
+
+func TestDiskCachePins(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir(), 8)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Pin("p_"))
+
+	assert.NoError(t, c.Put("p_1", []byte("1234")))
+	assert.NoError(t, c.Put("p_2", []byte("1234")))
+	assert.NoError(t, c.Put("x", []byte("12")))
+
+	_, ok := c.Get("x")
+	assert.False(t, ok)
+	_, ok = c.Get("p_1")
+	assert.True(t, ok)
+
+	assert.NoError(t, c.Unpin("p_"))
+	assert.NoError(t, c.Put("x", []byte("12")))
+	_, ok = c.Get("x")
+	assert.True(t, ok)
+	assert.LessOrEqual(t, c.Stats().Size, int64(8))
+}
+
+func TestDiskCacheConcurrentPut(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir, 1<<20)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.Put("a", bytes.Repeat([]byte{byte('a' + i)}, 4096)))
+		}()
+	}
+	wg.Wait()
+
+	// The chunk is one writer's data, never a mix of several.
+	data, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Len(t, data, 4096)
+	assert.Equal(t, bytes.Repeat(data[:1], 4096), data)
+
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
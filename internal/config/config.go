@@ -31,6 +31,11 @@ type ServerCmdConfig struct {
 	Bot      BotConfig     `config:"bot"`
 	CronJobs CronJobConfig `config:"cronjobs"`
 	Cache    CacheConfig   `config:"cache"`
+	Jobs     JobsConfig    `config:"jobs"`
+	Index    IndexConfig   `config:"index"`
+	S3       S3Config      `config:"s3"`
+	SFTP     SFTPConfig    `config:"sftp"`
+	Backup   BackupConfig  `config:"backup"`
 }
 
 type ServerConfig struct {
@@ -45,6 +50,8 @@ type CacheConfig struct {
 	MaxSize   int    `config:"max-size" description:"Maximum cache size in bytes" default:"10485760"`
 	RedisAddr string `config:"redis-addr" description:"Redis server address"`
 	RedisPass string `config:"redis-pass" description:"Redis server password"`
+	DiskPath  string `config:"disk-path" description:"Directory for caching streamed chunks on disk, disabled if empty"`
+	DiskSize  int64  `config:"disk-size" description:"Maximum size of the disk chunk cache in bytes" default:"10737418240"`
 }
 
 type LoggingConfig struct {
@@ -78,6 +85,42 @@ type CronJobConfig struct {
 	FolderSizeInterval   time.Duration `config:"folder-size-interval" description:"Interval for updating folder sizes" default:"2h"`
 }
 
+type BackupConfig struct {
+	Enable        bool          `config:"enable" description:"Back up the metadata of users to a Telegram channel"`
+	Interval      time.Duration `config:"interval" description:"Interval between metadata backups" default:"24h"`
+	ChannelId     int64         `config:"channel-id" description:"Channel the backups are uploaded to"`
+	Retention     int           `config:"retention" description:"Number of backups kept per user" default:"7"`
+	EncryptionKey string        `config:"encryption-key" description:"Key backups are encrypted with, empty uploads them unencrypted including bot tokens"`
+}
+
+type JobsConfig struct {
+	Workers       int           `config:"workers" description:"Number of background jobs run at the same time" default:"4"`
+	PollInterval  time.Duration `config:"poll-interval" description:"Interval for checking queued background jobs" default:"30s"`
+	BulkThreshold int           `config:"bulk-threshold" description:"Number of files above which bulk move and delete run as background jobs, answered with 202 and the job" default:"500"`
+}
+
+type IndexConfig struct {
+	Enable      bool          `config:"enable" description:"Index the contents of text files for search"`
+	Interval    time.Duration `config:"interval" description:"Interval for indexing new and changed files" default:"10m"`
+	BatchSize   int           `config:"batch-size" description:"Number of files indexed per run" default:"50"`
+	MaxSize     int64         `config:"max-size" description:"Largest file size in bytes that gets indexed" default:"1048576"`
+	MaxAttempts int           `config:"max-attempts" description:"Attempts to index a file which keeps failing before it is left until it changes, each retry waits twice as long" default:"5"`
+	MimeTypes   []string      `config:"mime-types" description:"Mime types to index, a trailing /* matches a whole type (defaults to text/* and common text formats)"`
+}
+
+type S3Config struct {
+	Enable bool   `config:"enable" description:"Serve the S3 compatible API"`
+	Port   int    `config:"port" description:"HTTP port for the S3 compatible API" default:"8081"`
+	Region string `config:"region" description:"Region reported to S3 clients" default:"us-east-1"`
+}
+
+type SFTPConfig struct {
+	Enable  bool   `config:"enable" description:"Serve files over SFTP"`
+	Port    int    `config:"port" description:"SSH port of the SFTP server" default:"2022"`
+	HostKey string `config:"host-key" description:"Path to the SSH host key (default $HOME/.teldrive/ssh_host_ed25519_key)"`
+	Encrypt bool   `config:"encrypt" description:"Encrypt files uploaded over SFTP"`
+}
+
 type TGStream struct {
 	MultiThreads int           `config:"multi-threads" description:"Number of download threads"`
 	Buffers      int           `config:"buffers" description:"Number of stream buffers" default:"8"`
@@ -89,6 +132,8 @@ type TGUpload struct {
 	Threads       int           `config:"threads" description:"Number of upload threads" default:"8"`
 	MaxRetries    int           `config:"max-retries" description:"Maximum upload retry attempts" default:"10"`
 	Retention     time.Duration `config:"retention" description:"Upload retention period" default:"7d"`
+	PartSize      int64         `config:"part-size" description:"Part size of files uploaded by the server itself (WebDAV, imports)" default:"524288000"`
+	SpoolDir      string        `config:"spool-dir" description:"Directory for unfinished parts of resumable uploads (default $HOME/.teldrive/uploads)"`
 }
 type TGConfig struct {
 	RateLimit         bool          `config:"rate-limit" description:"Enable rate limiting for API calls" default:"true"`
@@ -99,6 +144,7 @@ type TGConfig struct {
 	DisableStreamBots bool          `config:"disable-stream-bots" description:"Disable streaming bots"`
 	Proxy             string        `config:"proxy" description:"HTTP/SOCKS5 proxy URL"`
 	ReconnectTimeout  time.Duration `config:"reconnect-timeout" description:"Client reconnection timeout" default:"5m"`
+	ClientIdleTimeout time.Duration `config:"client-idle-timeout" description:"Close pooled stream and upload clients after being idle this long" default:"10m"`
 	PoolSize          int           `config:"pool-size" description:"Session pool size" default:"8"`
 	EnableLogging     bool          `config:"enable-logging" description:"Enable Telegram client logging"`
 	AppId             int           `config:"app-id" description:"Telegram app ID" default:"2496"`
@@ -60,3 +60,13 @@ func NewDatabase(cfg *config.DBConfig, lg *zap.SugaredLogger) (*gorm.DB, error)
 
 	return db, nil
 }
+
+// HasExtension reports whether a postgres extension is installed in the database.
+func HasExtension(db *gorm.DB, name string) bool {
+	var exists bool
+	if err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = ?)", name).
+		Scan(&exists).Error; err != nil {
+		return false
+	}
+	return exists
+}
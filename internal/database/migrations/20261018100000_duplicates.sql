@@ -0,0 +1,6 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS hash text;
+CREATE INDEX IF NOT EXISTS idx_files_user_id_hash ON teldrive.files (user_id, hash) WHERE hash IS NOT NULL AND status = 'active';
+CREATE INDEX IF NOT EXISTS idx_files_user_id_size ON teldrive.files (user_id, size) WHERE type = 'file' AND status = 'active';
+-- +goose StatementEnd
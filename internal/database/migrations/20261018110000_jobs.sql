@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.jobs (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id bigint NOT NULL,
+    type text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    payload jsonb,
+    state jsonb,
+    total bigint NOT NULL DEFAULT 0,
+    done bigint NOT NULL DEFAULT 0,
+    failed bigint NOT NULL DEFAULT 0,
+    error text,
+    created_at timestamp DEFAULT timezone('utc'::text, now()) NOT NULL,
+    updated_at timestamp DEFAULT timezone('utc'::text, now()) NOT NULL,
+    started_at timestamp,
+    finished_at timestamp
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_status_created_at ON teldrive.jobs (status, created_at);
+CREATE INDEX IF NOT EXISTS idx_jobs_user_id_created_at ON teldrive.jobs (user_id, created_at DESC);
+-- +goose StatementEnd
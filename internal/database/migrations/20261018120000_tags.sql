@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.tags (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT tags_pkey PRIMARY KEY (id),
+    CONSTRAINT tags_user_id_name_key UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS teldrive.file_tags (
+    file_id uuid NOT NULL,
+    tag_id uuid NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT file_tags_pkey PRIMARY KEY (file_id, tag_id),
+    CONSTRAINT fk_file FOREIGN KEY (file_id) REFERENCES teldrive.files (id) ON DELETE CASCADE,
+    CONSTRAINT fk_tag FOREIGN KEY (tag_id) REFERENCES teldrive.tags (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_tags_tag_id ON teldrive.file_tags USING btree (tag_id);
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_stars (
+    file_id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT file_stars_pkey PRIMARY KEY (user_id, file_id),
+    CONSTRAINT fk_file FOREIGN KEY (file_id) REFERENCES teldrive.files (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS teldrive.file_opens (
+    file_id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    opened_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT file_opens_pkey PRIMARY KEY (user_id, file_id),
+    CONSTRAINT fk_file FOREIGN KEY (file_id) REFERENCES teldrive.files (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_opens_user_id_opened_at ON teldrive.file_opens USING btree (user_id, opened_at DESC);
+-- +goose StatementEnd
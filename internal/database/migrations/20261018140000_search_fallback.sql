@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pgroonga')
+        AND EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'pg_trgm') THEN
+        CREATE EXTENSION IF NOT EXISTS pg_trgm;
+        CREATE INDEX IF NOT EXISTS idx_files_name_trgm ON teldrive.files USING gin (name gin_trgm_ops);
+    END IF;
+END $$;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_contents (
+    file_id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    content text NOT NULL DEFAULT '',
+    tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED,
+    error text NULL,
+    indexed_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT file_contents_pkey PRIMARY KEY (file_id),
+    CONSTRAINT fk_file FOREIGN KEY (file_id) REFERENCES teldrive.files (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_contents_tsv ON teldrive.file_contents USING gin (tsv);
+CREATE INDEX IF NOT EXISTS idx_file_contents_user_id ON teldrive.file_contents USING btree (user_id);
+-- +goose StatementEnd
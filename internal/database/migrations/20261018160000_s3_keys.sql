@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.s3_keys (
+    access_key text PRIMARY KEY,
+    secret_key text NOT NULL,
+    user_id bigint NOT NULL,
+    name text,
+    created_at timestamp DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_s3_keys_user_id ON teldrive.s3_keys (user_id);
+-- +goose StatementEnd
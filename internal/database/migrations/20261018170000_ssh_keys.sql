@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.ssh_keys (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id bigint NOT NULL,
+    name text,
+    fingerprint text NOT NULL,
+    public_key text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT ssh_keys_pkey PRIMARY KEY (id),
+    CONSTRAINT ssh_keys_fingerprint_key UNIQUE (fingerprint)
+);
+CREATE INDEX IF NOT EXISTS idx_ssh_keys_user_id ON teldrive.ssh_keys (user_id);
+-- +goose StatementEnd
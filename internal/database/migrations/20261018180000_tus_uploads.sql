@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.tus_uploads (
+    id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    parent_id uuid NOT NULL,
+    name text NOT NULL,
+    mime_type text,
+    size bigint NOT NULL,
+    part_size bigint NOT NULL,
+    channel_id bigint NOT NULL,
+    encrypted boolean DEFAULT false,
+    metadata text,
+    file_id uuid,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT tus_uploads_pkey PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_tus_uploads_created_at ON teldrive.tus_uploads (created_at);
+-- +goose StatementEnd
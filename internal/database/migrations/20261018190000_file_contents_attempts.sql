@@ -0,0 +1,6 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.file_contents ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE teldrive.file_contents ADD COLUMN IF NOT EXISTS retry_at timestamp NULL;
+CREATE INDEX IF NOT EXISTS idx_file_contents_retry_at ON teldrive.file_contents USING btree (retry_at) WHERE retry_at IS NOT NULL;
+-- +goose StatementEnd
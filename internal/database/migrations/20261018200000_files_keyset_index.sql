@@ -0,0 +1,7 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS idx_files_parent_id_name_id ON teldrive.files USING btree (parent_id, name, id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_files_parent_id_updated_at_id ON teldrive.files USING btree (parent_id, updated_at, id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_files_parent_id_size_id ON teldrive.files USING btree (parent_id, coalesce(size, 0), id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_files_user_id_updated_at_id ON teldrive.files USING btree (user_id, updated_at, id) WHERE status = 'active';
+-- +goose StatementEnd
@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.jobs ADD COLUMN IF NOT EXISTS heartbeat_at timestamp;
+-- +goose StatementEnd
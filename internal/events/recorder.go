@@ -17,6 +17,10 @@ const (
 	OpDelete EventType = "file_delete"
 	OpMove   EventType = "file_move"
 	OpCopy   EventType = "file_copy"
+
+	OpJobCompleted EventType = "job_completed"
+	OpJobFailed    EventType = "job_failed"
+	OpJobCancelled EventType = "job_cancelled"
 )
 
 type Recorder struct {
@@ -24,6 +28,7 @@ type Recorder struct {
 	events chan models.Event
 	logger *zap.Logger
 	ctx    context.Context
+	done   chan struct{}
 }
 
 func NewRecorder(ctx context.Context, db *gorm.DB, logger *zap.Logger) *Recorder {
@@ -32,6 +37,7 @@ func NewRecorder(ctx context.Context, db *gorm.DB, logger *zap.Logger) *Recorder
 		events: make(chan models.Event, 1000),
 		logger: logger,
 		ctx:    ctx,
+		done:   make(chan struct{}),
 	}
 
 	go r.processEvents()
@@ -56,11 +62,15 @@ func (r *Recorder) Record(eventType EventType, userID int64, source *models.Sour
 }
 
 func (r *Recorder) processEvents() {
+	defer close(r.done)
 	for {
 		select {
 		case <-r.ctx.Done():
 			return
-		case evt := <-r.events:
+		case evt, ok := <-r.events:
+			if !ok {
+				return
+			}
 			if err := r.db.Create(&evt).Error; err != nil {
 				r.logger.Error("failed to save event",
 					zap.Error(err),
@@ -71,6 +81,8 @@ func (r *Recorder) processEvents() {
 	}
 }
 
+// Shutdown stops accepting events and waits until the queued ones are saved.
 func (r *Recorder) Shutdown() {
 	close(r.events)
+	<-r.done
 }
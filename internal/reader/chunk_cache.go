@@ -0,0 +1,80 @@
+package reader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tgdrive/teldrive/internal/cache"
+)
+
+// chunkCacheBlock is the largest chunk telegram serves, smaller chunks are
+// aligned to their size and always fall inside one block.
+const chunkCacheBlock = 1024 * 1024
+
+var chunkCache *cache.DiskCache
+
+// SetChunkCache makes every reader look up chunks in c before asking telegram.
+func SetChunkCache(c *cache.DiskCache) {
+	chunkCache = c
+}
+
+// ChunkCacheKey identifies a block of a part on disk.
+func ChunkCacheKey(channelId, partId, offset int64) string {
+	return fmt.Sprintf("%s%d", ChunkCachePrefix(channelId, partId), offset)
+}
+
+// ChunkCachePrefix matches every cached block of a part.
+func ChunkCachePrefix(channelId, partId int64) string {
+	return fmt.Sprintf("%d_%d_", channelId, partId)
+}
+
+type cachedChunkSource struct {
+	ChunkSource
+	channelId int64
+	partId    int64
+	cache     *cache.DiskCache
+}
+
+func (c *cachedChunkSource) Chunk(ctx context.Context, offset int64, limit int64) ([]byte, error) {
+	base := offset - offset%chunkCacheBlock
+	key := ChunkCacheKey(c.channelId, c.partId, base)
+	block, ok := c.cache.Get(key)
+	if !ok {
+		var err error
+		block, err = c.ChunkSource.Chunk(ctx, base, chunkCacheBlock)
+		if err != nil {
+			return nil, err
+		}
+		c.cache.Put(key, block)
+	}
+	start := offset - base
+	if start >= int64(len(block)) {
+		return []byte{}, nil
+	}
+	return block[start:min(start+limit, int64(len(block)))], nil
+}
+
+func withChunkCache(src *chunkSource) ChunkSource {
+	if chunkCache == nil {
+		return src
+	}
+	return &cachedChunkSource{ChunkSource: src, channelId: src.channelId, partId: src.partId, cache: chunkCache}
+}
+
+// ChunkCache returns the disk cache set up at startup, nil when disabled.
+func ChunkCache() *cache.DiskCache {
+	return chunkCache
+}
+
+// UnpinParts drops the pins of parts whose messages are deleted, so their
+// blocks can be evicted again.
+func UnpinParts(channelId int64, partIds []int) error {
+	if chunkCache == nil || len(partIds) == 0 {
+		return nil
+	}
+	prefixes := make([]string, len(partIds))
+	for i, id := range partIds {
+		prefixes[i] = ChunkCachePrefix(channelId, int64(id))
+	}
+	return chunkCache.Unpin(prefixes...)
+}
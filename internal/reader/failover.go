@@ -0,0 +1,38 @@
+package reader
+
+import (
+	"context"
+
+	"github.com/gotd/td/tg"
+)
+
+// Failover hands out a client of another bot of the channel with the id of the
+// bot on every call and fails once no bot is left.
+type Failover func(ctx context.Context) (*tg.Client, string, error)
+
+type failoverKey struct{}
+
+// WithFailover lets readers created with ctx move slow or flood waited chunks
+// to another bot.
+func WithFailover(ctx context.Context, f Failover) context.Context {
+	return context.WithValue(ctx, failoverKey{}, f)
+}
+
+func failoverFrom(ctx context.Context) Failover {
+	f, _ := ctx.Value(failoverKey{}).(Failover)
+	return f
+}
+
+type clientSwitcher interface {
+	withClient(client *tg.Client, bot string) ChunkSource
+}
+
+func (c *cachedChunkSource) withClient(client *tg.Client, bot string) ChunkSource {
+	switcher, ok := c.ChunkSource.(clientSwitcher)
+	if !ok {
+		return c
+	}
+	next := *c
+	next.ChunkSource = switcher.withClient(client, bot)
+	return &next
+}
@@ -0,0 +1,69 @@
+package reader
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const readAheadTTL = 10 * time.Minute
+
+// readAhead remembers per reader of a part where it stopped and how far it
+// read ahead. Players fetch a file in consecutive range requests, so a reader
+// continuing where an earlier one left off takes over its window while a seek
+// starts small again. Every reader owns its state, so concurrent viewers of a
+// file do not grow or shrink each other's window.
+type readAhead struct {
+	mu    sync.Mutex
+	parts map[string][]*readAheadState
+}
+
+type readAheadState struct {
+	start  int64
+	next   int64
+	size   int
+	seen   time.Time
+	active bool
+}
+
+var readAheads = &readAhead{parts: map[string][]*readAheadState{}}
+
+// start returns the state of a new reader of the part at offset. It takes
+// over the window of a finished reader which stopped right before offset.
+func (ra *readAhead) start(key string, offset int64, minSize int, chunkSize int64) *readAheadState {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	now := time.Now()
+	for k, states := range ra.parts {
+		states = slices.DeleteFunc(states, func(st *readAheadState) bool { return now.Sub(st.seen) > readAheadTTL })
+		if len(states) == 0 {
+			delete(ra.parts, k)
+		} else {
+			ra.parts[k] = states
+		}
+	}
+	size := max(minSize, 1)
+	states := ra.parts[key]
+	if i := slices.IndexFunc(states, func(st *readAheadState) bool {
+		return !st.active && offset >= st.start && offset <= st.next+chunkSize
+	}); i >= 0 {
+		size = max(states[i].size, size)
+		states = slices.Delete(states, i, i+1)
+	}
+	st := &readAheadState{start: offset, next: offset, size: size, seen: now, active: true}
+	ra.parts[key] = append(states, st)
+	return st
+}
+
+func (ra *readAhead) update(st *readAheadState, next int64, size int) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	st.next, st.size, st.seen = next, size, time.Now()
+}
+
+// finish lets a later reader take over the window of st.
+func (ra *readAhead) finish(st *readAheadState) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	st.active, st.seen = false, time.Now()
+}
@@ -130,14 +130,16 @@ func (r *LinearReader) getPartReader() (io.ReadCloser, error) {
 	currentRange := r.ranges[r.pos]
 	partId := r.parts[currentRange.PartNo].ID
 
-	chunkSrc := &chunkSource{
+	chunkSrc := withChunkCache(&chunkSource{
 		channelId:   *r.file.ChannelId,
 		partId:      partId,
 		client:      r.client,
 		concurrency: r.concurrency,
 		cache:       r.cache,
 		key:         cache.Key("files", "location", r.file.ID, partId),
-	}
+	})
+
+	readAheadKey := cache.Key(r.file.ID, partId)
 
 	var (
 		reader io.ReadCloser
@@ -159,7 +161,7 @@ func (r *LinearReader) getPartReader() (io.ReadCloser, error) {
 				if r.concurrency < 2 {
 					return newTGReader(r.ctx, underlyingOffset, end, chunkSrc)
 				}
-				return newTGMultiReader(r.ctx, underlyingOffset, end, r.config, chunkSrc)
+				return newTGMultiReader(r.ctx, underlyingOffset, end, r.config, chunkSrc, readAheadKey)
 
 			}, currentRange.Start, currentRange.End-currentRange.Start+1)
 
@@ -167,7 +169,7 @@ func (r *LinearReader) getPartReader() (io.ReadCloser, error) {
 		if r.concurrency < 2 {
 			reader, err = newTGReader(r.ctx, currentRange.Start, currentRange.End, chunkSrc)
 		} else {
-			reader, err = newTGMultiReader(r.ctx, currentRange.Start, currentRange.End, r.config, chunkSrc)
+			reader, err = newTGMultiReader(r.ctx, currentRange.Start, currentRange.End, r.config, chunkSrc, readAheadKey)
 		}
 
 	}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/tgc"
@@ -17,6 +19,8 @@ import (
 var (
 	ErrStreamAbandoned = errors.New("stream abandoned")
 	ErrChunkTimeout    = errors.New("chunk fetch timed out")
+
+	errNoFailover = errors.New("no bot to fail over to")
 )
 
 type ChunkSource interface {
@@ -30,6 +34,7 @@ type chunkSource struct {
 	concurrency int
 	client      *tg.Client
 	key         string
+	bot         string
 	cache       cache.Cacher
 }
 
@@ -37,26 +42,44 @@ func (c *chunkSource) ChunkSize(start, end int64) int64 {
 	return tgc.CalculateChunkSize(start, end)
 }
 
+// locationKey is the cache key of the location. A location looked up by a
+// failover bot is cached apart from the one of the client the stream began with.
+func (c *chunkSource) locationKey() string {
+	if c.key == "" || c.bot == "" {
+		return c.key
+	}
+	return cache.Key(c.key, "bot", c.bot)
+}
+
 func (c *chunkSource) Chunk(ctx context.Context, offset int64, limit int64) ([]byte, error) {
 	var (
-		location *tg.InputDocumentFileLocation
+		location = &tg.InputDocumentFileLocation{}
+		key      = c.locationKey()
 		err      error
 	)
 
-	err = c.cache.Get(c.key, location)
-
-	if err != nil {
+	if key == "" || c.cache.Get(key, location) != nil {
 		location, err = tgc.GetLocation(ctx, c.client, c.channelId, c.partId)
 		if err != nil {
 			return nil, err
 		}
-		c.cache.Set(c.key, location, 30*time.Minute)
+		if key != "" {
+			c.cache.Set(key, location, 30*time.Minute)
+		}
 	}
 
 	return tgc.GetChunk(ctx, c.client, location, offset, limit)
 
 }
 
+// withClient returns the same source served by the client of another bot.
+func (c *chunkSource) withClient(client *tg.Client, bot string) ChunkSource {
+	next := *c
+	next.client = client
+	next.bot = bot
+	return &next
+}
+
 type tgMultiReader struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
@@ -72,6 +95,11 @@ type tgMultiReader struct {
 	currentPart int
 	chunkSrc    ChunkSource
 	timeout     time.Duration
+	readAhead   *readAheadState
+	ahead       int
+	maxAhead    int
+	srcMu       sync.Mutex
+	srcGen      int
 }
 
 func newTGMultiReader(
@@ -80,17 +108,20 @@ func newTGMultiReader(
 	end int64,
 	config *config.TGConfig,
 	chunkSrc ChunkSource,
+	key string,
 ) (*tgMultiReader, error) {
 	chunkSize := chunkSrc.ChunkSize(start, end)
 	offset := start - (start % chunkSize)
 
 	ctx, cancel := context.WithCancel(ctx)
 
+	maxAhead := max(config.Stream.Buffers, config.Stream.MultiThreads)
+
 	r := &tgMultiReader{
 		ctx:         ctx,
 		cancel:      cancel,
 		limit:       end - start + 1,
-		bufferChan:  make(chan *buffer, config.Stream.Buffers),
+		bufferChan:  make(chan *buffer, maxAhead),
 		concurrency: config.Stream.MultiThreads,
 		leftCut:     start - offset,
 		rightCut:    (end % chunkSize) + 1,
@@ -99,7 +130,10 @@ func newTGMultiReader(
 		chunkSize:   chunkSize,
 		chunkSrc:    chunkSrc,
 		timeout:     config.Stream.ChunkTimeout,
+		maxAhead:    maxAhead,
 	}
+	r.readAhead = readAheads.start(key, offset, config.Stream.MultiThreads, chunkSize)
+	r.ahead = r.readAhead.size
 
 	go r.fillBuffer()
 	return r, nil
@@ -140,31 +174,37 @@ func (r *tgMultiReader) Read(p []byte) (int, error) {
 
 func (r *tgMultiReader) fillBuffer() {
 	defer close(r.bufferChan)
+	defer readAheads.finish(r.readAhead)
 
 	for r.currentPart < r.totalParts {
-		if err := r.fillBatch(); err != nil {
+		drained, err := r.fillBatch()
+		if err != nil {
 			r.cancel()
 			return
 		}
+		// A consumer which got through the earlier batches while this one was
+		// fetched is waiting on Telegram, so the next batch reads further
+		// ahead. Slow consumers keep their window and do not pile up chunks.
+		if drained {
+			r.ahead = min(r.ahead*2, r.maxAhead)
+		}
+		readAheads.update(r.readAhead, r.offset, r.ahead)
 	}
 }
 
-func (r *tgMultiReader) fillBatch() error {
+// fillBatch fetches the next batch of chunks and queues them for Read. It
+// reports whether the chunks queued before had all been read by then.
+func (r *tgMultiReader) fillBatch() (bool, error) {
 	g, ctx := errgroup.WithContext(r.ctx)
 	g.SetLimit(r.concurrency)
 
-	buffers := make([]*buffer, r.concurrency)
+	batch := min(r.ahead, r.totalParts-r.currentPart)
+	buffers := make([]*buffer, batch)
 
-	for i := 0; i < r.concurrency && r.currentPart+i < r.totalParts; i++ {
+	for i := range batch {
 		g.Go(func() error {
-			chunkCtx, cancel := context.WithTimeout(ctx, r.timeout)
-			defer cancel()
-
-			chunk, err := r.fetchChunkWithTimeout(chunkCtx, int64(i))
+			chunk, err := r.fetchChunk(ctx, int64(i))
 			if err != nil {
-				if errors.Is(err, context.DeadlineExceeded) {
-					return fmt.Errorf("chunk %d: %w", r.currentPart+i, ErrChunkTimeout)
-				}
 				return fmt.Errorf("chunk %d: %w", r.currentPart+i, err)
 			}
 
@@ -182,32 +222,81 @@ func (r *tgMultiReader) fillBatch() error {
 	}
 
 	if err := g.Wait(); err != nil {
-		return err
+		return false, err
 	}
+	drained := r.currentPart > 0 && len(r.bufferChan) == 0
 
 	for _, buf := range buffers {
-		if buf == nil {
-			break
-		}
 		select {
 		case r.bufferChan <- buf:
 		case <-r.ctx.Done():
-			return r.ctx.Err()
+			return false, r.ctx.Err()
 		}
 	}
 
-	r.currentPart += r.concurrency
-	r.offset += r.chunkSize * int64(r.concurrency)
+	r.currentPart += batch
+	r.offset += r.chunkSize * int64(batch)
+
+	return drained, nil
+}
+
+// fetchChunk retries a chunk which timed out or hit a flood wait on the next
+// bot of the failover pool until the pool runs dry.
+func (r *tgMultiReader) fetchChunk(ctx context.Context, i int64) ([]byte, error) {
+	for {
+		r.srcMu.Lock()
+		src, gen := r.chunkSrc, r.srcGen
+		r.srcMu.Unlock()
+
+		chunkCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		chunk, err := r.fetchChunkWithTimeout(chunkCtx, src, i)
+		cancel()
+		if err == nil {
+			return chunk, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = ErrChunkTimeout
+		}
+		if _, flood := tgerr.AsFloodWait(err); !flood && !errors.Is(err, ErrChunkTimeout) {
+			return nil, err
+		}
+		if ferr := r.failover(ctx, gen); ferr != nil {
+			return nil, err
+		}
+	}
+}
 
+// failover swaps the chunk source for one backed by the next bot. Readers
+// which failed on an already replaced source simply retry with the new one.
+func (r *tgMultiReader) failover(ctx context.Context, gen int) error {
+	r.srcMu.Lock()
+	defer r.srcMu.Unlock()
+	if gen != r.srcGen {
+		return nil
+	}
+	next := failoverFrom(ctx)
+	switcher, ok := r.chunkSrc.(clientSwitcher)
+	if next == nil || !ok {
+		return errNoFailover
+	}
+	client, bot, err := next(ctx)
+	if err != nil {
+		return err
+	}
+	r.chunkSrc = switcher.withClient(client, bot)
+	r.srcGen++
 	return nil
 }
 
-func (r *tgMultiReader) fetchChunkWithTimeout(ctx context.Context, i int64) ([]byte, error) {
+func (r *tgMultiReader) fetchChunkWithTimeout(ctx context.Context, src ChunkSource, i int64) ([]byte, error) {
 	chunkChan := make(chan []byte, 1)
 	errChan := make(chan error, 1)
 
 	go func() {
-		chunk, err := r.chunkSrc.Chunk(ctx, r.offset+i*r.chunkSize, r.chunkSize)
+		chunk, err := src.Chunk(ctx, r.offset+i*r.chunkSize, r.chunkSize)
 		if err != nil {
 			errChan <- err
 		} else {
@@ -0,0 +1,324 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tgdrive/teldrive/internal/category"
+	"github.com/tgdrive/teldrive/internal/duration"
+)
+
+type Op string
+
+const (
+	OpEq  Op = "="
+	OpGt  Op = ">"
+	OpGte Op = ">="
+	OpLt  Op = "<"
+	OpLte Op = "<="
+)
+
+const (
+	FieldText     = "text"
+	FieldName     = "name"
+	FieldExt      = "ext"
+	FieldType     = "type"
+	FieldCategory = "category"
+	FieldSize     = "size"
+	FieldUpdated  = "updated"
+	FieldIn       = "in"
+	FieldTag      = "tag"
+	FieldIs       = "is"
+	FieldContent  = "content"
+)
+
+var aliases = map[string]string{
+	"cat":      FieldCategory,
+	"modified": FieldUpdated,
+}
+
+var comparable = map[string]bool{FieldSize: true, FieldUpdated: true}
+
+var (
+	types      = []string{"file", "folder"}
+	categories = []string{string(category.Document), string(category.Image), string(category.Video),
+		string(category.Audio), string(category.Archive), string(category.Other)}
+	flags = []string{"starred", "shared", "recent"}
+)
+
+var sizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// Term is a single condition of a query. Size and Time hold the parsed value
+// for size and updated terms, relative ages are already turned into a point
+// in time with the operator flipped, so updated:<30d becomes updated > now-30d.
+type Term struct {
+	Field   string
+	Op      Op
+	Value   string
+	Negated bool
+	Pos     int
+	Size    int64
+	Time    time.Time
+	// Day is set when an updated term names a date without comparison and
+	// matches the whole day starting at Time.
+	Day bool
+}
+
+type Query struct {
+	Terms []Term
+}
+
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.Pos+1, e.Msg)
+}
+
+// Parse reads a query such as `name:report ext:pdf size>10M updated:<30d in:/Work -tag:draft`.
+// Terms are ANDed, a leading "-" negates a term and words without a field
+// search the file name.
+func Parse(s string) (*Query, error) {
+	return ParseAt(s, time.Now().UTC())
+}
+
+// ParseAt is Parse with relative ages resolved against now.
+func ParseAt(s string, now time.Time) (*Query, error) {
+	p := &parser{input: []rune(s), now: now}
+	q := &Query{}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			break
+		}
+		term, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		q.Terms = append(q.Terms, *term)
+	}
+	if len(q.Terms) == 0 {
+		return nil, &ParseError{Pos: 0, Msg: "empty query"}
+	}
+	return q, nil
+}
+
+type parser struct {
+	input []rune
+	pos   int
+	now   time.Time
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *parser) term() (*Term, error) {
+	term := &Term{Pos: p.pos, Op: OpEq}
+	if p.input[p.pos] == '-' {
+		term.Negated = true
+		p.pos++
+	}
+
+	start := p.pos
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		value, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		term.Field, term.Value = FieldText, value
+		return term, nil
+	}
+	for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos])) {
+		p.pos++
+	}
+	word := strings.ToLower(string(p.input[start:p.pos]))
+
+	op, ok := p.operator()
+	if !ok || word == "" {
+		// Not a field, the whole word is searched in names.
+		p.pos = start
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return nil, &ParseError{Pos: term.Pos, Msg: "expected a search term"}
+		}
+		term.Field, term.Value = FieldText, value
+		return term, nil
+	}
+
+	if alias, ok := aliases[word]; ok {
+		word = alias
+	}
+	term.Field = word
+	if op != OpEq && !comparable[word] {
+		return nil, &ParseError{Pos: start, Msg: fmt.Sprintf("%s does not support %s", word, op)}
+	}
+	term.Op = op
+
+	valuePos := p.pos
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, &ParseError{Pos: valuePos, Msg: fmt.Sprintf("missing value for %s", word)}
+	}
+	term.Value = value
+
+	if err := p.check(term, valuePos); err != nil {
+		return nil, err
+	}
+	return term, nil
+}
+
+// operator reads the separator after a field name, which is ":" optionally
+// followed by a comparison, or a bare comparison for size and updated.
+func (p *parser) operator() (Op, bool) {
+	if p.pos >= len(p.input) {
+		return "", false
+	}
+	colon := false
+	if p.input[p.pos] == ':' {
+		colon = true
+		p.pos++
+	}
+	rest := string(p.input[p.pos:min(p.pos+2, len(p.input))])
+	for _, op := range []Op{OpGte, OpLte, OpGt, OpLt, OpEq} {
+		if strings.HasPrefix(rest, string(op)) {
+			p.pos += len(op)
+			return op, true
+		}
+	}
+	return OpEq, colon
+}
+
+func (p *parser) value() (string, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		return p.quoted()
+	}
+	start := p.pos
+	for p.pos < len(p.input) && !unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+	return string(p.input[start:p.pos]), nil
+}
+
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.pos < len(p.input) {
+				b.WriteRune(p.input[p.pos])
+				p.pos++
+			}
+		case '"':
+			return b.String(), nil
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return "", &ParseError{Pos: start, Msg: "unterminated quote"}
+}
+
+func (p *parser) check(term *Term, pos int) error {
+	switch term.Field {
+	case FieldName, FieldIn, FieldTag, FieldContent:
+	case FieldExt:
+		term.Value = strings.ToLower(strings.TrimPrefix(term.Value, "."))
+	case FieldType:
+		return oneOf(term, pos, types)
+	case FieldCategory:
+		return oneOf(term, pos, categories)
+	case FieldIs:
+		return oneOf(term, pos, flags)
+	case FieldSize:
+		size, err := ParseSize(term.Value)
+		if err != nil {
+			return &ParseError{Pos: pos, Msg: fmt.Sprintf("invalid size %q", term.Value)}
+		}
+		term.Size = size
+	case FieldUpdated:
+		return p.checkTime(term, pos)
+	default:
+		return &ParseError{Pos: term.Pos, Msg: fmt.Sprintf("unknown field %q", term.Field)}
+	}
+	return nil
+}
+
+func (p *parser) checkTime(term *Term, pos int) error {
+	if t, err := time.Parse(time.DateOnly, term.Value); err == nil {
+		term.Time = t
+		term.Day = term.Op == OpEq
+		return nil
+	}
+	age, err := duration.ParseDuration(term.Value)
+	if err != nil || age <= 0 || !strings.ContainsAny(term.Value, "smhdwMy") {
+		return &ParseError{Pos: pos, Msg: fmt.Sprintf("invalid date or age %q", term.Value)}
+	}
+	term.Time = p.now.Add(-age)
+	// An age is the distance from now, so less than 30 days ago is after now-30d.
+	switch term.Op {
+	case OpEq, OpLt:
+		term.Op = OpGt
+	case OpLte:
+		term.Op = OpGte
+	case OpGt:
+		term.Op = OpLt
+	case OpGte:
+		term.Op = OpLte
+	}
+	return nil
+}
+
+func oneOf(term *Term, pos int, values []string) error {
+	term.Value = strings.ToLower(term.Value)
+	for _, v := range values {
+		if v == term.Value {
+			return nil
+		}
+	}
+	return &ParseError{Pos: pos, Msg: fmt.Sprintf("%s must be one of %s", term.Field, strings.Join(values, ", "))}
+}
+
+// ParseSize reads sizes such as 512, 10K, 1.5GB using binary units.
+func ParseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.ToLower(s[i:])]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n * float64(unit)), nil
+}
@@ -0,0 +1,107 @@
+package search
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	q, err := ParseAt(`name:report ext:.PDF size>10M updated:<30d in:/Work -tag:draft "annual plan"`, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Term{
+		{Field: FieldName, Op: OpEq, Value: "report"},
+		{Field: FieldExt, Op: OpEq, Value: "pdf"},
+		{Field: FieldSize, Op: OpGt, Value: "10M", Size: 10 << 20},
+		{Field: FieldUpdated, Op: OpGt, Value: "30d", Time: now.Add(-30 * 24 * time.Hour)},
+		{Field: FieldIn, Op: OpEq, Value: "/Work"},
+		{Field: FieldTag, Op: OpEq, Value: "draft", Negated: true},
+		{Field: FieldText, Op: OpEq, Value: "annual plan"},
+	}
+	if len(q.Terms) != len(want) {
+		t.Fatalf("got %d terms, want %d", len(q.Terms), len(want))
+	}
+	for i, term := range q.Terms {
+		term.Pos = 0
+		if term != want[i] {
+			t.Errorf("term %d = %+v, want %+v", i, term, want[i])
+		}
+	}
+}
+
+func TestParseUpdated(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query string
+		op    Op
+		time  time.Time
+		day   bool
+	}{
+		{query: "updated:2024-01-02", op: OpEq, time: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), day: true},
+		{query: "updated>=2024-01-02", op: OpGte, time: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{query: "updated:>1w", op: OpLt, time: now.Add(-7 * 24 * time.Hour)},
+		{query: "modified:7d", op: OpGt, time: now.Add(-7 * 24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseAt(tt.query, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			term := q.Terms[0]
+			if term.Op != tt.op || !term.Time.Equal(tt.time) || term.Day != tt.day {
+				t.Errorf("got %s %v day=%v, want %s %v day=%v", term.Op, term.Time, term.Day, tt.op, tt.time, tt.day)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{query: "", pos: 0},
+		{query: "owner:me", pos: 0},
+		{query: "name>a", pos: 0},
+		{query: "size>lots", pos: 5},
+		{query: "type:link", pos: 5},
+		{query: "ext:pdf updated:<soon", pos: 17},
+		{query: `name:"open`, pos: 5},
+		{query: "name:", pos: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected parse error, got %v", err)
+			}
+			if perr.Pos != tt.pos {
+				t.Errorf("got position %d, want %d (%s)", perr.Pos, tt.pos, perr.Msg)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"512":   512,
+		"10K":   10 << 10,
+		"1.5GB": 3 << 29,
+		"2t":    2 << 40,
+	}
+	for s, want := range tests {
+		got, err := ParseSize(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	if _, err := ParseSize("10X"); err == nil {
+		t.Error("expected error for unknown unit")
+	}
+}
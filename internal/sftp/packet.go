@@ -0,0 +1,229 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Packet types of version 3 of the SFTP protocol.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Open flags.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Attribute flags.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+const (
+	modeDir     = 0o040000
+	modeRegular = 0o100000
+)
+
+// maxPacket is the largest packet accepted. OpenSSH sends writes of 32KiB and
+// allows packets of up to 256KiB.
+const maxPacket = 256*1024 + 1024
+
+var errShortPacket = errors.New("sftp: short packet")
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, errShortPacket
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// decoder consumes the fields of a packet. The first error sticks, callers
+// check it once after reading all fields.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil || uint32(len(d.b)) < n {
+		d.err = errShortPacket
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// attrs skips an attribute block, the server does not apply attributes.
+func (d *decoder) attrs() {
+	flags := d.uint32()
+	if flags&attrSize != 0 {
+		d.uint64()
+	}
+	if flags&attrUIDGID != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if flags&attrPermissions != 0 {
+		d.uint32()
+	}
+	if flags&attrACModTime != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if flags&attrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+}
+
+// encoder builds a packet, the length is filled in by packet.
+type encoder struct {
+	b []byte
+}
+
+func newPacket(typ byte, id uint32) *encoder {
+	e := &encoder{b: make([]byte, 4, 64)}
+	e.b = append(e.b, typ)
+	if typ != fxpVersion {
+		e.uint32(id)
+	}
+	return e
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, v)
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.uint32(uint32(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) attrs(fi fs.FileInfo) {
+	e.uint32(attrSize | attrPermissions | attrACModTime)
+	e.uint64(uint64(max(fi.Size(), 0)))
+	e.uint32(fileMode(fi))
+	mtime := uint32(fi.ModTime().Unix())
+	e.uint32(mtime)
+	e.uint32(mtime)
+}
+
+func (e *encoder) packet() []byte {
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	return e.b
+}
+
+func fileMode(fi fs.FileInfo) uint32 {
+	perm := uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		return modeDir | perm
+	}
+	return modeRegular | perm
+}
+
+// longName formats an entry like ls -l, clients show it in listings.
+func longName(fi fs.FileInfo) string {
+	mtime := fi.ModTime()
+	stamp := mtime.Format("Jan _2 15:04")
+	if time.Since(mtime) > 180*24*time.Hour || mtime.After(time.Now()) {
+		stamp = mtime.Format("Jan _2  2006")
+	}
+	mode := fi.Mode().Perm() | fi.Mode()&fs.ModeDir
+	return fmt.Sprintf("%s    1 teldrive teldrive %12d %s %s", mode, max(fi.Size(), 0), stamp, fi.Name())
+}
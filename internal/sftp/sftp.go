@@ -0,0 +1,431 @@
+// Package sftp serves a FileSystem over version 3 of the SSH file transfer
+// protocol, the version spoken by OpenSSH and most clients.
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+)
+
+// FileSystem is the tree served to a client. Names are absolute and cleaned.
+type FileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Open(name string) (io.ReadSeekCloser, error)
+	// Create replaces name with the data written, the file is stored once
+	// the writer is closed.
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string) error
+	// Remove deletes a file or a folder with its contents.
+	Remove(name string) error
+	Rename(oldName, newName string) error
+}
+
+// aborter is implemented by writers which can discard what was written.
+// Uploads still open when the session ends are aborted instead of stored.
+type aborter interface {
+	CloseWithError(err error) error
+}
+
+var (
+	errConnectionLost = errors.New("connection lost")
+
+	errInvalidHandle = errors.New("invalid handle")
+	errIsDir         = errors.New("is a directory")
+	errNotDir        = errors.New("not a directory")
+	errNotEmpty      = errors.New("directory not empty")
+	errNonSequential = errors.New("writes must be sequential")
+	errUnsupported   = errors.New("operation unsupported")
+)
+
+// readdirBatch is the number of entries sent per READDIR response.
+const readdirBatch = 100
+
+// maxData caps the data returned by a single READ.
+const maxData = 256 * 1024
+
+type handle struct {
+	name    string
+	r       io.ReadSeekCloser
+	pos     int64
+	w       io.WriteCloser
+	written int64
+	dir     bool
+	entries []fs.FileInfo
+}
+
+type server struct {
+	fs      FileSystem
+	w       io.Writer
+	handles map[string]*handle
+	next    uint64
+}
+
+// Serve answers the requests read from rw until it is closed. Requests are
+// handled one at a time in the order they arrive, which keeps pipelined reads
+// and writes of a handle sequential.
+func Serve(rw io.ReadWriter, fsys FileSystem) error {
+	s := &server{fs: fsys, w: rw, handles: map[string]*handle{}}
+	defer s.closeAll()
+	for {
+		typ, payload, err := readPacket(rw)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(s.serve(typ, payload)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) closeAll() {
+	for id, h := range s.handles {
+		s.close(h, errConnectionLost)
+		delete(s.handles, id)
+	}
+}
+
+func (s *server) close(h *handle, cause error) error {
+	switch {
+	case h.r != nil:
+		return h.r.Close()
+	case h.w != nil:
+		if a, ok := h.w.(aborter); ok && cause != nil {
+			return a.CloseWithError(cause)
+		}
+		return h.w.Close()
+	}
+	return nil
+}
+
+func (s *server) serve(typ byte, payload []byte) []byte {
+	d := &decoder{b: payload}
+	if typ == fxpInit {
+		p := newPacket(fxpVersion, 0)
+		p.uint32(3)
+		p.string("posix-rename@openssh.com")
+		p.string("1")
+		return p.packet()
+	}
+	id := d.uint32()
+	p, err := s.dispatch(typ, id, d)
+	if err == nil && d.err != nil {
+		err = d.err
+	}
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	if p == nil {
+		return statusPacket(id, nil)
+	}
+	return p.packet()
+}
+
+func (s *server) dispatch(typ byte, id uint32, d *decoder) (*encoder, error) {
+	switch typ {
+	case fxpOpen:
+		name, flags := clean(d.string()), d.uint32()
+		d.attrs()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return s.open(id, name, flags)
+	case fxpClose:
+		hid := d.string()
+		h, ok := s.handles[hid]
+		if !ok {
+			return nil, errInvalidHandle
+		}
+		delete(s.handles, hid)
+		return nil, s.close(h, nil)
+	case fxpRead:
+		h, offset, length := s.handles[d.string()], d.uint64(), d.uint32()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return s.read(id, h, int64(offset), length)
+	case fxpWrite:
+		h, offset, data := s.handles[d.string()], d.uint64(), d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, s.write(h, int64(offset), data)
+	case fxpLstat, fxpStat:
+		fi, err := s.fs.Stat(clean(d.string()))
+		if err != nil {
+			return nil, err
+		}
+		return attrsPacket(id, fi), nil
+	case fxpFstat:
+		h, ok := s.handles[d.string()]
+		if !ok {
+			return nil, errInvalidHandle
+		}
+		if h.w != nil {
+			return attrsPacket(id, &writeInfo{name: path.Base(h.name), size: h.written}), nil
+		}
+		fi, err := s.fs.Stat(h.name)
+		if err != nil {
+			return nil, err
+		}
+		return attrsPacket(id, fi), nil
+	case fxpSetstat, fxpFsetstat:
+		// Modes, owners and times are not stored, accepting them keeps
+		// clients which preserve attributes from failing the transfer.
+		d.string()
+		d.attrs()
+		return nil, nil
+	case fxpOpendir:
+		return s.opendir(id, clean(d.string()))
+	case fxpReaddir:
+		h, ok := s.handles[d.string()]
+		if !ok || !h.dir {
+			return nil, errInvalidHandle
+		}
+		if len(h.entries) == 0 {
+			return nil, io.EOF
+		}
+		return readdirPacket(id, h), nil
+	case fxpRemove:
+		return nil, s.remove(clean(d.string()), false)
+	case fxpMkdir:
+		name := clean(d.string())
+		d.attrs()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, s.fs.Mkdir(name)
+	case fxpRmdir:
+		return nil, s.remove(clean(d.string()), true)
+	case fxpRealpath:
+		name := clean(d.string())
+		p := newPacket(fxpName, id)
+		p.uint32(1)
+		p.string(name)
+		p.string(name)
+		p.uint32(0)
+		return p, nil
+	case fxpRename:
+		oldName, newName := clean(d.string()), clean(d.string())
+		if d.err != nil {
+			return nil, d.err
+		}
+		if _, err := s.fs.Stat(newName); err == nil {
+			return nil, fs.ErrExist
+		}
+		return nil, s.fs.Rename(oldName, newName)
+	case fxpExtended:
+		if d.string() != "posix-rename@openssh.com" {
+			return nil, errUnsupported
+		}
+		oldName, newName := clean(d.string()), clean(d.string())
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, s.posixRename(oldName, newName)
+	}
+	return nil, errUnsupported
+}
+
+func (s *server) addHandle(h *handle) string {
+	s.next++
+	hid := strconv.FormatUint(s.next, 10)
+	s.handles[hid] = h
+	return hid
+}
+
+func (s *server) open(id uint32, name string, flags uint32) (*encoder, error) {
+	h := &handle{name: name}
+	if flags&fxfWrite == 0 {
+		r, err := s.fs.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		h.r = r
+		return handlePacket(id, s.addHandle(h)), nil
+	}
+	if flags&fxfAppend != 0 {
+		return nil, errUnsupported
+	}
+	fi, err := s.fs.Stat(name)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil, errIsDir
+	case err == nil && flags&fxfCreat != 0 && flags&fxfExcl != 0:
+		return nil, fs.ErrExist
+	case errors.Is(err, fs.ErrNotExist) && flags&fxfCreat == 0:
+		return nil, err
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	w, err := s.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	h.w = w
+	return handlePacket(id, s.addHandle(h)), nil
+}
+
+func (s *server) read(id uint32, h *handle, offset int64, length uint32) (*encoder, error) {
+	if h == nil || h.r == nil {
+		return nil, errInvalidHandle
+	}
+	if offset != h.pos {
+		if _, err := h.r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		h.pos = offset
+	}
+	buf := make([]byte, min(length, maxData))
+	n, err := io.ReadFull(h.r, buf)
+	h.pos += int64(n)
+	if n == 0 {
+		if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	p := newPacket(fxpData, id)
+	p.bytes(buf[:n])
+	return p, nil
+}
+
+func (s *server) write(h *handle, offset int64, data []byte) error {
+	if h == nil || h.w == nil {
+		return errInvalidHandle
+	}
+	if offset != h.written {
+		return errNonSequential
+	}
+	n, err := h.w.Write(data)
+	h.written += int64(n)
+	return err
+}
+
+func (s *server) opendir(id uint32, name string) (*encoder, error) {
+	fi, err := s.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errNotDir
+	}
+	entries, err := s.fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return handlePacket(id, s.addHandle(&handle{name: name, dir: true, entries: entries})), nil
+}
+
+func (s *server) remove(name string, dir bool) error {
+	fi, err := s.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !dir && fi.IsDir():
+		return errIsDir
+	case dir && !fi.IsDir():
+		return errNotDir
+	case dir:
+		entries, err := s.fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return errNotEmpty
+		}
+	}
+	return s.fs.Remove(name)
+}
+
+// posixRename replaces an existing file at newName, unlike RENAME of version
+// 3 which fails when the target exists.
+func (s *server) posixRename(oldName, newName string) error {
+	if fi, err := s.fs.Stat(newName); err == nil {
+		if fi.IsDir() {
+			return errIsDir
+		}
+		if err := s.fs.Remove(newName); err != nil {
+			return err
+		}
+	}
+	return s.fs.Rename(oldName, newName)
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func statusPacket(id uint32, err error) []byte {
+	code, msg := uint32(fxOK), "OK"
+	if err != nil {
+		code, msg = statusCode(err), err.Error()
+	}
+	p := newPacket(fxpStatus, id)
+	p.uint32(code)
+	p.string(msg)
+	p.string("")
+	return p.packet()
+}
+
+func statusCode(err error) uint32 {
+	switch {
+	case errors.Is(err, io.EOF):
+		return fxEOF
+	case errors.Is(err, fs.ErrNotExist):
+		return fxNoSuchFile
+	case errors.Is(err, fs.ErrPermission):
+		return fxPermissionDenied
+	case errors.Is(err, errShortPacket):
+		return fxBadMessage
+	case errors.Is(err, errUnsupported):
+		return fxOpUnsupported
+	}
+	return fxFailure
+}
+
+func handlePacket(id uint32, hid string) *encoder {
+	p := newPacket(fxpHandle, id)
+	p.string(hid)
+	return p
+}
+
+func attrsPacket(id uint32, fi fs.FileInfo) *encoder {
+	p := newPacket(fxpAttrs, id)
+	p.attrs(fi)
+	return p
+}
+
+func readdirPacket(id uint32, h *handle) *encoder {
+	n := min(len(h.entries), readdirBatch)
+	p := newPacket(fxpName, id)
+	p.uint32(uint32(n))
+	for _, fi := range h.entries[:n] {
+		p.string(fi.Name())
+		p.string(longName(fi))
+		p.attrs(fi)
+	}
+	h.entries = h.entries[n:]
+	return p
+}
+
+// writeInfo describes a file which is still being uploaded.
+type writeInfo struct {
+	name string
+	size int64
+}
+
+func (fi *writeInfo) Name() string       { return fi.name }
+func (fi *writeInfo) Size() int64        { return fi.size }
+func (fi *writeInfo) Mode() fs.FileMode  { return 0644 }
+func (fi *writeInfo) ModTime() time.Time { return time.Now() }
+func (fi *writeInfo) IsDir() bool        { return false }
+func (fi *writeInfo) Sys() any           { return nil }
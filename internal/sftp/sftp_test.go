@@ -0,0 +1,262 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi *memInfo) Name() string { return fi.name }
+func (fi *memInfo) Size() int64  { return fi.size }
+func (fi *memInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+func (fi *memInfo) ModTime() time.Time { return time.Unix(0, 0) }
+func (fi *memInfo) IsDir() bool        { return fi.dir }
+func (fi *memInfo) Sys() any           { return nil }
+
+// memFS keeps files in a map, folders have a nil value.
+type memFS struct {
+	files   map[string][]byte
+	aborted []string
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &memInfo{name: path.Base(name), size: int64(len(data)), dir: data == nil}, nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	var out []fs.FileInfo
+	for p := range m.files {
+		if p != "/" && path.Dir(p) == name {
+			fi, _ := m.Stat(p)
+			out = append(out, fi)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+func (m *memFS) Open(name string) (io.ReadSeekCloser, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return readSeekNopCloser{bytes.NewReader(data)}, nil
+}
+
+type memWriter struct {
+	m    *memFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriter) Close() error {
+	w.m.files[w.name] = append([]byte{}, w.buf.Bytes()...)
+	return nil
+}
+
+func (w *memWriter) CloseWithError(err error) error {
+	w.m.aborted = append(w.m.aborted, w.name)
+	return nil
+}
+
+func (m *memFS) Create(name string) (io.WriteCloser, error) {
+	return &memWriter{m: m, name: name}, nil
+}
+
+func (m *memFS) Mkdir(name string) error {
+	if _, ok := m.files[name]; ok {
+		return fs.ErrExist
+	}
+	m.files[name] = nil
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) Rename(oldName, newName string) error {
+	m.files[newName] = m.files[oldName]
+	delete(m.files, oldName)
+	return nil
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	id   uint32
+}
+
+func (c *client) send(typ byte, fields ...any) (byte, *decoder) {
+	c.t.Helper()
+	c.id++
+	p := newPacket(typ, c.id)
+	if typ == fxpInit {
+		p = &encoder{b: []byte{0, 0, 0, 0, fxpInit}}
+	}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			p.uint32(v)
+		case uint64:
+			p.uint64(v)
+		case string:
+			p.string(v)
+		case []byte:
+			p.bytes(v)
+		}
+	}
+	if _, err := c.conn.Write(p.packet()); err != nil {
+		c.t.Fatal(err)
+	}
+	typ, payload, err := readPacket(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{b: payload}
+	if typ != fxpVersion && d.uint32() != c.id {
+		c.t.Fatalf("response to another request")
+	}
+	return typ, d
+}
+
+func (c *client) status(typ byte, fields ...any) uint32 {
+	c.t.Helper()
+	rtyp, d := c.send(typ, fields...)
+	if rtyp != fxpStatus {
+		c.t.Fatalf("got packet %d, want status", rtyp)
+	}
+	return d.uint32()
+}
+
+func (c *client) handle(typ byte, fields ...any) string {
+	c.t.Helper()
+	rtyp, d := c.send(typ, fields...)
+	if rtyp != fxpHandle {
+		c.t.Fatalf("got packet %d, want handle", rtyp)
+	}
+	return d.string()
+}
+
+func serve(t *testing.T, m *memFS) (*client, chan error) {
+	srv, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(srv, m)
+		srv.Close()
+	}()
+	c := &client{t: t, conn: conn}
+	if typ, d := c.send(fxpInit, uint32(3)); typ != fxpVersion || d.uint32() != 3 {
+		t.Fatal("version not negotiated")
+	}
+	return c, done
+}
+
+func TestServe(t *testing.T) {
+	m := &memFS{files: map[string][]byte{"/": nil, "/docs": nil, "/docs/a.txt": []byte("hello world")}}
+	c, done := serve(t, m)
+
+	typ, d := c.send(fxpRealpath, ".")
+	if typ != fxpName || d.uint32() != 1 || d.string() != "/" {
+		t.Fatal("realpath of . is not /")
+	}
+
+	typ, d = c.send(fxpStat, "/docs/a.txt")
+	if typ != fxpAttrs || d.uint32()&attrSize == 0 || d.uint64() != 11 {
+		t.Fatal("stat did not report the size")
+	}
+	if code := c.status(fxpStat, "/missing"); code != fxNoSuchFile {
+		t.Errorf("stat of a missing file: got %d", code)
+	}
+
+	h := c.handle(fxpOpen, "/docs/a.txt", uint32(fxfRead), uint32(0))
+	typ, d = c.send(fxpRead, h, uint64(6), uint32(100))
+	if typ != fxpData || string(d.bytes()) != "world" {
+		t.Fatal("read at an offset failed")
+	}
+	if code := c.status(fxpRead, h, uint64(11), uint32(100)); code != fxEOF {
+		t.Errorf("read past the end: got %d", code)
+	}
+	if code := c.status(fxpClose, h); code != fxOK {
+		t.Errorf("close: got %d", code)
+	}
+
+	h = c.handle(fxpOpen, "/docs/b.txt", uint32(fxfWrite|fxfCreat|fxfTrunc), uint32(0))
+	c.status(fxpWrite, h, uint64(0), []byte("abc"))
+	c.status(fxpWrite, h, uint64(3), []byte("def"))
+	if code := c.status(fxpWrite, h, uint64(10), []byte("x")); code != fxFailure {
+		t.Errorf("non-sequential write: got %d", code)
+	}
+	c.status(fxpClose, h)
+	if string(m.files["/docs/b.txt"]) != "abcdef" {
+		t.Errorf("uploaded %q", m.files["/docs/b.txt"])
+	}
+
+	h = c.handle(fxpOpendir, "/docs")
+	typ, d = c.send(fxpReaddir, h)
+	if typ != fxpName || d.uint32() != 2 || d.string() != "a.txt" || !strings.HasPrefix(d.string(), "-rw-r--r--") {
+		t.Fatal("unexpected listing")
+	}
+	if code := c.status(fxpReaddir, h); code != fxEOF {
+		t.Errorf("listing did not end: got %d", code)
+	}
+	c.status(fxpClose, h)
+
+	if code := c.status(fxpRename, "/docs/b.txt", "/docs/a.txt"); code != fxFailure {
+		t.Errorf("rename onto an existing file: got %d", code)
+	}
+	if code := c.status(fxpExtended, "posix-rename@openssh.com", "/docs/b.txt", "/docs/a.txt"); code != fxOK {
+		t.Errorf("posix-rename: got %d", code)
+	}
+	if string(m.files["/docs/a.txt"]) != "abcdef" {
+		t.Errorf("posix-rename did not replace the target")
+	}
+	if code := c.status(fxpRmdir, "/docs"); code != fxFailure {
+		t.Errorf("rmdir of a non-empty folder: got %d", code)
+	}
+	if code := c.status(fxpRemove, "/docs"); code != fxFailure {
+		t.Errorf("remove of a folder: got %d", code)
+	}
+	if code := c.status(fxpSymlink, "/a", "/b"); code != fxOpUnsupported {
+		t.Errorf("symlink: got %d", code)
+	}
+
+	c.handle(fxpOpen, "/partial.bin", uint32(fxfWrite|fxfCreat), uint32(0))
+	c.conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.files["/partial.bin"]; ok || len(m.aborted) != 1 {
+		t.Error("an upload left open was stored")
+	}
+}
@@ -0,0 +1,210 @@
+package sigv4
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	StreamingPayload        = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	emptyPayloadHash        = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	ErrContentSHA256Mismatch  = errors.New("payload does not match x-amz-content-sha256")
+	ErrMalformedChunk         = errors.New("malformed aws-chunked payload")
+	ErrChunkSignatureMismatch = errors.New("chunk signature does not match")
+)
+
+// Streaming reports whether the payload is sent with aws-chunked encoding.
+func Streaming(payloadHash string) bool {
+	return strings.HasPrefix(payloadHash, "STREAMING-")
+}
+
+type hashReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+	size     int64
+	read     int64
+}
+
+// NewHashReader fails the final read of r if the payload does not hash to the
+// hex encoded sha256 in expected. The payload ends at EOF or, when size is not
+// negative, after size bytes so readers stopping at the length are checked
+// too. Unsigned payloads are passed through.
+func NewHashReader(r io.Reader, expected string, size int64) io.Reader {
+	if expected == UnsignedPayload || Streaming(expected) {
+		return r
+	}
+	return &hashReader{r: r, h: sha256.New(), expected: expected, size: size}
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.read += int64(n)
+	if (err == io.EOF || r.read == r.size) && hex.EncodeToString(r.h.Sum(nil)) != r.expected {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+type chunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+
+	// Set for signed payloads, every chunk is signed over the signature of
+	// the one before, starting at the seed signature of the request.
+	key     []byte
+	scope   string
+	prev    string
+	sig     string
+	h       hash.Hash
+	trailer bool
+}
+
+// NewChunkedReader decodes an aws-chunked payload. The chunk signatures of
+// signed payloads are checked with the secret, the read ending a chunk fails
+// when its signature does not match. Unsigned streaming payloads are only
+// decoded. Trailing checksums are not checked, a signed trailer is verified.
+func NewChunkedReader(r io.Reader, s *Signature, secret string) io.Reader {
+	c := &chunkedReader{r: bufio.NewReader(r)}
+	if s.PayloadHash == StreamingPayload || s.PayloadHash == StreamingPayloadTrailer {
+		c.key = SigningKey(secret, s.Date, s.Region, s.Service)
+		c.scope = s.Time.Format(timeFormat) + "\n" + s.scope()
+		c.prev = s.Signature
+		c.h = sha256.New()
+		c.trailer = s.PayloadHash == StreamingPayloadTrailer
+	}
+	return c
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		size, err := c.header()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			c.done = true
+			if err := c.verifyChunk(); err != nil {
+				return 0, err
+			}
+			return 0, c.readTrailer()
+		}
+		c.remaining = size
+	}
+	n, err := c.r.Read(p[:min(int64(len(p)), c.remaining)])
+	c.remaining -= int64(n)
+	if c.h != nil {
+		c.h.Write(p[:n])
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if c.remaining == 0 {
+		if err := c.crlf(); err != nil {
+			return n, err
+		}
+		if err := c.verifyChunk(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// header reads a chunk header of the form size[;chunk-signature=...]\r\n.
+func (c *chunkedReader) header() (int64, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, ErrMalformedChunk
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	sizeField, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return 0, ErrMalformedChunk
+	}
+	c.sig, _ = strings.CutPrefix(ext, "chunk-signature=")
+	if c.key != nil && c.sig == "" {
+		return 0, ErrMalformedChunk
+	}
+	return size, nil
+}
+
+func (c *chunkedReader) verifyChunk() error {
+	if c.key == nil {
+		return nil
+	}
+	return c.verify("AWS4-HMAC-SHA256-PAYLOAD\n"+c.scope+"\n"+c.prev+"\n"+emptyPayloadHash+"\n"+
+		hex.EncodeToString(c.h.Sum(nil)), c.sig)
+}
+
+func (c *chunkedReader) verify(stringToSign, sig string) error {
+	expected := hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return ErrChunkSignatureMismatch
+	}
+	c.prev = expected
+	c.h.Reset()
+	return nil
+}
+
+func (c *chunkedReader) crlf() error {
+	var buf [2]byte
+	if _, err := io.ReadFull(c.r, buf[:]); err != nil || buf != [2]byte{'\r', '\n'} {
+		return ErrMalformedChunk
+	}
+	return nil
+}
+
+// readTrailer reads the trailing headers up to the final empty line. A
+// payload without trailers may end right after the last chunk.
+func (c *chunkedReader) readTrailer() error {
+	var (
+		headers strings.Builder
+		sig     string
+	)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if err == io.EOF || line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "x-amz-trailer-signature:"); ok {
+			sig = v
+			continue
+		}
+		headers.WriteString(line + "\n")
+	}
+	if !c.trailer {
+		return io.EOF
+	}
+	if sig == "" {
+		return ErrMalformedChunk
+	}
+	sum := sha256.Sum256([]byte(headers.String()))
+	if err := c.verify("AWS4-HMAC-SHA256-TRAILER\n"+c.scope+"\n"+c.prev+"\n"+hex.EncodeToString(sum[:]), sig); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,275 @@
+// Package sigv4 verifies AWS Signature Version 4 signed requests, both signed
+// in the Authorization header and presigned in the query string.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Algorithm       = "AWS4-HMAC-SHA256"
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	timeFormat      = "20060102T150405Z"
+	maxSkew         = 15 * time.Minute
+	maxExpires      = 7 * 24 * time.Hour
+)
+
+var (
+	ErrMissing           = errors.New("request is not signed")
+	ErrMalformed         = errors.New("malformed authorization")
+	ErrExpired           = errors.New("request has expired")
+	ErrSkewed            = errors.New("request time is too skewed")
+	ErrSignatureMismatch = errors.New("signature does not match")
+)
+
+// Credential is the scope a request was signed for.
+type Credential struct {
+	AccessKey string
+	Date      string
+	Region    string
+	Service   string
+}
+
+func (c *Credential) scope() string {
+	return strings.Join([]string{c.Date, c.Region, c.Service, "aws4_request"}, "/")
+}
+
+// Signature holds the signing parameters of a request.
+type Signature struct {
+	Credential
+	SignedHeaders []string
+	Signature     string
+	Time          time.Time
+	Presigned     bool
+	Expires       time.Duration
+	PayloadHash   string
+}
+
+// Parse reads the signing parameters from the Authorization header or, for
+// presigned URLs, the query string.
+func Parse(r *http.Request) (*Signature, error) {
+	if q := r.URL.Query(); q.Get("X-Amz-Algorithm") != "" {
+		return parseQuery(q)
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, ErrMissing
+	}
+	rest, ok := strings.CutPrefix(header, Algorithm+" ")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	s := &Signature{}
+	for _, field := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, ErrMalformed
+		}
+		switch key {
+		case "Credential":
+			cred, err := parseCredential(value)
+			if err != nil {
+				return nil, err
+			}
+			s.Credential = cred
+		case "SignedHeaders":
+			s.SignedHeaders = strings.Split(value, ";")
+		case "Signature":
+			s.Signature = value
+		}
+	}
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		t, err := http.ParseTime(r.Header.Get("Date"))
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		s.Time = t.UTC()
+	} else {
+		t, err := time.Parse(timeFormat, date)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		s.Time = t
+	}
+	s.PayloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if s.PayloadHash == "" {
+		s.PayloadHash = UnsignedPayload
+	}
+	if s.AccessKey == "" || s.Signature == "" || len(s.SignedHeaders) == 0 {
+		return nil, ErrMalformed
+	}
+	return s, nil
+}
+
+func parseQuery(q url.Values) (*Signature, error) {
+	if q.Get("X-Amz-Algorithm") != Algorithm {
+		return nil, ErrMalformed
+	}
+	cred, err := parseCredential(q.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(timeFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	seconds, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, ErrMalformed
+	}
+	s := &Signature{
+		Credential:    cred,
+		SignedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		Signature:     q.Get("X-Amz-Signature"),
+		Time:          t,
+		Presigned:     true,
+		Expires:       time.Duration(seconds) * time.Second,
+		PayloadHash:   UnsignedPayload,
+	}
+	if hash := q.Get("X-Amz-Content-Sha256"); hash != "" {
+		s.PayloadHash = hash
+	}
+	if s.Signature == "" || s.Expires > maxExpires {
+		return nil, ErrMalformed
+	}
+	return s, nil
+}
+
+func parseCredential(value string) (Credential, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[0] == "" {
+		return Credential{}, ErrMalformed
+	}
+	return Credential{AccessKey: parts[0], Date: parts[1], Region: parts[2], Service: parts[3]}, nil
+}
+
+// Verify checks the signature of r with the secret of the access key.
+func (s *Signature) Verify(r *http.Request, secret string, now time.Time) error {
+	if s.Presigned {
+		if now.Before(s.Time.Add(-maxSkew)) || now.After(s.Time.Add(s.Expires)) {
+			return ErrExpired
+		}
+	} else if d := now.Sub(s.Time); d > maxSkew || d < -maxSkew {
+		return ErrSkewed
+	}
+	if s.Time.Format("20060102") != s.Date {
+		return ErrMalformed
+	}
+	expected := hex.EncodeToString(hmacSHA256(SigningKey(secret, s.Date, s.Region, s.Service), s.StringToSign(r)))
+	if !hmac.Equal([]byte(expected), []byte(s.Signature)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// SigningKey derives the key signatures of the day and scope are made with.
+func SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// StringToSign builds the string the signature of r is computed over.
+func (s *Signature) StringToSign(r *http.Request) string {
+	hash := sha256.Sum256([]byte(s.CanonicalRequest(r)))
+	return strings.Join([]string{Algorithm, s.Time.Format(timeFormat), s.scope(), hex.EncodeToString(hash[:])}, "\n")
+}
+
+// CanonicalRequest builds the canonical form of r described by the signing
+// process.
+func (s *Signature) CanonicalRequest(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(Escape(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(s.canonicalQuery(r.URL.Query()))
+	b.WriteByte('\n')
+	for _, name := range s.SignedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(headerValue(r, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(s.SignedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(s.PayloadHash)
+	return b.String()
+}
+
+func (s *Signature) canonicalQuery(q url.Values) string {
+	type pair struct{ key, value string }
+	pairs := []pair{}
+	for key, values := range q {
+		if s.Presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, pair{Escape(key, true), Escape(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.key + "=" + p.value
+	}
+	return strings.Join(encoded, "&")
+}
+
+func headerValue(r *http.Request, name string) string {
+	if name == "host" {
+		return r.Host
+	}
+	values := r.Header.Values(name)
+	if name == "content-length" && len(values) == 0 && r.ContentLength >= 0 {
+		return strconv.FormatInt(r.ContentLength, 10)
+	}
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// Escape percent encodes everything but unreserved characters, slashes are
+// kept unless encodeSlash is set.
+func Escape(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -274,19 +274,7 @@ func (h *integratedUpdateHandler) processDocument(ctx context.Context, doc *tg.M
 		h.bot.logger.Infow("File with this name already exists, making filename unique", 
 			"original_name", fileName)
 		
-		ext := ""
-		baseName := fileName
-		
-		// Extract extension if present
-		if idx := strings.LastIndex(fileName, "."); idx >= 0 {
-			ext = fileName[idx:]
-			baseName = fileName[:idx]
-		}
-		
-		// Append timestamp and a UUID to ensure uniqueness
-		timestamp := time.Now().Format("20060102_150405")
-		uniqueID := uuid.New().String()[:8]
-		fileName = fmt.Sprintf("%s_%s_%s%s", baseName, timestamp, uniqueID, ext)
+		fileName = UniqueFileName(fileName, time.Now())
 		
 		h.bot.logger.Infow("Using unique filename", "new_name", fileName)
 	}
@@ -383,3 +371,15 @@ func (h *integratedUpdateHandler) processDocument(ctx context.Context, doc *tg.M
 	logToFile(fmt.Sprintf("SUCCESS: File added to database: %s (ID: %s, Parent: %s)", 
 		fileName, fileID, h.bot.parentId))
 }
+
+// UniqueFileName is the name given to an ingested file when its name is taken,
+// a timestamp and a random suffix are added before the extension.
+func UniqueFileName(fileName string, now time.Time) string {
+	ext := ""
+	baseName := fileName
+	if idx := strings.LastIndex(fileName, "."); idx >= 0 {
+		ext = fileName[idx:]
+		baseName = fileName[:idx]
+	}
+	return fmt.Sprintf("%s_%s_%s%s", baseName, now.Format("20060102_150405"), uuid.New().String()[:8], ext)
+}
@@ -0,0 +1,189 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/pool"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var errClientClosed = errors.New("client closed")
+
+// streamRetries is how often requests of stream clients are retried, upload
+// clients use tg.uploads.max-retries.
+const streamRetries = 5
+
+// ClientManager keeps authorized clients connected between requests so range
+// requests and upload parts do not pay for connection setup every time.
+// Clients are keyed by bot token or user session and closed after being idle.
+// Upload clients are kept apart from stream clients as they retry differently.
+type ClientManager struct {
+	ctx     context.Context
+	db      *gorm.DB
+	config  *config.TGConfig
+	worker  *BotWorker
+	mu      sync.Mutex
+	clients map[string]*managedClient
+}
+
+type managedClient struct {
+	key      string
+	client   *telegram.Client
+	pool     pool.Pool
+	ready    chan struct{}
+	err      error
+	cancel   context.CancelFunc
+	users    int
+	lastUsed time.Time
+}
+
+func NewClientManager(ctx context.Context, db *gorm.DB, config *config.TGConfig, worker *BotWorker) *ClientManager {
+	m := &ClientManager{ctx: ctx, db: db, config: config, worker: worker, clients: map[string]*managedClient{}}
+	go m.evictIdle()
+	return m
+}
+
+// Bot returns a ready client of the bot. release must be called once the
+// caller is done with it.
+func (m *ClientManager) Bot(ctx context.Context, token string) (*tg.Client, func(), error) {
+	return m.acquire(ctx, cache.Key("bot", token), token, streamRetries, m.botClient(token))
+}
+
+// User returns a ready client of the user session.
+func (m *ClientManager) User(ctx context.Context, session string) (*tg.Client, func(), error) {
+	return m.acquire(ctx, cache.Key("user", session), "", streamRetries, m.userClient(session))
+}
+
+// UploadBot returns a ready client of the bot for uploading parts.
+func (m *ClientManager) UploadBot(ctx context.Context, token string) (*tg.Client, func(), error) {
+	return m.acquire(ctx, cache.Key("upload", "bot", token), token, m.config.Uploads.MaxRetries, m.botClient(token))
+}
+
+// UploadUser returns a ready client of the user session for uploading parts.
+func (m *ClientManager) UploadUser(ctx context.Context, session string) (*tg.Client, func(), error) {
+	return m.acquire(ctx, cache.Key("upload", "user", session), "", m.config.Uploads.MaxRetries, m.userClient(session))
+}
+
+func (m *ClientManager) botClient(token string) func(ctx context.Context) (*telegram.Client, error) {
+	return func(ctx context.Context) (*telegram.Client, error) {
+		return BotClient(ctx, m.db, m.config, token)
+	}
+}
+
+func (m *ClientManager) userClient(session string) func(ctx context.Context) (*telegram.Client, error) {
+	return func(ctx context.Context) (*telegram.Client, error) {
+		return AuthClient(ctx, m.config, session)
+	}
+}
+
+func (m *ClientManager) acquire(ctx context.Context, key, token string, retries int,
+	create func(ctx context.Context) (*telegram.Client, error)) (*tg.Client, func(), error) {
+	m.mu.Lock()
+	c, ok := m.clients[key]
+	if !ok {
+		var err error
+		if c, err = m.start(key, token, retries, create); err != nil {
+			m.mu.Unlock()
+			return nil, nil, err
+		}
+		m.clients[key] = c
+	}
+	c.users++
+	c.lastUsed = time.Now()
+	m.mu.Unlock()
+
+	release := sync.OnceFunc(func() {
+		m.mu.Lock()
+		c.users--
+		c.lastUsed = time.Now()
+		m.mu.Unlock()
+	})
+
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+	if c.err != nil {
+		release()
+		return nil, nil, c.err
+	}
+	return c.pool.Default(m.ctx), release, nil
+}
+
+// start connects a new client in the background. The caller holds mu.
+func (m *ClientManager) start(key, token string, retries int,
+	create func(ctx context.Context) (*telegram.Client, error)) (*managedClient, error) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	client, err := create(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	middlewares := NewMiddleware(m.config, WithFloodWait(), WithRecovery(ctx), WithRetry(retries), WithRateLimit())
+	if token != "" {
+		middlewares = append(middlewares, m.worker.FloodReporter(token))
+	}
+	c := &managedClient{
+		key:    key,
+		client: client,
+		pool:   pool.NewPool(client, int64(m.config.PoolSize), middlewares...),
+		ready:  make(chan struct{}),
+		cancel: cancel,
+	}
+	go func() {
+		err := RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+			close(c.ready)
+			<-ctx.Done()
+			return c.pool.Close()
+		})
+		m.mu.Lock()
+		if m.clients[key] == c {
+			delete(m.clients, key)
+		}
+		m.mu.Unlock()
+		select {
+		case <-c.ready:
+		default:
+			if err == nil {
+				err = errClientClosed
+			}
+			c.err = err
+			close(c.ready)
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logging.DefaultLogger().Debug("telegram client stopped", zap.Error(err))
+		}
+	}()
+	return c, nil
+}
+
+func (m *ClientManager) evictIdle() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		for key, c := range m.clients {
+			if c.users == 0 && time.Since(c.lastUsed) > m.config.ClientIdleTimeout {
+				c.cancel()
+				delete(m.clients, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
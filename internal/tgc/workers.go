@@ -1,37 +1,223 @@
 package tgc
 
 import (
+	"context"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+const (
+	// botErrorWindow is how long a failed request counts against a bot.
+	botErrorWindow = 5 * time.Minute
+	// botMaxErrors recent errors mark a bot unhealthy until the window passes.
+	botMaxErrors = 3
 )
 
+// BotWorker hands out the bots of a channel. It prefers bots which are not
+// flood waited and have no recent errors, and among those the least loaded.
 type BotWorker struct {
-	mu      sync.RWMutex
+	mu      sync.Mutex
 	bots    map[int64][]string
 	currIdx map[int64]int
+	state   map[string]*botState
+}
+
+type botState struct {
+	inFlight   int
+	requests   int64
+	errors     int
+	lastError  time.Time
+	floodUntil time.Time
+}
+
+type BotStats struct {
+	BotId      string    `json:"botId"`
+	ChannelId  int64     `json:"channelId"`
+	InFlight   int       `json:"inFlight"`
+	Requests   int64     `json:"requests"`
+	Errors     int       `json:"errors"`
+	LastError  time.Time `json:"lastError,omitzero"`
+	FloodUntil time.Time `json:"floodUntil,omitzero"`
+	Healthy    bool      `json:"healthy"`
 }
 
 func NewBotWorker() *BotWorker {
 	return &BotWorker{
 		bots:    make(map[int64][]string),
 		currIdx: make(map[int64]int),
+		state:   make(map[string]*botState),
 	}
 }
 
+// Set registers the bots of a channel. Callers pass the current list on every
+// request, so added and removed bots are picked up as soon as it changes.
 func (w *BotWorker) Set(bots []string, channelId int64) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if _, ok := w.bots[channelId]; ok {
+	if slices.Equal(w.bots[channelId], bots) {
 		return
 	}
-	w.bots[channelId] = bots
+	w.bots[channelId] = slices.Clone(bots)
 	w.currIdx[channelId] = 0
+	for _, token := range bots {
+		if _, ok := w.state[token]; !ok {
+			w.state[token] = &botState{}
+		}
+	}
 }
 
+// Next picks a bot without tracking the request.
 func (w *BotWorker) Next(channelId int64) (string, int) {
-	w.mu.RLock()
-	defer w.mu.RUnlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	token, index := w.pick(channelId)
+	if token != "" {
+		w.state[token].requests++
+	}
+	return token, index
+}
+
+// Acquire picks a bot and counts the request as in flight until release is
+// called with its outcome.
+func (w *BotWorker) Acquire(channelId int64) (string, int, func(err error)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	token, index := w.pick(channelId)
+	if token == "" {
+		return "", index, func(error) {}
+	}
+	st := w.state[token]
+	st.inFlight++
+	st.requests++
+	var once sync.Once
+	return token, index, func(err error) {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			st.inFlight--
+			if err != nil {
+				w.failed(st)
+			}
+		})
+	}
+}
+
+// Failed records an error of a bot outside of Acquire.
+func (w *BotWorker) Failed(token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if st, ok := w.state[token]; ok {
+		w.failed(st)
+	}
+}
+
+func (w *BotWorker) failed(st *botState) {
+	if time.Since(st.lastError) > botErrorWindow {
+		st.errors = 0
+	}
+	st.errors++
+	st.lastError = time.Now()
+}
+
+// Flood records a FLOOD_WAIT of the bot, it is avoided until the wait is over.
+func (w *BotWorker) Flood(token string, wait time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st, ok := w.state[token]
+	if !ok {
+		return
+	}
+	if until := time.Now().Add(wait); until.After(st.floodUntil) {
+		st.floodUntil = until
+	}
+}
+
+func (st *botState) healthy(now time.Time) bool {
+	if now.Before(st.floodUntil) {
+		return false
+	}
+	return st.errors < botMaxErrors || now.Sub(st.lastError) > botErrorWindow
+}
+
+// pick returns the least loaded healthy bot starting the scan after the last
+// pick so equally loaded bots take turns. With no healthy bot left the one
+// whose flood wait ends first is used. The caller holds mu.
+func (w *BotWorker) pick(channelId int64) (string, int) {
 	bots := w.bots[channelId]
-	index := w.currIdx[channelId]
-	w.currIdx[channelId] = (index + 1) % len(bots)
-	return bots[index], index
+	if len(bots) == 0 {
+		return "", 0
+	}
+	now := time.Now()
+	start := w.currIdx[channelId]
+	best, fallback := -1, -1
+	for i := range bots {
+		index := (start + i) % len(bots)
+		st := w.state[bots[index]]
+		if !st.healthy(now) {
+			if fallback < 0 || st.floodUntil.Before(w.state[bots[fallback]].floodUntil) {
+				fallback = index
+			}
+			continue
+		}
+		if best < 0 || st.inFlight < w.state[bots[best]].inFlight {
+			best = index
+		}
+	}
+	if best < 0 {
+		best = fallback
+	}
+	w.currIdx[channelId] = (best + 1) % len(bots)
+	return bots[best], best
+}
+
+// Stats returns the state of the given bots, tokens are reduced to the bot id.
+func (w *BotWorker) Stats(tokens []string) []BotStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	stats := []BotStats{}
+	for channelId, bots := range w.bots {
+		for _, token := range bots {
+			if !slices.Contains(tokens, token) {
+				continue
+			}
+			st := w.state[token]
+			errors := st.errors
+			if now.Sub(st.lastError) > botErrorWindow {
+				errors = 0
+			}
+			stats = append(stats, BotStats{
+				BotId:      strings.Split(token, ":")[0],
+				ChannelId:  channelId,
+				InFlight:   st.inFlight,
+				Requests:   st.requests,
+				Errors:     errors,
+				LastError:  st.lastError,
+				FloodUntil: st.floodUntil,
+				Healthy:    st.healthy(now),
+			})
+		}
+	}
+	return stats
+}
+
+// FloodReporter passes FLOOD_WAIT errors of the bot to the worker before the
+// flood wait middleware sleeps them off, so it has to come after it.
+func (w *BotWorker) FloodReporter(token string) telegram.Middleware {
+	return telegram.MiddlewareFunc(func(next tg.Invoker) telegram.InvokeFunc {
+		return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+			err := next.Invoke(ctx, input, output)
+			if wait, ok := tgerr.AsFloodWait(err); ok {
+				w.Flood(token, wait)
+			}
+			return err
+		}
+	})
 }
@@ -33,6 +33,20 @@ func ExecutableDir() string {
 	return filepath.Dir(path)
 }
 
+// DataDir returns the .teldrive directory in the home directory, or the
+// directory of the executable when it cannot be created.
+func DataDir() string {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return ExecutableDir()
+	}
+	dir = filepath.Join(dir, ".teldrive")
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return ExecutableDir()
+	}
+	return dir
+}
+
 func Filter[T any](slice []T, predicate func(T) bool) []T {
 	var result []T
 	for _, v := range slice {
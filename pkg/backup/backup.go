@@ -0,0 +1,320 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/query"
+	"github.com/gotd/td/telegram/query/messages"
+	"github.com/gotd/td/telegram/uploader"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const version = 1
+
+// encryptedMagic starts encrypted backups, it is followed by the salt of the
+// key on its own line. Unencrypted backups are plain gzip.
+var encryptedMagic = []byte("TDBACKUP\n")
+
+var (
+	ErrNoBackup       = errors.New("no backup found")
+	ErrNotEmpty       = errors.New("the user already has files, restore needs an empty database")
+	ErrConflict       = errors.New("rows of the backup already exist, restore needs an empty database")
+	ErrKeyRequired    = errors.New("backup is encrypted, an encryption key is required")
+	ErrInvalidVersion = errors.New("unsupported backup version")
+)
+
+// Metadata is what a backup holds of a user, the parts of files are stored
+// with the files.
+type Metadata struct {
+	Version   int                `json:"version"`
+	CreatedAt time.Time          `json:"createdAt"`
+	User      models.User        `json:"user"`
+	Files     []models.File      `json:"files"`
+	Shares    []models.FileShare `json:"shares"`
+	Bots      []models.Bot       `json:"bots"`
+	Channels  []models.Channel   `json:"channels"`
+}
+
+// Export reads the metadata of a user. Files waiting for deletion are left out.
+func Export(db *gorm.DB, userId int64) (*Metadata, error) {
+	m := &Metadata{Version: version, CreatedAt: time.Now().UTC()}
+	if err := db.Where("user_id = ?", userId).First(&m.User).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ? AND status <> 'pending_deletion'", userId).Order("id").
+		Find(&m.Files).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userId).Find(&m.Shares).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userId).Find(&m.Bots).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userId).Find(&m.Channels).Error; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Name is the file name of a backup of the user taken at t.
+func Name(userId int64, t time.Time, encrypted bool) string {
+	name := fmt.Sprintf("%s%s.json.gz", prefix(userId), t.UTC().Format("20060102T150405Z"))
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+func prefix(userId int64) string {
+	return fmt.Sprintf("teldrive-metadata-%d-", userId)
+}
+
+// Encode writes m as gzipped json, encrypted when key is set.
+func Encode(w io.Writer, m *Metadata, key string) error {
+	if key != "" {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		encodedSalt := base64.RawURLEncoding.EncodeToString(salt)
+		cipher, err := crypt.NewCipher(key, encodedSalt)
+		if err != nil {
+			return err
+		}
+		var plain bytes.Buffer
+		if err := Encode(&plain, m, ""); err != nil {
+			return err
+		}
+		enc, err := cipher.EncryptData(&plain)
+		if err != nil {
+			return err
+		}
+		defer enc.Close()
+		if _, err := fmt.Fprintf(w, "%s%s\n", encryptedMagic, encodedSalt); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, enc)
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(m); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Decode reads a backup written by Encode.
+func Decode(r io.Reader, key string) (*Metadata, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(encryptedMagic))
+	var body io.Reader = br
+	if bytes.Equal(head, encryptedMagic) {
+		if key == "" {
+			return nil, ErrKeyRequired
+		}
+		br.Discard(len(encryptedMagic))
+		salt, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		cipher, err := crypt.NewCipher(key, strings.TrimSuffix(salt, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		dec, err := cipher.DecryptData(io.NopCloser(br))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		body = dec
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	defer zr.Close()
+	var m Metadata
+	if err := json.NewDecoder(zr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	if m.Version != version {
+		return nil, ErrInvalidVersion
+	}
+	return &m, nil
+}
+
+// Restore imports a backup. The user may exist with nothing but the root
+// folder created at login, files of the backup root are moved into it.
+func Restore(db *gorm.DB, m *Metadata) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&m.User).Error; err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&models.File{}).Where("user_id = ? AND parent_id IS NOT NULL", m.User.UserId).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrNotEmpty
+		}
+		var root models.File
+		err := tx.Where("user_id = ? AND parent_id IS NULL", m.User.UserId).First(&root).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		files := make([]models.File, 0, len(m.Files))
+		rootId := ""
+		for _, f := range m.Files {
+			if f.ParentId == nil && root.ID != "" {
+				rootId = f.ID
+				continue
+			}
+			files = append(files, f)
+		}
+		for i := range files {
+			if rootId != "" && files[i].ParentId != nil && *files[i].ParentId == rootId {
+				files[i].ParentId = &root.ID
+			}
+		}
+		if err := createAll(tx, "files", files); err != nil {
+			return err
+		}
+		if err := createAll(tx, "shares", m.Shares); err != nil {
+			return err
+		}
+		if err := createAll(tx, "bots", m.Bots); err != nil {
+			return err
+		}
+		return createAll(tx, "channels", m.Channels)
+	})
+}
+
+// createAll inserts every row or fails with ErrConflict, rows which exist
+// already would otherwise be reported as restored.
+func createAll[T any](tx *gorm.DB, name string, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	res := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(rows, 500)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != int64(len(rows)) {
+		return fmt.Errorf("%w: %d of %d %s", ErrConflict, int64(len(rows))-res.RowsAffected, len(rows), name)
+	}
+	return nil
+}
+
+// Upload sends a backup to the channel and deletes the oldest backups of the
+// user beyond retention.
+func Upload(ctx context.Context, client *telegram.Client, channelId, userId int64, name string, data []byte, retention int) error {
+	return tgc.RunWithAuth(ctx, client, "", func(ctx context.Context) error {
+		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+		if err != nil {
+			return err
+		}
+		upload, err := uploader.NewUploader(client.API()).Upload(ctx, uploader.NewUpload(name, bytes.NewReader(data), int64(len(data))))
+		if err != nil {
+			return err
+		}
+		document := message.UploadedDocument(upload).Filename(name).ForceFile(true)
+		if _, err := message.NewSender(client.API()).To(&tg.InputPeerChannel{ChannelID: channel.ChannelID,
+			AccessHash: channel.AccessHash}).Media(ctx, document); err != nil {
+			return err
+		}
+		if retention <= 0 {
+			return nil
+		}
+		backups, err := list(ctx, client.API(), channel, userId)
+		if err != nil {
+			return err
+		}
+		if len(backups) <= retention {
+			return nil
+		}
+		ids := make([]int, 0, len(backups)-retention)
+		for _, b := range backups[retention:] {
+			ids = append(ids, b.id)
+		}
+		_, err = client.API().ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: ids})
+		return err
+	})
+}
+
+// Latest downloads the newest backup of the user from the channel.
+func Latest(ctx context.Context, client *telegram.Client, channelId, userId int64) (name string, data []byte, err error) {
+	err = tgc.RunWithAuth(ctx, client, "", func(ctx context.Context) error {
+		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+		if err != nil {
+			return err
+		}
+		backups, err := list(ctx, client.API(), channel, userId)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return ErrNoBackup
+		}
+		buf, err := tgc.GetMediaContent(ctx, client.API(), backups[0].doc.AsInputDocumentFileLocation())
+		if err != nil {
+			return err
+		}
+		name, data = backups[0].name, buf.Bytes()
+		return nil
+	})
+	return
+}
+
+type storedBackup struct {
+	id   int
+	name string
+	doc  *tg.Document
+}
+
+// list returns the backups of the user in the channel, newest first.
+func list(ctx context.Context, client *tg.Client, channel *tg.InputChannel, userId int64) ([]storedBackup, error) {
+	q := query.NewQuery(client).Messages().GetHistory(&tg.InputPeerChannel{
+		ChannelID:  channel.ChannelID,
+		AccessHash: channel.AccessHash,
+	})
+	var backups []storedBackup
+	iter := messages.NewIterator(q, 100)
+	for iter.Next(ctx) {
+		doc, ok := iter.Value().Document()
+		if !ok {
+			continue
+		}
+		for _, attr := range doc.Attributes {
+			if name, ok := attr.(*tg.DocumentAttributeFilename); ok && strings.HasPrefix(name.FileName, prefix(userId)) {
+				backups = append(backups, storedBackup{id: iter.Value().Msg.GetID(), name: name.FileName, doc: doc})
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].id > backups[j].id })
+	return backups, nil
+}
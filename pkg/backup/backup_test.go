@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	rootId   = "00000000-0000-0000-0000-000000000001"
+	folderId = "00000000-0000-0000-0000-000000000002"
+	fileId   = "00000000-0000-0000-0000-000000000003"
+)
+
+func testMetadata() *Metadata {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	size, channel := int64(5), int64(100)
+	root, folder := rootId, folderId
+	return &Metadata{
+		Version:   version,
+		CreatedAt: now,
+		User:      models.User{UserId: 1, Name: "user", UserName: "user", CreatedAt: now, UpdatedAt: now},
+		Files: []models.File{
+			{ID: rootId, Name: "root", Type: "folder", MimeType: "drive/folder", UserId: 1, Status: "active",
+				CreatedAt: now, UpdatedAt: now},
+			{ID: folderId, Name: "docs", Type: "folder", MimeType: "drive/folder", UserId: 1, Status: "active",
+				ParentId: &root, CreatedAt: now, UpdatedAt: now},
+			{ID: fileId, Name: "a.txt", Type: "file", MimeType: "text/plain", Size: &size, UserId: 1, Status: "active",
+				ParentId: &folder, ChannelId: &channel, Parts: datatypes.NewJSONSlice([]api.Part{{ID: 7}}),
+				CreatedAt: now, UpdatedAt: now},
+		},
+		Shares:   []models.FileShare{{ID: "00000000-0000-0000-0000-000000000004", FileId: fileId, UserId: 1, CreatedAt: now, UpdatedAt: now}},
+		Bots:     []models.Bot{{Token: "1:abc", UserId: 1, BotId: 1, ChannelId: channel}},
+		Channels: []models.Channel{{ChannelId: channel, ChannelName: "files", UserId: 1, Selected: true}},
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, key := range []string{"", "secret"} {
+		var buf bytes.Buffer
+		assert.NoError(t, Encode(&buf, testMetadata(), key))
+		assert.Equal(t, key != "", bytes.HasPrefix(buf.Bytes(), encryptedMagic))
+
+		m, err := Decode(bytes.NewReader(buf.Bytes()), key)
+		assert.NoError(t, err)
+		assert.Equal(t, testMetadata(), m)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var encrypted bytes.Buffer
+	assert.NoError(t, Encode(&encrypted, testMetadata(), "secret"))
+
+	_, err := Decode(bytes.NewReader(encrypted.Bytes()), "")
+	assert.ErrorIs(t, err, ErrKeyRequired)
+
+	_, err = Decode(bytes.NewReader(encrypted.Bytes()), "wrong")
+	assert.Error(t, err)
+
+	m := testMetadata()
+	m.Version = version + 1
+	var newer bytes.Buffer
+	assert.NoError(t, Encode(&newer, m, ""))
+	_, err = Decode(bytes.NewReader(newer.Bytes()), "")
+	assert.ErrorIs(t, err, ErrInvalidVersion)
+
+	_, err = Decode(bytes.NewReader([]byte("not a backup")), "")
+	assert.Error(t, err)
+}
+
+// testDB opens a sqlite database with the columns Restore writes.
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.NoError(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE users (user_id integer PRIMARY KEY, name text, user_name text, is_premium bool,
+			updated_at datetime, created_at datetime)`,
+		`CREATE TABLE files (id text PRIMARY KEY, name text, type text, mime_type text, size integer,
+			category text, hash text, encrypted bool, user_id integer, status text, parent_id text, parts text,
+			channel_id integer, created_at datetime, updated_at datetime)`,
+		`CREATE TABLE file_shares (id text PRIMARY KEY, file_id text, password text, expires_at datetime,
+			created_at datetime, updated_at datetime, user_id integer)`,
+		`CREATE TABLE bots (token text PRIMARY KEY, user_id integer, bot_id integer, bot_user_name text,
+			channel_id integer)`,
+		`CREATE TABLE channels (channel_id integer PRIMARY KEY, channel_name text, user_id integer, selected bool)`,
+	} {
+		assert.NoError(t, db.Exec(stmt).Error)
+	}
+	return db
+}
+
+func TestRestore(t *testing.T) {
+	db := testDB(t)
+	assert.NoError(t, Restore(db, testMetadata()))
+
+	var files []models.File
+	assert.NoError(t, db.Order("id").Find(&files).Error)
+	assert.Equal(t, testMetadata().Files, files)
+	var count int64
+	for _, model := range []any{&models.FileShare{}, &models.Bot{}, &models.Channel{}} {
+		assert.NoError(t, db.Model(model).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	}
+
+	assert.ErrorIs(t, Restore(db, testMetadata()), ErrNotEmpty)
+}
+
+func TestRestoreIntoRoot(t *testing.T) {
+	// The root folder created at login takes the place of the one of the backup.
+	db := testDB(t)
+	login := models.File{ID: "00000000-0000-0000-0000-000000000009", Name: "root", Type: "folder",
+		MimeType: "drive/folder", UserId: 1, Status: "active"}
+	assert.NoError(t, db.Create(&login).Error)
+	assert.NoError(t, Restore(db, testMetadata()))
+
+	var folder models.File
+	assert.NoError(t, db.Where("id = ?", folderId).First(&folder).Error)
+	assert.Equal(t, login.ID, *folder.ParentId)
+	var count int64
+	assert.NoError(t, db.Model(&models.File{}).Where("id = ?", rootId).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestRestoreConflict(t *testing.T) {
+	db := testDB(t)
+	assert.NoError(t, db.Create(&models.Bot{Token: "1:abc", UserId: 2}).Error)
+	assert.ErrorIs(t, Restore(db, testMetadata()), ErrConflict)
+
+	// The failed restore leaves nothing behind.
+	var count int64
+	assert.NoError(t, db.Model(&models.File{}).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+}
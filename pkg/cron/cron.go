@@ -1,7 +1,11 @@
 package cron
 
 import (
+	"bytes"
 	"context"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -9,7 +13,10 @@ import (
 	"github.com/tgdrive/teldrive/internal/api"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/backup"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"go.uber.org/zap"
 	"gorm.io/datatypes"
@@ -54,6 +61,10 @@ func StartCronJobs(ctx context.Context, scheduler *gocron.Scheduler, db *gorm.DB
 
 	scheduler.Every(cnf.CronJobs.CleanUploadsInterval).Do(cron.cleanUploads, ctx)
 
+	if cnf.Backup.Enable && cnf.Backup.ChannelId != 0 {
+		scheduler.Every(cnf.Backup.Interval).Do(cron.backupMetadata, ctx)
+	}
+
 	scheduler.StartAsync()
 }
 
@@ -100,13 +111,35 @@ func (c *CronService) cleanFiles(ctx context.Context) {
 
 		}
 
-		client, _ := tgc.AuthClient(ctx, &c.cnf.TG, row.Session, middlewares...)
-		err := tgc.DeleteMessages(ctx, client, row.ChannelId, ids)
-
-		if err != nil {
-			c.logger.Errorw("failed to delete messages", err)
+		// Parts can be shared with active files (deduplicated references),
+		// those messages must survive the cleanup.
+		var referenced []int
+		if err := c.db.Raw(`SELECT DISTINCT (p->>'id')::int FROM teldrive.files f, jsonb_array_elements(f.parts) p
+		WHERE f.channel_id = ? AND f.status = 'active' AND (p->>'id')::int = any(?)`, row.ChannelId,
+			pgtype.Array[int]{
+				Elements: ids,
+				Valid:    true,
+				Dims:     []pgtype.ArrayDimension{{Length: int32(len(ids)), LowerBound: 1}},
+			}).Scan(&referenced).Error; err != nil {
+			c.logger.Errorw("failed to check referenced parts", err)
 			return
 		}
+		if len(referenced) > 0 {
+			ids = utils.Filter(ids, func(id int) bool { return !slices.Contains(referenced, id) })
+		}
+
+		if len(ids) > 0 {
+			client, _ := tgc.AuthClient(ctx, &c.cnf.TG, row.Session, middlewares...)
+			err := tgc.DeleteMessages(ctx, client, row.ChannelId, ids)
+
+			if err != nil {
+				c.logger.Errorw("failed to delete messages", err)
+				return
+			}
+			if err := reader.UnpinParts(row.ChannelId, ids); err != nil {
+				c.logger.Errorw("failed to unpin parts", err)
+			}
+		}
 
 		items := pgtype.Array[string]{
 			Elements: fileIds,
@@ -163,6 +196,71 @@ func (c *CronService) cleanUploads(ctx context.Context) {
 			Where("user_id = ?", result.UserId).Delete(&models.Upload{}).Delete(&models.Upload{})
 
 	}
+
+	c.cleanTusUploads()
+}
+
+// cleanTusUploads removes expired resumable uploads and their spooled data,
+// the uploaded parts are cleaned with the other uploads.
+func (c *CronService) cleanTusUploads() {
+	var expired []models.TusUpload
+	if err := c.db.Where("created_at < ?", time.Now().UTC().Add(-c.cnf.TG.Uploads.Retention)).
+		Find(&expired).Error; err != nil {
+		return
+	}
+	for _, up := range expired {
+		files, _ := filepath.Glob(filepath.Join(c.cnf.TG.Uploads.SpoolDir, up.ID+".*"))
+		for _, file := range files {
+			os.Remove(file)
+		}
+		c.db.Delete(&up)
+	}
+}
+
+// backupMetadata uploads a backup of the metadata of every user with a
+// session to the backup channel.
+func (c *CronService) backupMetadata(ctx context.Context) {
+	var users []struct {
+		UserId  int64
+		Session string
+	}
+	if err := c.db.Table("teldrive.users as u").
+		Select("u.user_id, s.session").
+		Joins(`JOIN (
+        SELECT DISTINCT ON (user_id) user_id, session
+        FROM teldrive.sessions
+        ORDER BY user_id, created_at DESC
+    ) as s ON u.user_id = s.user_id`).
+		Scan(&users).Error; err != nil {
+		c.logger.Errorw("failed to get users for backup", "err", err)
+		return
+	}
+
+	middlewares := tgc.NewMiddleware(&c.cnf.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+	for _, user := range users {
+		m, err := backup.Export(c.db, user.UserId)
+		if err != nil {
+			c.logger.Errorw("failed to export metadata", "user", user.UserId, "err", err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := backup.Encode(&buf, m, c.cnf.Backup.EncryptionKey); err != nil {
+			c.logger.Errorw("failed to encode metadata", "user", user.UserId, "err", err)
+			continue
+		}
+		client, err := tgc.AuthClient(ctx, &c.cnf.TG, user.Session, middlewares...)
+		if err != nil {
+			c.logger.Errorw("failed to create client", "user", user.UserId, "err", err)
+			continue
+		}
+		name := backup.Name(user.UserId, m.CreatedAt, c.cnf.Backup.EncryptionKey != "")
+		if err := backup.Upload(ctx, client, c.cnf.Backup.ChannelId, user.UserId, name, buf.Bytes(),
+			c.cnf.Backup.Retention); err != nil {
+			c.logger.Errorw("failed to upload metadata backup", "user", user.UserId, "err", err)
+			continue
+		}
+		c.logger.Infow("backed up metadata", "user", user.UserId, "files", len(m.Files), "size", buf.Len())
+	}
 }
 
 func (c *CronService) updateFolderSize() {
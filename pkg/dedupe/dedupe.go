@@ -0,0 +1,375 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+type Action string
+
+const (
+	ActionDelete    Action = "delete"
+	ActionReference Action = "reference"
+)
+
+var (
+	ErrInvalidAction = errors.New("invalid action")
+	ErrInvalidGroup  = errors.New("invalid duplicate group")
+)
+
+type File struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	ParentId  string    `json:"parentId,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	ChannelId int64     `json:"channelId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type Group struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	WastedBytes int64  `json:"wastedBytes"`
+	Files       []File `json:"files"`
+}
+
+type Report struct {
+	Groups      []Group `json:"groups"`
+	TotalGroups int     `json:"totalGroups"`
+	TotalFiles  int     `json:"totalFiles"`
+	WastedBytes int64   `json:"wastedBytes"`
+}
+
+type Resolution struct {
+	Keep  string   `json:"keep"`
+	Files []string `json:"files"`
+}
+
+type Result struct {
+	Deleted     int      `json:"deleted"`
+	Referenced  int      `json:"referenced"`
+	Reclaimed   int64    `json:"reclaimed"`
+	FailedFiles []string `json:"failedFiles,omitempty"`
+}
+
+type candidate struct {
+	models.File
+	Path string
+}
+
+// Find groups the active files of a user by content. Files with a stored hash
+// are grouped by it, the rest fall back to the Telegram document ids of their
+// parts, which are only resolved for files sharing a size with another file.
+func Find(ctx context.Context, db *gorm.DB, client *telegram.Client, userId int64) (*Report, error) {
+	groups := map[string][]candidate{}
+
+	var hashed []candidate
+	if err := db.Model(&models.File{}).Select("*",
+		"(select get_path_from_file_id as path from teldrive.get_path_from_file_id(id))").
+		Where("user_id = ? AND type = 'file' AND status = 'active' AND hash IS NOT NULL", userId).
+		Where("hash IN (?)", db.Model(&models.File{}).Select("hash").
+			Where("user_id = ? AND type = 'file' AND status = 'active' AND hash IS NOT NULL", userId).
+			Group("hash").Having("count(*) > 1")).
+		Scan(&hashed).Error; err != nil {
+		return nil, err
+	}
+	for _, f := range hashed {
+		key := "hash:" + *f.Hash
+		groups[key] = append(groups[key], f)
+	}
+
+	var unhashed []candidate
+	if err := db.Model(&models.File{}).Select("*",
+		"(select get_path_from_file_id as path from teldrive.get_path_from_file_id(id))").
+		Where("user_id = ? AND type = 'file' AND status = 'active' AND hash IS NULL AND size > 0", userId).
+		Where("size IN (?)", db.Model(&models.File{}).Select("size").
+			Where("user_id = ? AND type = 'file' AND status = 'active' AND hash IS NULL AND size > 0", userId).
+			Group("size").Having("count(*) > 1")).
+		Scan(&unhashed).Error; err != nil {
+		return nil, err
+	}
+
+	if len(unhashed) > 0 && client != nil {
+		docKeys, err := documentKeys(ctx, client, unhashed)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range unhashed {
+			key, ok := docKeys[f.ID]
+			if !ok {
+				continue
+			}
+			groups[key] = append(groups[key], f)
+		}
+	}
+
+	report := &Report{Groups: []Group{}}
+	for key, files := range groups {
+		if len(files) < 2 {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].CreatedAt.Before(files[j].CreatedAt)
+		})
+		size := *files[0].Size
+		group := Group{
+			Key:         key,
+			Size:        size,
+			WastedBytes: size * int64(len(files)-1),
+			Files: utils.Map(files, func(f candidate) File {
+				out := File{ID: f.ID, Name: f.Name, Path: f.Path, UpdatedAt: f.UpdatedAt}
+				if f.ParentId != nil {
+					out.ParentId = *f.ParentId
+				}
+				if f.ChannelId != nil {
+					out.ChannelId = *f.ChannelId
+				}
+				return out
+			}),
+		}
+		report.Groups = append(report.Groups, group)
+		report.TotalFiles += len(files)
+		report.WastedBytes += group.WastedBytes
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		return report.Groups[i].WastedBytes > report.Groups[j].WastedBytes
+	})
+	report.TotalGroups = len(report.Groups)
+	return report, nil
+}
+
+func documentKeys(ctx context.Context, client *telegram.Client, files []candidate) (map[string]string, error) {
+	byChannel := map[int64][]candidate{}
+	for _, f := range files {
+		if f.ChannelId == nil || len(f.Parts) == 0 {
+			continue
+		}
+		byChannel[*f.ChannelId] = append(byChannel[*f.ChannelId], f)
+	}
+
+	keys := make(map[string]string, len(files))
+
+	err := tgc.RunWithAuth(ctx, client, "", func(ctx context.Context) error {
+		for channelId, channelFiles := range byChannel {
+			ids := []int{}
+			for _, f := range channelFiles {
+				for _, part := range f.Parts {
+					ids = append(ids, part.ID)
+				}
+			}
+			messages, err := tgc.GetMessages(ctx, client.API(), ids, channelId)
+			if err != nil {
+				return err
+			}
+			documents := make(map[int]int64, len(messages))
+			for _, m := range messages {
+				msg, ok := m.(*tg.Message)
+				if !ok {
+					continue
+				}
+				media, ok := msg.Media.(*tg.MessageMediaDocument)
+				if !ok {
+					continue
+				}
+				doc, ok := media.Document.(*tg.Document)
+				if !ok {
+					continue
+				}
+				documents[msg.ID] = doc.ID
+			}
+			for _, f := range channelFiles {
+				docIds := make([]string, 0, len(f.Parts))
+				for _, part := range f.Parts {
+					docId, ok := documents[part.ID]
+					if !ok {
+						break
+					}
+					docIds = append(docIds, strconv.FormatInt(docId, 10))
+				}
+				if len(docIds) != len(f.Parts) {
+					continue
+				}
+				keys[f.ID] = fmt.Sprintf("doc:%s:%d", strings.Join(docIds, ","), *f.Size)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// contentKeys returns the group key of every file the way Find builds it, a
+// stored hash or the Telegram documents of the parts with the size. Files
+// without either have no key.
+func contentKeys(ctx context.Context, client *telegram.Client, files []candidate) (map[string]string, error) {
+	keys := map[string]string{}
+	unhashed := []candidate{}
+	for _, f := range files {
+		if f.Hash != nil {
+			keys[f.ID] = "hash:" + *f.Hash
+		} else if f.Size != nil && *f.Size > 0 {
+			unhashed = append(unhashed, f)
+		}
+	}
+	if len(unhashed) == 0 || client == nil {
+		return keys, nil
+	}
+	docKeys, err := documentKeys(ctx, client, unhashed)
+	if err != nil {
+		return nil, err
+	}
+	for id, key := range docKeys {
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// Resolve keeps one file of every group and removes the others through
+// teldrive.delete_files_bulk. Groups come from the caller, so the content key
+// of every file is computed again and groups whose files do not share it are
+// failed. With ActionReference the other files are pointed at the parts of
+// the kept file in place, so their ids, shares and tags stay while their own
+// parts are left to the cleanup job.
+func Resolve(ctx context.Context, db *gorm.DB, client *telegram.Client, c cache.Cacher, recorder *events.Recorder,
+	userId int64, action Action, resolutions []Resolution) (*Result, error) {
+	if action != ActionDelete && action != ActionReference {
+		return nil, ErrInvalidAction
+	}
+
+	ids := []string{}
+	for _, resolution := range resolutions {
+		ids = append(ids, resolution.Keep)
+		ids = append(ids, resolution.Files...)
+	}
+	var files []candidate
+	if err := db.Model(&models.File{}).Where("id IN ? AND user_id = ? AND type = 'file' AND status = 'active'", ids,
+		userId).Scan(&files).Error; err != nil {
+		return nil, err
+	}
+	keys, err := contentKeys(ctx, client, files)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	for _, resolution := range resolutions {
+		removed, err := resolveGroup(db, c, recorder, userId, action, resolution, keys)
+		if err != nil {
+			res.FailedFiles = append(res.FailedFiles, resolution.Files...)
+			continue
+		}
+		for _, f := range removed {
+			if action == ActionReference {
+				res.Referenced++
+			} else {
+				res.Deleted++
+			}
+			res.Reclaimed += *f.Size
+		}
+	}
+	return res, nil
+}
+
+func resolveGroup(db *gorm.DB, c cache.Cacher, recorder *events.Recorder, userId int64, action Action,
+	resolution Resolution, keys map[string]string) ([]models.File, error) {
+	ids := utils.Filter(resolution.Files, func(id string) bool { return id != resolution.Keep })
+	if resolution.Keep == "" || len(ids) == 0 {
+		return nil, ErrInvalidGroup
+	}
+
+	var keep models.File
+	if err := db.Where("id = ? AND user_id = ? AND type = 'file' AND status = 'active'", resolution.Keep, userId).
+		First(&keep).Error; err != nil {
+		return nil, err
+	}
+
+	var dups []models.File
+	if err := db.Where("id IN ? AND user_id = ? AND type = 'file' AND status = 'active'", ids, userId).
+		Find(&dups).Error; err != nil {
+		return nil, err
+	}
+	if len(dups) != len(ids) {
+		return nil, ErrInvalidGroup
+	}
+	key := keys[keep.ID]
+	if key == "" {
+		return nil, ErrInvalidGroup
+	}
+	for _, f := range dups {
+		if keys[f.ID] != key || f.Size == nil || keep.Size == nil || *f.Size != *keep.Size {
+			return nil, ErrInvalidGroup
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if action != ActionReference {
+			return tx.Exec("call teldrive.delete_files_bulk($1 , $2)", ids, userId).Error
+		}
+		for _, f := range dups {
+			// The old parts move to a row pending deletion so the cleanup job
+			// deletes their messages, parts shared with active files survive it.
+			old := models.File{
+				Name:      f.Name,
+				Type:      f.Type,
+				Size:      f.Size,
+				Encrypted: f.Encrypted,
+				UserId:    userId,
+				Status:    "pending_deletion",
+				ParentId:  f.ParentId,
+				Parts:     f.Parts,
+				ChannelId: f.ChannelId,
+			}
+			if err := tx.Create(&old).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.File{}).Where("id = ?", f.ID).Updates(map[string]any{
+				"parts":      keep.Parts,
+				"channel_id": keep.ChannelId,
+				"encrypted":  keep.Encrypted,
+				"hash":       keep.Hash,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	eventType := events.OpDelete
+	if action == ActionReference {
+		eventType = events.OpUpdate
+	}
+	for _, f := range dups {
+		if action == ActionReference && c != nil {
+			cacheKeys := []string{cache.Key("files", f.ID), cache.Key("files", "messages", f.ID)}
+			for _, part := range f.Parts {
+				cacheKeys = append(cacheKeys, cache.Key("files", "location", f.ID, part.ID))
+			}
+			c.Delete(cacheKeys...)
+		}
+		source := &models.Source{ID: f.ID, Type: f.Type, Name: f.Name}
+		if f.ParentId != nil {
+			source.ParentID = *f.ParentId
+		}
+		recorder.Record(eventType, userId, source)
+	}
+	return dups, nil
+}
@@ -0,0 +1,479 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// staleAfter is how long a running job may go without a heartbeat before a
+// worker takes it over, its instance is assumed dead by then. Running jobs
+// beat every second.
+const staleAfter = time.Minute
+
+var (
+	ErrNotFound    = errors.New("job not found")
+	ErrUnknownType = errors.New("unknown job type")
+	ErrFinished    = errors.New("job already finished")
+)
+
+// Handler runs a single job. It should return ctx.Err() once the context is
+// cancelled and pick up from the last checkpoint when the job is resumed.
+type Handler func(ctx context.Context, job *Job) error
+
+// Job is the handle passed to a Handler to read its payload and report progress.
+type Job struct {
+	model  models.Job
+	mu     sync.Mutex
+	dirty  bool
+	state  datatypes.JSON
+	total  int64
+	done   int64
+	failed int64
+}
+
+func (j *Job) ID() string {
+	return j.model.ID
+}
+
+func (j *Job) UserId() int64 {
+	return j.model.UserId
+}
+
+// Decode unmarshals the payload the job was enqueued with.
+func (j *Job) Decode(v any) error {
+	return json.Unmarshal(j.model.Payload, v)
+}
+
+// Restore unmarshals the last checkpoint and reports whether there was one.
+func (j *Job) Restore(v any) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.state) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(j.state, v)
+}
+
+// Checkpoint stores the state the job resumes from after a restart.
+func (j *Job) Checkpoint(v any) error {
+	state, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = state
+	j.dirty = true
+	return nil
+}
+
+func (j *Job) SetTotal(total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total = total
+	j.dirty = true
+}
+
+func (j *Job) SetProgress(done, failed int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done, j.failed = done, failed
+	j.dirty = true
+}
+
+func (j *Job) Add(done, failed int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done += done
+	j.failed += failed
+	j.dirty = true
+}
+
+func (j *Job) Done() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done
+}
+
+func (j *Job) Failed() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.failed
+}
+
+func (j *Job) updates() map[string]any {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.dirty = false
+	return map[string]any{
+		"total":      j.total,
+		"done":       j.done,
+		"failed":     j.failed,
+		"state":      j.state,
+		"updated_at": time.Now().UTC(),
+	}
+}
+
+type Manager struct {
+	db       *gorm.DB
+	events   *events.Recorder
+	cnf      *config.JobsConfig
+	logger   *zap.Logger
+	handlers map[string]Handler
+	wake     chan struct{}
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]*runningJob
+}
+
+type runningJob struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+func NewManager(db *gorm.DB, events *events.Recorder, cnf *config.JobsConfig) *Manager {
+	return &Manager{
+		db:       db,
+		events:   events,
+		cnf:      cnf,
+		logger:   logging.DefaultLogger(),
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		running:  make(map[string]*runningJob),
+	}
+}
+
+// Register adds the handler for a job type. It must be called before Start.
+func (m *Manager) Register(jobType string, handler Handler) {
+	m.handlers[jobType] = handler
+}
+
+// Start starts the workers. Jobs of an instance which shut down are pending
+// again, those of one which died are claimed once their heartbeat is stale.
+func (m *Manager) Start(ctx context.Context) {
+	for range max(m.cnf.Workers, 1) {
+		m.wg.Add(1)
+		go m.work(ctx)
+	}
+}
+
+// Wait blocks until every worker has returned after the context passed to
+// Start is cancelled.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Manager) Enqueue(userId int64, jobType string, payload any) (*models.Job, error) {
+	if _, ok := m.handlers[jobType]; !ok {
+		return nil, ErrUnknownType
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job := &models.Job{UserId: userId, Type: jobType, Status: StatusPending, Payload: data}
+	if err := m.db.Create(job).Error; err != nil {
+		return nil, err
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (m *Manager) Get(userId int64, id string) (*models.Job, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotFound
+	}
+	var res []models.Job
+	if err := m.db.Where("id = ? AND user_id = ?", id, userId).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return &res[0], nil
+}
+
+func (m *Manager) List(userId int64, status string, limit int) ([]models.Job, error) {
+	res := []models.Job{}
+	query := m.db.Where("user_id = ?", userId)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Order("created_at desc").Limit(limit).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Cancel drops a pending job right away and asks a running one to stop.
+func (m *Manager) Cancel(userId int64, id string) (*models.Job, error) {
+	job, err := m.Get(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	switch job.Status {
+	case StatusPending:
+		res := m.db.Model(&models.Job{}).Where("id = ? AND status = ?", id, StatusPending).
+			Updates(map[string]any{"status": StatusCancelled, "finished_at": time.Now().UTC(),
+				"updated_at": time.Now().UTC()})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected > 0 {
+			job.Status = StatusCancelled
+			return job, nil
+		}
+		// Picked up by a worker in the meantime.
+		fallthrough
+	case StatusRunning:
+		// The status reaches workers which have not registered their cancel
+		// func yet and workers of other instances, they poll it.
+		res := m.db.Model(&models.Job{}).Where("id = ? AND status = ?", id, StatusRunning).
+			Updates(map[string]any{"status": StatusCancelled, "updated_at": time.Now().UTC()})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil, ErrFinished
+		}
+		m.mu.Lock()
+		if r, ok := m.running[id]; ok {
+			r.cancelled = true
+			r.cancel()
+		}
+		m.mu.Unlock()
+		return job, nil
+	}
+	return nil, ErrFinished
+}
+
+// checkCancelled stops a running job whose row was cancelled.
+func (m *Manager) checkCancelled(id string) {
+	var status string
+	if err := m.db.Model(&models.Job{}).Select("status").Where("id = ?", id).Scan(&status).Error; err != nil {
+		m.logger.Error("failed to read job status", zap.String("job", id), zap.Error(err))
+		return
+	}
+	if status != StatusCancelled {
+		return
+	}
+	m.mu.Lock()
+	if r, ok := m.running[id]; ok {
+		r.cancelled = true
+		r.cancel()
+	}
+	m.mu.Unlock()
+}
+
+func (m *Manager) work(ctx context.Context) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.cnf.PollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			job, err := m.claim()
+			if err != nil {
+				m.logger.Error("failed to claim job", zap.Error(err))
+				break
+			}
+			if job == nil {
+				break
+			}
+			m.run(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) claim() (*models.Job, error) {
+	var res []models.Job
+	if err := m.db.Raw(`UPDATE teldrive.jobs SET status = ?, started_at = coalesce(started_at, timezone('utc'::text, now())),
+	updated_at = timezone('utc'::text, now()), heartbeat_at = timezone('utc'::text, now())
+	WHERE id = (SELECT id FROM teldrive.jobs WHERE status = ? OR (status = ?
+	AND coalesce(heartbeat_at, updated_at) < timezone('utc'::text, now()) - make_interval(secs => ?))
+	ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING *`, StatusRunning, StatusPending, StatusRunning,
+		staleAfter.Seconds()).Scan(&res).Error; err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return &res[0], nil
+}
+
+func (m *Manager) run(ctx context.Context, model *models.Job) {
+	logger := m.logger.With(zap.String("job", model.ID), zap.String("type", model.Type))
+
+	job := &Job{model: *model, state: model.State, total: model.Total, done: model.Done, failed: model.Failed}
+
+	jobCtx, cancel := context.WithCancel(logging.WithLogger(ctx, logger))
+	defer cancel()
+
+	m.mu.Lock()
+	m.running[model.ID] = &runningJob{cancel: cancel}
+	m.mu.Unlock()
+	// A cancel may have come in after the claim.
+	m.checkCancelled(model.ID)
+
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				m.flush(job)
+				m.checkCancelled(job.ID())
+			}
+		}
+	}()
+
+	var err error
+	if handler, ok := m.handlers[model.Type]; ok {
+		err = m.safeRun(jobCtx, handler, job)
+	} else {
+		err = ErrUnknownType
+	}
+
+	m.mu.Lock()
+	cancelled := m.running[model.ID].cancelled
+	delete(m.running, model.ID)
+	m.mu.Unlock()
+
+	cancel()
+	<-flushed
+
+	updates := job.updates()
+	switch {
+	case cancelled:
+		updates["status"] = StatusCancelled
+	case err != nil && ctx.Err() != nil:
+		// Shutting down, the job resumes from its checkpoint on the next start.
+		updates["status"] = StatusPending
+	case err != nil:
+		updates["status"] = StatusFailed
+		updates["error"] = err.Error()
+	default:
+		updates["status"] = StatusCompleted
+	}
+	query := m.db.Model(&models.Job{}).Where("id = ?", model.ID)
+	if updates["status"] != StatusPending {
+		updates["finished_at"] = time.Now().UTC()
+	} else {
+		// A job cancelled during shutdown is not requeued.
+		query = query.Where("status = ?", StatusRunning)
+	}
+	if err := query.Updates(updates).Error; err != nil {
+		logger.Error("failed to update job", zap.Error(err))
+	}
+
+	source := &models.Source{ID: model.ID, Type: "job", Name: model.Type}
+	switch updates["status"] {
+	case StatusCompleted:
+		m.events.Record(events.OpJobCompleted, model.UserId, source)
+	case StatusFailed:
+		logger.Error("job failed", zap.Error(err))
+		m.events.Record(events.OpJobFailed, model.UserId, source)
+	case StatusCancelled:
+		m.events.Record(events.OpJobCancelled, model.UserId, source)
+	}
+}
+
+func (m *Manager) safeRun(ctx context.Context, handler Handler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// flush saves the progress of the job if it changed, together with the
+// heartbeat which keeps other instances from taking the job over.
+func (m *Manager) flush(job *Job) {
+	job.mu.Lock()
+	dirty := job.dirty
+	job.mu.Unlock()
+	updates := map[string]any{}
+	if dirty {
+		updates = job.updates()
+	}
+	updates["heartbeat_at"] = time.Now().UTC()
+	if err := m.db.Model(&models.Job{}).Where("id = ?", job.ID()).Updates(updates).Error; err != nil {
+		m.logger.Error("failed to save job progress", zap.String("job", job.ID()), zap.Error(err))
+	}
+}
+
+// Info is the api representation of a job.
+type Info struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Status     string          `json:"status"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Total      int64           `json:"total"`
+	Done       int64           `json:"done"`
+	Failed     int64           `json:"failed"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+}
+
+func ToInfo(job *models.Job) *Info {
+	info := &Info{
+		ID:         job.ID,
+		Type:       job.Type,
+		Status:     job.Status,
+		Payload:    json.RawMessage(job.Payload),
+		Total:      job.Total,
+		Done:       job.Done,
+		Failed:     job.Failed,
+		CreatedAt:  job.CreatedAt,
+		UpdatedAt:  job.UpdatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+	if job.Error != nil {
+		info.Error = *job.Error
+	}
+	return info
+}
+
+func ToInfos(res []models.Job) []*Info {
+	return utils.Map(res, func(job models.Job) *Info { return ToInfo(&job) })
+}
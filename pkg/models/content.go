@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+type FileContent struct {
+	FileId    string     `gorm:"type:uuid;primary_key"`
+	UserId    int64      `gorm:"type:bigint;not null"`
+	Content   string     `gorm:"type:text"`
+	Error     *string    `gorm:"type:text"`
+	Attempts  int        `gorm:"type:integer;not null;default:0"`
+	RetryAt   *time.Time `gorm:"type:timestamp"`
+	IndexedAt time.Time  `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+type Job struct {
+	ID          string         `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserId      int64          `gorm:"type:bigint;not null"`
+	Type        string         `gorm:"type:text;not null"`
+	Status      string         `gorm:"type:text;not null"`
+	Payload     datatypes.JSON `gorm:"type:jsonb"`
+	State       datatypes.JSON `gorm:"type:jsonb"`
+	Total       int64          `gorm:"type:bigint"`
+	Done        int64          `gorm:"type:bigint"`
+	Failed      int64          `gorm:"type:bigint"`
+	Error       *string        `gorm:"type:text"`
+	CreatedAt   time.Time      `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt   time.Time      `gorm:"default:timezone('utc'::text, now())"`
+	StartedAt   *time.Time     `gorm:"type:timestamp"`
+	FinishedAt  *time.Time     `gorm:"type:timestamp"`
+	HeartbeatAt *time.Time     `gorm:"type:timestamp"`
+}
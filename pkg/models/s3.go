@@ -0,0 +1,13 @@
+package models
+
+import (
+	"time"
+)
+
+type S3Key struct {
+	AccessKey string    `gorm:"type:text;primaryKey"`
+	SecretKey string    `gorm:"type:text;not null"`
+	UserId    int64     `gorm:"type:bigint;not null"`
+	Name      string    `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+type SSHKey struct {
+	ID          string    `gorm:"type:uuid;default:gen_random_uuid();primary_key"`
+	UserId      int64     `gorm:"type:bigint;not null"`
+	Name        string    `gorm:"type:text"`
+	Fingerprint string    `gorm:"type:text;not null;unique"`
+	PublicKey   string    `gorm:"type:text;not null"`
+	CreatedAt   time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+type FileStar struct {
+	FileId    string    `gorm:"type:uuid;primary_key"`
+	UserId    int64     `gorm:"type:bigint;primary_key"`
+	CreatedAt time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
+
+type FileOpen struct {
+	FileId   string    `gorm:"type:uuid;primary_key"`
+	UserId   int64     `gorm:"type:bigint;primary_key"`
+	OpenedAt time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+type Tag struct {
+	ID        string    `gorm:"type:uuid;default:gen_random_uuid();primary_key"`
+	UserId    int64     `gorm:"type:bigint;not null"`
+	Name      string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
+
+type FileTag struct {
+	FileId    string    `gorm:"type:uuid;primary_key"`
+	TagId     string    `gorm:"type:uuid;primary_key"`
+	CreatedAt time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
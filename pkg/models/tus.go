@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// TusUpload is a resumable upload. Its id is the upload_id of the uploaded
+// parts, the offset is derived from them and the spooled remainder.
+type TusUpload struct {
+	ID        string    `gorm:"type:uuid;primary_key"`
+	UserId    int64     `gorm:"type:bigint;not null"`
+	ParentId  string    `gorm:"type:uuid;not null"`
+	Name      string    `gorm:"type:text;not null"`
+	MimeType  string    `gorm:"type:text"`
+	Size      int64     `gorm:"type:bigint;not null"`
+	PartSize  int64     `gorm:"type:bigint;not null"`
+	ChannelId int64     `gorm:"type:bigint;not null"`
+	Encrypted bool      `gorm:"default:false"`
+	Metadata  string    `gorm:"type:text"`
+	FileId    *string   `gorm:"type:uuid"`
+	CreatedAt time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
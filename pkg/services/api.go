@@ -3,8 +3,10 @@ package services
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-faster/errors"
 	"github.com/gotd/td/telegram"
 	"github.com/ogen-go/ogen/ogenerrors"
@@ -14,11 +16,13 @@ import (
 	"github.com/tgdrive/teldrive/internal/api"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/database"
 	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/logging"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/internal/version"
+	"github.com/tgdrive/teldrive/pkg/jobs"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"gorm.io/gorm"
 )
@@ -29,8 +33,12 @@ type apiService struct {
 	cache       cache.Cacher
 	tgdb        *gorm.DB
 	worker      *tgc.BotWorker
+	clients     *tgc.ClientManager
 	middlewares []telegram.Middleware
 	events      *events.Recorder
+	jobs        *jobs.Manager
+	pgroonga    bool
+	trigram     bool
 }
 
 func (a *apiService) VersionVersion(ctx context.Context) (*api.ApiVersion, error) {
@@ -90,20 +98,34 @@ func NewApiService(db *gorm.DB,
 	cache cache.Cacher,
 	tgdb *gorm.DB,
 	worker *tgc.BotWorker,
-	events *events.Recorder) *apiService {
-	return &apiService{
+	clients *tgc.ClientManager,
+	events *events.Recorder,
+	jobs *jobs.Manager) *apiService {
+	a := &apiService{
 		db:          db,
 		cnf:         cnf,
 		cache:       cache,
 		tgdb:        tgdb,
 		worker:      worker,
+		clients:     clients,
 		middlewares: tgc.NewMiddleware(&cnf.TG, tgc.WithFloodWait(), tgc.WithRateLimit()),
 		events:      events,
+		jobs:        jobs,
+		pgroonga:    database.HasExtension(db, "pgroonga"),
+		trigram:     database.HasExtension(db, "pg_trgm"),
 	}
+	if !a.pgroonga {
+		logging.DefaultLogger().Info("pgroonga is not installed, falling back to pattern matching for search",
+			zap.Bool("pg_trgm", a.trigram))
+	}
+	a.registerJobs()
+	return a
 }
 
 type extendedService struct {
-	api *apiService
+	api      *apiService
+	davLocks sync.Map
+	tusLocks tusLocks
 }
 
 func NewExtendedService(api *apiService) *extendedService {
@@ -111,11 +133,16 @@ func NewExtendedService(api *apiService) *extendedService {
 }
 
 type extendedMiddleware struct {
-	next *api.Server
-	srv  *extendedService
+	next   *api.Server
+	srv    *extendedService
+	routes chi.Router
 }
 
 func (m *extendedMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.routes.Match(chi.NewRouteContext(), r.Method, r.URL.Path) {
+		m.routes.ServeHTTP(w, r)
+		return
+	}
 	route, ok := m.next.FindRoute(r.Method, r.URL.Path)
 	if !ok {
 		m.next.ServeHTTP(w, r)
@@ -129,6 +156,22 @@ func (m *extendedMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		args := route.Args()
 		m.srv.FilesStream(w, r, args[0], 0)
 		return
+	case api.FilesListOperation:
+		filters := newFileFilters(r.URL.Query())
+		r = r.WithContext(withFileFilters(r.Context(), filters))
+		if filters.page != nil {
+			w = &cursorWriter{ResponseWriter: w, page: filters.page}
+		}
+		if filters.snippets != nil {
+			sw := &snippetWriter{ResponseWriter: w, snippets: filters.snippets}
+			m.next.ServeHTTP(sw, r)
+			sw.flush()
+			return
+		}
+	case api.FilesDeleteOperation, api.FilesMoveOperation:
+		ctx, queued := withQueuedJob(r.Context())
+		r = r.WithContext(ctx)
+		w = &jobWriter{ResponseWriter: w, queued: queued}
 	case api.SharesStreamOperation:
 		args := route.Args()
 		m.srv.SharesStream(w, r, args[0], args[1])
@@ -138,7 +181,7 @@ func (m *extendedMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func NewExtendedMiddleware(next *api.Server, srv *extendedService) *extendedMiddleware {
-	return &extendedMiddleware{next: next, srv: srv}
+	return &extendedMiddleware{next: next, srv: srv, routes: srv.routes()}
 }
 
 type apiError struct {
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+)
+
+type archiveEntry struct {
+	models.File
+	Path string
+}
+
+// archiveEntries returns the selected files and everything below the selected
+// folders, with paths relative to the selection.
+func (a *apiService) archiveEntries(userId int64, ids []string) ([]archiveEntry, error) {
+	entries := []archiveEntry{}
+	if err := a.db.Raw(`WITH RECURSIVE tree AS (
+		SELECT id, type, name::text AS path FROM teldrive.files
+		WHERE id = any(?) AND user_id = ? AND status = 'active'
+		UNION ALL
+		SELECT f.id, f.type, tree.path || '/' || f.name FROM teldrive.files f
+		INNER JOIN tree ON f.parent_id = tree.id WHERE tree.type = 'folder' AND f.status = 'active'
+	) SELECT files.*, tree.path FROM tree INNER JOIN teldrive.files files ON files.id = tree.id ORDER BY tree.path`,
+		stringArray(ids), userId).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+	uniqueArchivePaths(entries)
+	return entries, nil
+}
+
+// uniqueArchivePaths renames entries whose path is already taken, selected
+// files of different folders may share a name. "a.txt" becomes "a (1).txt"
+// and the entries of a renamed folder move along with it. Entries come
+// sorted by path, so folders are renamed before their entries.
+func uniqueArchivePaths(entries []archiveEntry) {
+	paths := map[string]string{}
+	taken := map[string]bool{}
+	for i := range entries {
+		entry := &entries[i]
+		if entry.ParentId != nil {
+			if dir, ok := paths[*entry.ParentId]; ok {
+				entry.Path = dir + "/" + entry.Name
+			}
+		}
+		if taken[entry.Path] {
+			ext := path.Ext(entry.Path)
+			if entry.Type == "folder" || ext == path.Base(entry.Path) {
+				ext = ""
+			}
+			base := strings.TrimSuffix(entry.Path, ext)
+			for n := 1; taken[entry.Path]; n++ {
+				entry.Path = fmt.Sprintf("%s (%d)%s", base, n, ext)
+			}
+		}
+		taken[entry.Path] = true
+		paths[entry.ID] = entry.Path
+	}
+}
+
+// writeArchive streams the entries as an uncompressed zip, reading the files
+// of every channel through one client of the channel.
+func (a *apiService) writeArchive(ctx context.Context, w http.ResponseWriter, name string, userId int64, session string, entries []archiveEntry) {
+	streamArchive(ctx, w, name, entries, func(ctx context.Context, zw *zip.Writer, channelId int64, files []*archiveEntry) error {
+		client, release, err := a.channelClient(ctx, userId, channelId, session)
+		if err != nil {
+			return err
+		}
+		for _, entry := range files {
+			if err = a.writeArchiveEntry(ctx, client, zw, entry); err != nil {
+				break
+			}
+		}
+		release(err)
+		return err
+	})
+}
+
+// streamArchive writes the folders and empty files of the entries itself and
+// the files of every channel through writeFiles. Entries are stored rather
+// than deflated so nothing has to be buffered, and archive/zip switches to
+// zip64 for entries and archives over 4 GB on its own.
+//
+// The status is sent before the first file is read, so a failure aborts the
+// response without the central directory. Clients then see a broken download
+// instead of a valid zip with files cut short or missing.
+func streamArchive(ctx context.Context, w http.ResponseWriter, name string, entries []archiveEntry,
+	writeFiles func(ctx context.Context, zw *zip.Writer, channelId int64, files []*archiveEntry) error) {
+	logger := logging.FromContext(ctx)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	w.WriteHeader(http.StatusOK)
+
+	abort := func(err error) {
+		logger.Error("archive failed", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+
+	zw := zip.NewWriter(w)
+	channels := []int64{}
+	files := map[int64][]*archiveEntry{}
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Type == "folder" || entry.Size == nil || *entry.Size == 0 || entry.ChannelId == nil {
+			path := entry.Path
+			if entry.Type == "folder" {
+				path += "/"
+			}
+			if _, err := zw.CreateHeader(&zip.FileHeader{Name: path, Method: zip.Store, Modified: entry.UpdatedAt}); err != nil {
+				abort(err)
+			}
+			continue
+		}
+		if _, ok := files[*entry.ChannelId]; !ok {
+			channels = append(channels, *entry.ChannelId)
+		}
+		files[*entry.ChannelId] = append(files[*entry.ChannelId], entry)
+	}
+
+	// Files are written channel by channel so every channel needs one client only.
+	for _, channelId := range channels {
+		if err := writeFiles(ctx, zw, channelId, files[channelId]); err != nil {
+			abort(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		abort(err)
+	}
+}
+
+func (a *apiService) writeArchiveEntry(ctx context.Context, client *tg.Client, zw *zip.Writer, entry *archiveEntry) error {
+	header := &zip.FileHeader{
+		Name:               entry.Path,
+		Method:             zip.Store,
+		Modified:           entry.UpdatedAt,
+		UncompressedSize64: uint64(*entry.Size),
+	}
+	ew, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	parts, err := getParts(ctx, client, a.cache, &entry.File)
+	if err != nil {
+		return err
+	}
+	lr, err := reader.NewLinearReader(ctx, client, a.cache, &entry.File, parts, 0, *entry.Size-1, &a.cnf.TG, 0)
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+	_, err = io.CopyN(ew, lr, *entry.Size)
+	return err
+}
+
+func archiveIds(r *http.Request) []string {
+	ids := []string{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (e *extendedService) FilesArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := auth.GetUser(ctx)
+
+	ids := archiveIds(r)
+	if len(ids) == 0 {
+		writeError(w, r, &apiError{err: errors.New("ids should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	if slices.ContainsFunc(ids, func(id string) bool { return !isUUID(id) }) {
+		writeError(w, r, &apiError{err: errors.New("invalid file id"), code: http.StatusBadRequest})
+		return
+	}
+
+	entries, err := e.api.archiveEntries(userId, ids)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, r, &apiError{err: errors.New("file not found"), code: http.StatusNotFound})
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "download"
+		if len(ids) == 1 {
+			name = entries[0].Name
+		}
+	}
+	e.api.writeArchive(ctx, w, name, userId, auth.GetJWTUser(ctx).TgSession, entries)
+}
+
+func (e *extendedService) SharesArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	share, err := e.api.validFileShare(r, chi.URLParam(r, "id"))
+	if err != nil && errors.Is(err, ErrEmptyAuth) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ids := archiveIds(r)
+	if len(ids) == 0 {
+		ids = []string{share.FileId}
+	}
+	if slices.ContainsFunc(ids, func(id string) bool { return !isUUID(id) }) {
+		http.Error(w, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	// Only the shared file or files below the shared folder may be selected.
+	var shared int
+	if err := e.api.db.Raw(`WITH RECURSIVE tree AS (
+		SELECT id FROM teldrive.files WHERE id = ?
+		UNION ALL
+		SELECT f.id FROM teldrive.files f INNER JOIN tree ON f.parent_id = tree.id
+	) SELECT count(*) FROM tree WHERE id = any(?)`, share.FileId, stringArray(ids)).Scan(&shared).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if shared != len(ids) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	entries, err := e.api.archiveEntries(share.UserId, ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	name := share.Name
+	if len(ids) == 1 {
+		name = entries[0].Name
+	}
+	e.api.writeArchive(ctx, w, name, share.UserId, "", entries)
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func archiveFile(id, parent, name, typ, path string, size int64) archiveEntry {
+	channel := int64(1)
+	file := models.File{ID: id, Name: name, Type: typ, Size: &size, UpdatedAt: time.Now()}
+	if parent != "" {
+		file.ParentId = &parent
+	}
+	if typ == "file" {
+		file.ChannelId = &channel
+	}
+	return archiveEntry{File: file, Path: path}
+}
+
+func TestUniqueArchivePaths(t *testing.T) {
+	entries := []archiveEntry{
+		archiveFile("1", "a", "docs", "folder", "docs", 0),
+		archiveFile("2", "b", "docs", "folder", "docs", 0),
+		archiveFile("3", "1", "x.txt", "file", "docs/x.txt", 1),
+		archiveFile("4", "2", "x.txt", "file", "docs/x.txt", 1),
+		archiveFile("5", "a", "x.txt", "file", "x.txt", 1),
+		archiveFile("6", "b", "x.txt", "file", "x.txt", 1),
+		archiveFile("7", "c", "x.txt", "file", "x.txt", 1),
+		archiveFile("8", "a", ".env", "file", ".env", 1),
+		archiveFile("9", "b", ".env", "file", ".env", 1),
+	}
+	uniqueArchivePaths(entries)
+
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = entry.Path
+	}
+	assert.Equal(t, []string{"docs", "docs (1)", "docs/x.txt", "docs (1)/x.txt", "x.txt", "x (1).txt",
+		"x (2).txt", ".env", ".env (1)"}, paths)
+}
+
+func TestStreamArchive(t *testing.T) {
+	entries := []archiveEntry{
+		archiveFile("1", "", "docs", "folder", "docs", 0),
+		archiveFile("2", "1", "a.txt", "file", "docs/a.txt", 5),
+		archiveFile("3", "1", "empty", "file", "docs/empty", 0),
+	}
+	writeFiles := func(ctx context.Context, zw *zip.Writer, channelId int64, files []*archiveEntry) error {
+		for _, file := range files {
+			w, err := zw.Create(file.Path)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte("hello")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rec := httptest.NewRecorder()
+	streamArchive(context.Background(), rec, "docs", entries, writeFiles)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"docs/", "docs/empty", "docs/a.txt"}, names)
+}
+
+func TestStreamArchiveAbort(t *testing.T) {
+	entries := []archiveEntry{
+		archiveFile("1", "", "a.txt", "file", "a.txt", 5),
+		archiveFile("2", "", "b.txt", "file", "b.txt", 5),
+	}
+	writeFiles := func(ctx context.Context, zw *zip.Writer, channelId int64, files []*archiveEntry) error {
+		w, err := zw.Create(files[0].Path)
+		if err != nil {
+			return err
+		}
+		w.Write([]byte("he"))
+		return errors.New("read failed")
+	}
+
+	rec := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		streamArchive(context.Background(), rec, "files", entries, writeFiles)
+	})
+	// Without the central directory the download is not a valid zip.
+	_, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	assert.Error(t, err)
+	assert.False(t, strings.Contains(rec.Body.String(), "b.txt"))
+}
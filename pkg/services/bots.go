@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+var errNoSpareBots = errors.New("no spare bots left")
+
+// botFailover hands the stream the remaining bots of the channel one by one
+// and marks the bot given up on as failed. Each spare client is released when
+// ctx ends.
+func (a *apiService) botFailover(ctx context.Context, tokens []string, current string) reader.Failover {
+	var mu sync.Mutex
+	spare := slices.DeleteFunc(slices.Clone(tokens), func(token string) bool { return token == current })
+	return func(context.Context) (*tg.Client, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(spare) == 0 {
+			return nil, "", errNoSpareBots
+		}
+		a.worker.Failed(current)
+		token := spare[0]
+		spare = spare[1:]
+		current = token
+
+		client, release, err := a.clients.Bot(ctx, token)
+		if err != nil {
+			return nil, "", err
+		}
+		context.AfterFunc(ctx, release)
+		botId, _, _ := strings.Cut(token, ":")
+		return client, botId, nil
+	}
+}
+
+// channelClient returns a pooled client for reading the files of a channel,
+// a bot when the channel has any and the user session otherwise. release
+// must be called with the outcome of the read.
+func (a *apiService) channelClient(ctx context.Context, userId, channelId int64, session string) (*tg.Client, func(error), error) {
+	tokens, err := getBotsToken(a.db, a.cache, userId, channelId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 || a.cnf.TG.DisableStreamBots {
+		if session == "" {
+			if session, err = a.userSession(userId); err != nil {
+				return nil, nil, err
+			}
+		}
+		client, release, err := a.clients.User(ctx, session)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func(error) { release() }, nil
+	}
+	a.worker.Set(tokens, channelId)
+	token, _, done := a.worker.Acquire(channelId)
+	client, release, err := a.clients.Bot(ctx, token)
+	if err != nil {
+		done(err)
+		return nil, nil, err
+	}
+	return client, func(err error) {
+		release()
+		done(err)
+	}, nil
+}
+
+func (e *extendedService) BotsStats(w http.ResponseWriter, r *http.Request) {
+	var tokens []string
+	if err := e.api.db.Model(&models.Bot{}).Where("user_id = ?", auth.GetUser(r.Context())).
+		Pluck("token", &tokens).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, e.api.worker.Stats(tokens))
+}
@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/tg"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/tgdrive/teldrive/internal/api"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/crypt"
@@ -20,9 +20,9 @@ import (
 	"gorm.io/gorm"
 )
 
-func getParts(ctx context.Context, client *telegram.Client, c cache.Cacher, file *models.File) ([]types.Part, error) {
+func getParts(ctx context.Context, client *tg.Client, c cache.Cacher, file *models.File) ([]types.Part, error) {
 	return cache.Fetch(c, cache.Key("files", "messages", file.ID), 60*time.Minute, func() ([]types.Part, error) {
-		messages, err := tgc.GetMessages(ctx, client.API(), utils.Map(file.Parts, func(part api.Part) int {
+		messages, err := tgc.GetMessages(ctx, client, utils.Map(file.Parts, func(part api.Part) int {
 			return part.ID
 		}), *file.ChannelId)
 
@@ -87,3 +87,11 @@ func getBotsToken(db *gorm.DB, c cache.Cacher, userId, channelId int64) ([]strin
 	})
 
 }
+
+func stringArray(items []string) pgtype.Array[string] {
+	return pgtype.Array[string]{
+		Elements: items,
+		Valid:    true,
+		Dims:     []pgtype.ArrayDimension{{Length: int32(len(items)), LowerBound: 1}},
+	}
+}
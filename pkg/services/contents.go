@@ -0,0 +1,349 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/search"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+var defaultIndexMimeTypes = []string{"text/*", "application/json", "application/xml", "application/x-yaml",
+	"application/yaml", "application/toml", "application/javascript", "application/x-sh", "application/sql"}
+
+var errBinaryContent = errors.New("file does not contain text")
+
+const snippetOptions = "MaxFragments=2, MaxWords=20, MinWords=5, StartSel=<<, StopSel=>>"
+
+type contentMatch struct {
+	File    *api.File `json:"file"`
+	Snippet string    `json:"snippet"`
+}
+
+type contentMatches struct {
+	Items []contentMatch `json:"items"`
+	Meta  struct {
+		Count       int `json:"count"`
+		TotalPages  int `json:"totalPages"`
+		CurrentPage int `json:"currentPage"`
+	} `json:"meta"`
+}
+
+type contentIndexer struct {
+	api    *apiService
+	logger *zap.Logger
+}
+
+// StartContentIndexer periodically downloads small text files and stores
+// their contents for search.
+func StartContentIndexer(ctx context.Context, api *apiService) {
+	if !api.cnf.Index.Enable {
+		return
+	}
+	indexer := &contentIndexer{api: api, logger: logging.DefaultLogger().With(zap.String("component", "indexer"))}
+	go indexer.run(ctx)
+}
+
+func (c *contentIndexer) run(ctx context.Context) {
+	ticker := time.NewTicker(c.api.cnf.Index.Interval)
+	defer ticker.Stop()
+	for {
+		c.indexBatch(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *contentIndexer) mimePatterns() []string {
+	mimeTypes := c.api.cnf.Index.MimeTypes
+	if len(mimeTypes) == 0 {
+		mimeTypes = defaultIndexMimeTypes
+	}
+	return utils.Map(mimeTypes, func(mimeType string) string {
+		return strings.Replace(escapeLike(strings.ToLower(mimeType)), "*", "%", 1)
+	})
+}
+
+// indexBatch indexes new and changed files. Files failing to be indexed are
+// retried with backoff until max attempts, so they do not take the place of
+// the other files in every batch.
+func (c *contentIndexer) indexBatch(ctx context.Context) {
+	var files []struct {
+		models.File
+		Attempts int
+	}
+	if err := c.api.db.Table("teldrive.files as f").
+		Select("f.*", "CASE WHEN c.indexed_at >= f.updated_at THEN c.attempts ELSE 0 END as attempts").
+		Joins("LEFT JOIN teldrive.file_contents as c ON c.file_id = f.id").
+		Where("f.type = 'file' AND f.status = 'active' AND f.channel_id IS NOT NULL").
+		Where("f.size > 0 AND f.size <= ?", c.api.cnf.Index.MaxSize).
+		Where("lower(f.mime_type) LIKE ANY (?)", stringArray(c.mimePatterns())).
+		Where("c.file_id IS NULL OR c.indexed_at < f.updated_at OR c.retry_at <= ?", time.Now().UTC()).
+		Order("f.updated_at DESC").Limit(c.api.cnf.Index.BatchSize).
+		Scan(&files).Error; err != nil {
+		c.logger.Error("failed to find files to index", zap.Error(err))
+		return
+	}
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		content, err := c.extract(ctx, &file.File)
+		if ctx.Err() != nil {
+			return
+		}
+		row := models.FileContent{FileId: file.ID, UserId: file.UserId, Content: content, IndexedAt: time.Now().UTC()}
+		if err != nil {
+			c.logger.Debug("failed to index file", zap.String("file", file.ID), zap.Error(err))
+			c.failed(&row, file.Attempts, err)
+		}
+		if err := c.save(&row); err != nil {
+			// Contents postgres refuses, like a too large tsvector, are stored as a failure.
+			c.logger.Error("failed to save file contents", zap.String("file", file.ID), zap.Error(err))
+			row.Content = ""
+			c.failed(&row, file.Attempts, err)
+			if err := c.save(&row); err != nil {
+				c.logger.Error("failed to save file contents", zap.String("file", file.ID), zap.Error(err))
+			}
+		}
+	}
+}
+
+// failed records a failed attempt. Binary files are not retried, other
+// failures are retried after the interval doubled with every attempt.
+func (c *contentIndexer) failed(row *models.FileContent, attempts int, err error) {
+	row.Error = utils.Ptr(err.Error())
+	if errors.Is(err, errBinaryContent) {
+		return
+	}
+	row.Attempts = attempts + 1
+	if row.Attempts < c.api.cnf.Index.MaxAttempts {
+		row.RetryAt = utils.Ptr(row.IndexedAt.Add(c.api.cnf.Index.Interval << (row.Attempts - 1)))
+	}
+}
+
+func (c *contentIndexer) save(row *models.FileContent) error {
+	return c.api.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"content", "error", "attempts", "retry_at", "indexed_at"}),
+	}).Create(row).Error
+}
+
+func (c *contentIndexer) extract(ctx context.Context, file *models.File) (string, error) {
+	client, release, err := c.api.channelClient(ctx, file.UserId, *file.ChannelId, "")
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	err = func() error {
+		parts, err := getParts(ctx, client, c.api.cache, file)
+		if err != nil {
+			return err
+		}
+		lr, err := reader.NewLinearReader(ctx, client, c.api.cache, file, parts, 0, *file.Size-1, &c.api.cnf.TG, 0)
+		if err != nil {
+			return err
+		}
+		defer lr.Close()
+		data, err = io.ReadAll(io.LimitReader(lr, c.api.cnf.Index.MaxSize))
+		return err
+	}()
+	release(err)
+	if err != nil {
+		return "", err
+	}
+	return extractText(data)
+}
+
+// extractText rejects binary data and cleans up what postgres would refuse to store as text.
+func extractText(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if bytes.IndexByte(data[:min(len(data), 8192)], 0) >= 0 {
+		return "", errBinaryContent
+	}
+	text := strings.ToValidUTF8(string(data), "")
+	// A few broken sequences come from legacy encodings, mostly invalid data is not text.
+	if len(data)-len(text) > len(data)/10 {
+		return "", errBinaryContent
+	}
+	return text, nil
+}
+
+func (e *extendedService) FilesSearchContents(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeError(w, r, &apiError{err: errors.New("q should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	page, limit := 1, 50
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, &apiError{err: errors.New("invalid page"), code: http.StatusBadRequest})
+			return
+		}
+		page = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, &apiError{err: errors.New("invalid limit"), code: http.StatusBadRequest})
+			return
+		}
+		limit = min(n, 500)
+	}
+
+	var res []struct {
+		models.File
+		Snippet string
+		Total   int
+	}
+	if err := e.api.db.Table("teldrive.files as files").
+		Select(`files.*, count(*) OVER () as total, ts_headline('simple', c.content, websearch_to_tsquery('simple', ?), ?) as snippet`,
+			q, snippetOptions).
+		Joins("JOIN teldrive.file_contents as c ON c.file_id = files.id").
+		Where("files.user_id = ? AND files.status = 'active'", userId).
+		Where("c.tsv @@ websearch_to_tsquery('simple', ?)", q).
+		Order(clause.Expr{SQL: "ts_rank(c.tsv, websearch_to_tsquery('simple', ?)) DESC, files.updated_at DESC", Vars: []any{q}}).
+		Offset((page - 1) * limit).Limit(limit).
+		Scan(&res).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	out := contentMatches{Items: []contentMatch{}}
+	for _, item := range res {
+		out.Items = append(out.Items, contentMatch{File: mapper.ToFileOut(item.File), Snippet: item.Snippet})
+		out.Meta.Count = item.Total
+	}
+	out.Meta.CurrentPage = page
+	out.Meta.TotalPages = int(math.Ceil(float64(out.Meta.Count) / float64(limit)))
+	writeJSON(w, http.StatusOK, &out)
+}
+
+// contentSnippets finds the snippets of the listed files matching the content
+// terms of a search, they are added to the listing by snippetWriter.
+func (afb *fileQueryBuilder) contentSnippets(ids []string) error {
+	if afb.search == nil || afb.filters.snippets == nil || len(ids) == 0 {
+		return nil
+	}
+	var (
+		queries []string
+		args    []any
+	)
+	for _, term := range afb.search.Terms {
+		if term.Field == search.FieldContent && !term.Negated {
+			queries = append(queries, "websearch_to_tsquery('simple', ?)")
+			args = append(args, term.Value)
+		}
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+	tsquery := "(" + strings.Join(queries, " && ") + ")"
+	var res []struct {
+		FileId  string
+		Snippet string
+	}
+	vars := append(slices.Clone(args), snippetOptions, stringArray(ids))
+	vars = append(vars, args...)
+	if err := afb.db.Raw(fmt.Sprintf(`SELECT file_id, ts_headline('simple', content, %s, ?) as snippet
+		FROM teldrive.file_contents WHERE file_id = any(?) AND tsv @@ %s`, tsquery, tsquery), vars...).
+		Scan(&res).Error; err != nil {
+		return err
+	}
+	for _, item := range res {
+		afb.filters.snippets[item.FileId] = item.Snippet
+	}
+	return nil
+}
+
+// snippetWriter holds back the listing written by the generated handler and
+// adds the snippets to its items, the generated file has no field for them.
+type snippetWriter struct {
+	http.ResponseWriter
+	snippets map[string]string
+	code     int
+	body     bytes.Buffer
+}
+
+func (w *snippetWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *snippetWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *snippetWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flush writes the response once the handler returned.
+func (w *snippetWriter) flush() {
+	if w.code == 0 {
+		return
+	}
+	body := w.body.Bytes()
+	if w.code == http.StatusOK && len(w.snippets) > 0 {
+		if out, err := addSnippets(body, w.snippets); err == nil {
+			body = out
+			w.Header().Del("Content-Length")
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(body)
+}
+
+func addSnippets(body []byte, snippets map[string]string) ([]byte, error) {
+	var list map[string]json.RawMessage
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(list["items"], &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var id string
+		if err := json.Unmarshal(item["id"], &id); err != nil {
+			continue
+		}
+		if snippet, ok := snippets[id]; ok {
+			item["snippet"], _ = json.Marshal(snippet)
+		}
+	}
+	var err error
+	if list["items"], err = json.Marshal(items); err != nil {
+		return nil, err
+	}
+	return json.Marshal(list)
+}
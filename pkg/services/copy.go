@@ -0,0 +1,400 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/jobs"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"gorm.io/datatypes"
+)
+
+var errCopyParts = errors.New("failed to copy all file parts")
+
+type copyItem struct {
+	file     models.File
+	parentId string
+}
+
+func (a *apiService) copyDestination(userId int64, destination string) (string, error) {
+	if isUUID(destination) {
+		return destination, nil
+	}
+	var destRes []models.File
+	if err := a.db.Raw("select * from teldrive.create_directories(?, ?)", userId, destination).
+		Scan(&destRes).Error; err != nil {
+		return "", err
+	}
+	return destRes[0].ID, nil
+}
+
+func copyParts(ctx context.Context, client *tg.Client, file *models.File, channel *tg.InputChannel) ([]api.Part, error) {
+	ids := utils.Map(file.Parts, func(part api.Part) int { return part.ID })
+	messages, err := tgc.GetMessages(ctx, client, ids, *file.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	newIds := []api.Part{}
+	for i, message := range messages {
+		item, ok := message.(*tg.Message)
+		if !ok {
+			return nil, errCopyParts
+		}
+		media, ok := item.Media.(*tg.MessageMediaDocument)
+		if !ok {
+			return nil, errCopyParts
+		}
+		document, ok := media.Document.(*tg.Document)
+		if !ok {
+			return nil, errCopyParts
+		}
+
+		id, _ := randInt64()
+		request := tg.MessagesSendMediaRequest{
+			Silent:   true,
+			Peer:     &tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash},
+			Media:    &tg.InputMediaDocument{ID: document.AsInput()},
+			RandomID: id,
+		}
+		res, err := client.MessagesSendMedia(ctx, &request)
+		if err != nil {
+			return nil, err
+		}
+
+		updates, ok := res.(*tg.Updates)
+		if !ok {
+			return nil, errCopyParts
+		}
+
+		var msg *tg.Message
+		for _, update := range updates.Updates {
+			channelMsg, ok := update.(*tg.UpdateNewChannelMessage)
+			if ok {
+				msg = channelMsg.Message.(*tg.Message)
+				break
+			}
+		}
+		if msg == nil {
+			return nil, errCopyParts
+		}
+		p := api.Part{ID: msg.ID}
+		if file.Parts[i].Salt.Value != "" {
+			p.Salt = file.Parts[i].Salt
+		}
+		newIds = append(newIds, p)
+	}
+
+	if len(newIds) != len(file.Parts) {
+		return nil, errCopyParts
+	}
+	return newIds, nil
+}
+
+func copiedFile(file *models.File, name, parentId string, channelId int64, parts []api.Part) *models.File {
+	dbFile := &models.File{
+		Name:      name,
+		Size:      file.Size,
+		Type:      file.Type,
+		MimeType:  file.MimeType,
+		UserId:    file.UserId,
+		Status:    "active",
+		ParentId:  utils.Ptr(parentId),
+		Encrypted: file.Encrypted,
+		Category:  file.Category,
+		Hash:      file.Hash,
+		UpdatedAt: file.UpdatedAt,
+	}
+	if file.Type == "file" {
+		dbFile.ChannelId = &channelId
+	}
+	if len(parts) > 0 {
+		dbFile.Parts = datatypes.NewJSONSlice(parts)
+	}
+	return dbFile
+}
+
+type copyJob struct {
+	SourceId  string `json:"sourceId"`
+	RootId    string `json:"rootId"`
+	ChannelId int64  `json:"channelId"`
+}
+
+type copyState struct {
+	Folders map[string]string `json:"folders"`
+	Copied  map[string]bool   `json:"copied"`
+}
+
+// copyFolder creates the destination folder right away and leaves the rest of
+// the tree to a background job, since re-sending every part of a large tree
+// takes far longer than a request should.
+func (a *apiService) copyFolder(ctx context.Context, folder *models.File, req *api.FileCopy, parentId string, channelId int64) (*api.File, error) {
+	userId := auth.GetUser(ctx)
+
+	root := copiedFile(folder, req.NewName.Or(folder.Name), parentId, channelId, nil)
+	if req.UpdatedAt.IsSet() && !req.UpdatedAt.Value.IsZero() {
+		root.UpdatedAt = req.UpdatedAt.Value
+	} else {
+		root.UpdatedAt = time.Now().UTC()
+	}
+	if err := a.db.Create(root).Error; err != nil {
+		return nil, &apiError{err: err}
+	}
+
+	job, err := a.jobs.Enqueue(userId, jobCopy, &copyJob{SourceId: folder.ID, RootId: root.ID, ChannelId: channelId})
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+	setQueuedJob(ctx, job)
+
+	a.events.Record(events.OpCopy, userId, &models.Source{
+		ID:       root.ID,
+		Type:     root.Type,
+		Name:     root.Name,
+		ParentID: parentId,
+	})
+
+	return mapper.ToFileOut(*root), nil
+}
+
+func (a *apiService) runCopyJob(ctx context.Context, job *jobs.Job) error {
+	var payload copyJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+
+	state := copyState{Folders: map[string]string{}, Copied: map[string]bool{}}
+	if _, err := job.Restore(&state); err != nil {
+		return err
+	}
+	state.Folders[payload.SourceId] = payload.RootId
+
+	items, err := a.copyFolderTree(payload.SourceId, job.UserId(), payload.ChannelId, &state)
+	if err != nil {
+		return err
+	}
+	if err := job.Checkpoint(&state); err != nil {
+		return err
+	}
+
+	pending := []copyItem{}
+	for _, item := range items {
+		if !state.Copied[item.file.ID] {
+			pending = append(pending, item)
+		}
+	}
+	job.SetTotal(int64(len(items)))
+	job.SetProgress(int64(len(items)-len(pending)), 0)
+
+	if err := a.copyFiles(ctx, job, payload.ChannelId, pending, &state); err != nil {
+		return err
+	}
+	if failed := job.Failed(); failed > 0 {
+		return fmt.Errorf("failed to copy %d of %d files", failed, len(items))
+	}
+	return nil
+}
+
+// copyFolderTree creates the sub folders of src which are not in state yet and
+// returns the files to copy together with their new parent.
+func (a *apiService) copyFolderTree(src string, userId, channelId int64, state *copyState) ([]copyItem, error) {
+	items := []copyItem{}
+	queue := []copyItem{{file: models.File{ID: src}, parentId: state.Folders[src]}}
+	// Folders created by the copy must not be walked again when copying a folder into itself.
+	created := map[string]bool{}
+	for _, id := range state.Folders {
+		created[id] = true
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		var children []models.File
+		if err := a.db.Where("parent_id = ? AND user_id = ? AND status = 'active'", current.file.ID, userId).
+			Order("name").Find(&children).Error; err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if created[child.ID] {
+				continue
+			}
+			if child.Type != "folder" {
+				items = append(items, copyItem{file: child, parentId: current.parentId})
+				continue
+			}
+			id, ok := state.Folders[child.ID]
+			if !ok {
+				folder := copiedFile(&child, child.Name, current.parentId, channelId, nil)
+				if err := a.db.Create(folder).Error; err != nil {
+					return nil, err
+				}
+				id = folder.ID
+				state.Folders[child.ID] = id
+				created[id] = true
+			}
+			queue = append(queue, copyItem{file: child, parentId: id})
+		}
+	}
+	return items, nil
+}
+
+// copyFiles copies the parts of the files with the bots of the destination
+// channel. Bots can only read parts of channels they are members of, so files
+// stored in channels without the same bots are copied with the user session.
+func (a *apiService) copyFiles(ctx context.Context, job *jobs.Job, channelId int64, items []copyItem, state *copyState) error {
+	logger := logging.FromContext(ctx)
+	userId := job.UserId()
+
+	var mu sync.Mutex
+
+	tokens, err := getBotsToken(a.db, a.cache, userId, channelId)
+	if err != nil {
+		logger.Error("failed to get bots", zap.Error(err))
+	}
+
+	botItems, sessionItems := []copyItem{}, []copyItem{}
+	readable := map[int64]bool{channelId: true}
+	for _, item := range items {
+		source := channelId
+		if len(item.file.Parts) > 0 && item.file.ChannelId != nil {
+			source = *item.file.ChannelId
+		}
+		ok, seen := readable[source]
+		if !seen {
+			sourceTokens, err := getBotsToken(a.db, a.cache, userId, source)
+			if err != nil {
+				return err
+			}
+			ok = len(tokens) > 0
+			for _, token := range tokens {
+				if !slices.Contains(sourceTokens, token) {
+					ok = false
+					break
+				}
+			}
+			readable[source] = ok
+		}
+		if ok && len(tokens) > 0 {
+			botItems = append(botItems, item)
+		} else {
+			sessionItems = append(sessionItems, item)
+		}
+	}
+
+	newQueue := func(items []copyItem) chan copyItem {
+		queue := make(chan copyItem, len(items))
+		for _, item := range items {
+			queue <- item
+		}
+		close(queue)
+		return queue
+	}
+	botQueue, sessionQueue := newQueue(botItems), newQueue(sessionItems)
+
+	worker := func(client *telegram.Client, token string, queue chan copyItem) error {
+		return tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+			channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+			if err != nil {
+				return err
+			}
+			for item := range queue {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err := a.copyItem(ctx, client.API(), channel, channelId, &item); err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					logger.Error("copy failed", zap.String("file", item.file.ID), zap.Error(err))
+					job.Add(0, 1)
+					continue
+				}
+				mu.Lock()
+				state.Copied[item.file.ID] = true
+				job.Checkpoint(state)
+				mu.Unlock()
+				job.Add(1, 0)
+			}
+			return nil
+		})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(tokens)+1)
+
+	if len(sessionItems) > 0 {
+		session, err := a.userSession(userId)
+		if err != nil {
+			return err
+		}
+		client, err := tgc.AuthClient(ctx, &a.cnf.TG, session, a.middlewares...)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- worker(client, "", sessionQueue)
+		}()
+	}
+	if len(botItems) > 0 {
+		for _, token := range tokens {
+			client, err := tgc.BotClient(ctx, a.tgdb, &a.cnf.TG, token, a.middlewares...)
+			if err != nil {
+				errs <- err
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- worker(client, token, botQueue)
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var workerErr error
+	for err := range errs {
+		if err != nil {
+			workerErr = err
+		}
+	}
+	// Items left in the queues were never picked up by a worker.
+	if left := len(botQueue) + len(sessionQueue); left > 0 {
+		job.Add(0, int64(left))
+		if workerErr != nil {
+			return workerErr
+		}
+	}
+	return nil
+}
+
+func (a *apiService) copyItem(ctx context.Context, client *tg.Client, channel *tg.InputChannel, channelId int64, item *copyItem) error {
+	var parts []api.Part
+	if len(item.file.Parts) > 0 && item.file.ChannelId != nil {
+		var err error
+		parts, err = copyParts(ctx, client, &item.file, channel)
+		if err != nil {
+			return err
+		}
+	}
+	return a.db.Create(copiedFile(&item.file, item.file.Name, item.parentId, channelId, parts)).Error
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+const nextCursorHeader = "X-Next-Cursor"
+
+var (
+	errInvalidCursor  = errors.New("invalid cursor")
+	errCursorMismatch = errors.New("cursor was created for a different sort order")
+)
+
+// keysetColumns maps the sortable fields to the type their cursor value is cast to.
+var keysetColumns = map[string]string{
+	"name":       "text",
+	"updated_at": "timestamp",
+	"size":       "bigint",
+	"id":         "uuid",
+}
+
+// fileCursor points right after the last file of a page. It is handed out
+// base64 encoded and only meant to be passed back as is.
+type fileCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v,omitempty"`
+	ID    string `json:"id"`
+}
+
+// keysetPage carries the cursor of a listing into the query and the cursor of
+// the following page back out to the response.
+type keysetPage struct {
+	after *fileCursor
+	err   error
+	next  string
+}
+
+func newKeysetPage(cursor string) *keysetPage {
+	page := &keysetPage{}
+	if cursor == "" {
+		return page
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		page.after = &fileCursor{}
+		err = json.Unmarshal(data, page.after)
+	}
+	if err != nil || page.after.ID == "" || !isUUID(page.after.ID) {
+		page.err = errInvalidCursor
+	}
+	return page
+}
+
+func encodeCursor(c *fileCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursorWriter adds the next cursor header before the generated handler
+// writes its response.
+type cursorWriter struct {
+	http.ResponseWriter
+	page  *keysetPage
+	wrote bool
+}
+
+func (w *cursorWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		if w.page.next != "" {
+			w.Header().Set(nextCursorHeader, w.page.next)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cursorWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cursorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// executeKeyset pages with a (sort key, id) comparison instead of ranking the
+// whole result, so every page costs the same no matter how deep it is.
+func (afb *fileQueryBuilder) executeKeyset(query *gorm.DB, filesQuery *api.FilesListParams, userId int64) (*api.FileList, error) {
+	page := afb.filters.page
+	if page.err != nil {
+		return nil, &apiError{err: page.err, code: http.StatusBadRequest}
+	}
+
+	field := utils.CamelToSnake(string(filesQuery.Sort.Value))
+	cast, ok := keysetColumns[field]
+	if !ok {
+		return nil, &apiError{err: fmt.Errorf("sorting by %s is not supported with cursors", filesQuery.Sort.Value),
+			code: http.StatusBadRequest}
+	}
+	column := field
+	if field == "size" {
+		column = "coalesce(size, 0)"
+	}
+	order := strings.ToUpper(string(filesQuery.Order.Value))
+	op := ">"
+	if order == "DESC" {
+		op = "<"
+	}
+
+	if page.after != nil {
+		if page.after.Sort != field || page.after.Order != order {
+			return nil, &apiError{err: errCursorMismatch, code: http.StatusBadRequest}
+		}
+		if field == "id" {
+			query = query.Where(fmt.Sprintf("id %s ?", op), page.after.ID)
+		} else {
+			query = query.Where(fmt.Sprintf("(%s, id) %s (?::%s, ?::uuid)", column, op, cast),
+				page.after.Value, page.after.ID)
+		}
+	}
+
+	orderBy := fmt.Sprintf("id %s", order)
+	if field != "id" {
+		orderBy = fmt.Sprintf("%s %s, %s", column, order, orderBy)
+	}
+
+	limit := filesQuery.Limit.Value
+	res := []models.File{}
+	if err := afb.buildSubqueryCTE(query, filesQuery, userId).Model(&models.File{}).
+		Select(selectedFields).Where(query).Order(orderBy).Limit(limit + 1).
+		Scan(&res).Error; err != nil {
+		if strings.Contains(err.Error(), "file not found") {
+			return nil, &apiError{err: errors.New("invalid path"), code: 404}
+		}
+		return nil, &apiError{err: err}
+	}
+
+	if len(res) > limit {
+		res = res[:limit]
+		last := res[len(res)-1]
+		page.next = encodeCursor(&fileCursor{Sort: field, Order: order, Value: cursorValue(field, &last), ID: last.ID})
+	}
+
+	if err := afb.contentSnippets(utils.Map(res, func(item models.File) string { return item.ID })); err != nil {
+		return nil, &apiError{err: err}
+	}
+
+	files := utils.Map(res, func(item models.File) api.File { return *mapper.ToFileOut(item) })
+
+	// Counting the whole listing is what cursors avoid, so the meta only describes this page.
+	return &api.FileList{Items: files, Meta: api.FileListMeta{Count: len(files)}}, nil
+}
+
+func cursorValue(field string, file *models.File) string {
+	switch field {
+	case "name":
+		return file.Name
+	case "updated_at":
+		return file.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	case "size":
+		if file.Size == nil {
+			return "0"
+		}
+		return strconv.FormatInt(*file.Size, 10)
+	}
+	return ""
+}
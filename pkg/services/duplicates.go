@@ -0,0 +1,65 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/dedupe"
+)
+
+type duplicatesResolve struct {
+	Action dedupe.Action       `json:"action"`
+	Groups []dedupe.Resolution `json:"groups"`
+}
+
+func (e *extendedService) FilesDuplicates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := auth.GetUser(ctx)
+
+	client, err := tgc.AuthClient(ctx, &e.api.cnf.TG, auth.GetJWTUser(ctx).TgSession, e.api.middlewares...)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	report, err := dedupe.Find(ctx, e.api.db, client, userId)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (e *extendedService) FilesResolveDuplicates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := auth.GetUser(ctx)
+
+	var req duplicatesResolve
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Groups) == 0 {
+		writeError(w, r, &apiError{err: errors.New("groups should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+
+	client, err := tgc.AuthClient(ctx, &e.api.cnf.TG, auth.GetJWTUser(ctx).TgSession, e.api.middlewares...)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	res, err := dedupe.Resolve(ctx, e.api.db, client, e.api.cache, e.api.events, userId, req.Action, req.Groups)
+	if errors.Is(err, dedupe.ErrInvalidAction) {
+		writeError(w, r, &apiError{err: err, code: http.StatusBadRequest})
+		return
+	}
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
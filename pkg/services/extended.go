@@ -0,0 +1,104 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"go.uber.org/zap"
+)
+
+// routes registers the endpoints which are not part of the generated api.
+func (e *extendedService) routes() chi.Router {
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(e.authenticate)
+		r.Get("/files/duplicates", e.FilesDuplicates)
+		r.Post("/files/duplicates", e.FilesResolveDuplicates)
+		r.Get("/files/tags", e.FilesTagStats)
+		r.Get("/files/contents", e.FilesSearchContents)
+		r.Post("/files/tags", e.FilesUpdateTags)
+		r.Get("/files/{id}/tags", e.FilesGetTags)
+		r.Post("/files/starred", e.FilesUpdateStarred)
+		r.Get("/files/archive", e.FilesArchive)
+		r.Get("/files/{id}/zip", e.FilesZipEntries)
+		r.Get("/files/{id}/zip/entry", e.FilesZipEntry)
+		r.Post("/files/{id}/pin", e.FilesPin)
+		r.Delete("/files/{id}/pin", e.FilesUnpin)
+		r.Post("/files/reencrypt", e.FilesReencrypt)
+		r.Post("/channels/migrate", e.ChannelsMigrate)
+		r.Get("/cache/stats", e.CacheStats)
+		r.Get("/bots/stats", e.BotsStats)
+		r.Get("/s3/keys", e.S3KeysList)
+		r.Post("/s3/keys", e.S3KeysCreate)
+		r.Delete("/s3/keys/{id}", e.S3KeysDelete)
+		r.Get("/ssh/keys", e.SSHKeysList)
+		r.Post("/ssh/keys", e.SSHKeysCreate)
+		r.Delete("/ssh/keys/{id}", e.SSHKeysDelete)
+		r.Post("/uploads/tus", e.TusCreate)
+		r.Head("/uploads/tus/{id}", e.TusHead)
+		r.Patch("/uploads/tus/{id}", e.TusPatch)
+		r.Delete("/uploads/tus/{id}", e.TusDelete)
+		r.Get("/jobs", e.JobsList)
+		r.Get("/jobs/{id}", e.JobsGet)
+		r.Post("/jobs/{id}/cancel", e.JobsCancel)
+	})
+	r.Get("/shares/{id}/archive", e.SharesArchive)
+	r.Options("/uploads/tus", e.TusOptions)
+	r.Options("/uploads/tus/{id}", e.TusOptions)
+	return r
+}
+
+func (e *extendedService) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			if cookie, err := r.Cookie(authCookieName); err == nil {
+				token = cookie.Value
+			}
+		}
+		if token == "" {
+			writeError(w, r, &apiError{err: errors.New("missing token"), code: http.StatusUnauthorized})
+			return
+		}
+		claims, err := auth.VerifyUser(e.api.db, e.api.cache, e.api.cnf.JWT.Secret, token)
+		if err != nil {
+			writeError(w, r, &apiError{err: errors.New("invalid token"), code: http.StatusUnauthorized})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), claims)))
+	})
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &apiError{err: err, code: http.StatusBadRequest}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		code     = http.StatusInternalServerError
+		message  = http.StatusText(code)
+		apiError *apiError
+	)
+	if errors.As(err, &apiError) {
+		if apiError.code != 0 {
+			code = apiError.code
+			message = apiError.Error()
+		}
+		logging.FromContext(r.Context()).Error("api error", zap.Error(apiError))
+	}
+	writeJSON(w, code, map[string]any{"code": code, "message": message})
+}
@@ -14,9 +14,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/tg"
-	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/tgdrive/teldrive/internal/api"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
@@ -24,8 +22,8 @@ import (
 	"github.com/tgdrive/teldrive/internal/database"
 	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/http_range"
-	"github.com/tgdrive/teldrive/internal/md5"
 	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/search"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/pkg/mapper"
@@ -112,11 +110,9 @@ func (a *apiService) FilesCategoryStats(ctx context.Context) ([]api.CategoryStat
 func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params api.FilesCopyParams) (*api.File, error) {
 	userId := auth.GetUser(ctx)
 
-	client, _ := tgc.AuthClient(ctx, &a.cnf.TG, auth.GetJWTUser(ctx).TgSession, a.middlewares...)
-
 	var res []models.File
 
-	if err := a.db.Model(&models.File{}).Where("id = ?", params.ID).Find(&res).Error; err != nil {
+	if err := a.db.Model(&models.File{}).Where("id = ?", params.ID).Where("user_id = ?", userId).Find(&res).Error; err != nil {
 		return nil, &apiError{err: err}
 	}
 	if len(res) == 0 {
@@ -125,109 +121,45 @@ func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params ap
 
 	file := res[0]
 
-	newIds := []api.Part{}
-
 	channelId, err := getDefaultChannel(a.db, a.cache, userId)
 	if err != nil {
 		return nil, &apiError{err: err}
 	}
 
-	err = tgc.RunWithAuth(ctx, client, "", func(ctx context.Context) error {
+	parentId, err := a.copyDestination(userId, req.Destination)
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
 
-		ids := utils.Map(file.Parts, func(part api.Part) int { return part.ID })
-		messages, err := tgc.GetMessages(ctx, client.API(), ids, *file.ChannelId)
+	if file.Type == "folder" {
+		return a.copyFolder(ctx, &file, req, parentId, channelId)
+	}
 
-		if err != nil {
-			return err
-		}
+	client, _ := tgc.AuthClient(ctx, &a.cnf.TG, auth.GetJWTUser(ctx).TgSession, a.middlewares...)
 
-		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+	var newIds []api.Part
 
+	err = tgc.RunWithAuth(ctx, client, "", func(ctx context.Context) error {
+		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
 		if err != nil {
 			return err
 		}
-		for i, message := range messages {
-			item := message.(*tg.Message)
-			media := item.Media.(*tg.MessageMediaDocument)
-			document := media.Document.(*tg.Document)
-
-			id, _ := randInt64()
-			request := tg.MessagesSendMediaRequest{
-				Silent:   true,
-				Peer:     &tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash},
-				Media:    &tg.InputMediaDocument{ID: document.AsInput()},
-				RandomID: id,
-			}
-			res, err := client.API().MessagesSendMedia(ctx, &request)
-
-			if err != nil {
-				return err
-			}
-
-			updates := res.(*tg.Updates)
-
-			var msg *tg.Message
-
-			for _, update := range updates.Updates {
-				channelMsg, ok := update.(*tg.UpdateNewChannelMessage)
-				if ok {
-					msg = channelMsg.Message.(*tg.Message)
-					break
-				}
-
-			}
-			p := api.Part{ID: msg.ID}
-			if file.Parts[i].Salt.Value != "" {
-				p.Salt = file.Parts[i].Salt
-			}
-			newIds = append(newIds, p)
-
-		}
-		return nil
+		newIds, err = copyParts(ctx, client.API(), &file, channel)
+		return err
 	})
 
 	if err != nil {
 		return nil, &apiError{err: err}
 	}
 
-	if len(newIds) != len(file.Parts) {
-		return nil, &apiError{err: errors.New("failed to copy all file parts")}
-	}
-
-	var parentId string
-	if !isUUID(req.Destination) {
-		var destRes []models.File
-		if err := a.db.Raw("select * from teldrive.create_directories(?, ?)", userId, req.Destination).
-			Scan(&destRes).Error; err != nil {
-			return nil, &apiError{err: err}
-		}
-		parentId = destRes[0].ID
-	} else {
-		parentId = req.Destination
-	}
-
-	dbFile := models.File{}
-
-	dbFile.Name = req.NewName.Or(file.Name)
-	dbFile.Size = file.Size
-	dbFile.Type = string(file.Type)
-	dbFile.MimeType = file.MimeType
-	if len(newIds) > 0 {
-		dbFile.Parts = datatypes.NewJSONSlice(newIds)
-	}
-	dbFile.UserId = userId
-	dbFile.Status = "active"
-	dbFile.ParentId = utils.Ptr(parentId)
-	dbFile.ChannelId = &channelId
-	dbFile.Encrypted = file.Encrypted
-	dbFile.Category = string(file.Category)
+	dbFile := copiedFile(&file, req.NewName.Or(file.Name), parentId, channelId, newIds)
 	if req.UpdatedAt.IsSet() && !req.UpdatedAt.Value.IsZero() {
 		dbFile.UpdatedAt = req.UpdatedAt.Value
 	} else {
 		dbFile.UpdatedAt = time.Now().UTC()
 	}
 
-	if err := a.db.Create(&dbFile).Error; err != nil {
+	if err := a.db.Create(dbFile).Error; err != nil {
 		return nil, &apiError{err: err}
 	}
 
@@ -237,7 +169,52 @@ func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params ap
 		Name:     dbFile.Name,
 		ParentID: parentId,
 	})
-	return mapper.ToFileOut(dbFile), nil
+	return mapper.ToFileOut(*dbFile), nil
+}
+
+// copyOver copies a file in place of the existing one at the destination.
+func (a *apiService) copyOver(ctx context.Context, srcId, parentId, name string, existing *models.File) (string, error) {
+	return a.createOver(ctx, existing, name, func(name string) (string, error) {
+		out, err := a.FilesCopy(ctx, &api.FileCopy{NewName: api.NewOptString(name), Destination: parentId},
+			api.FilesCopyParams{ID: srcId})
+		if err != nil {
+			return "", err
+		}
+		return out.ID.Value, nil
+	})
+}
+
+// createOver runs create for a file taking the place of existing. The file is
+// created under a temporary name and only replaces the existing one once it
+// succeeded, so a failed copy leaves the destination as it was.
+func (a *apiService) createOver(ctx context.Context, existing *models.File, name string,
+	create func(name string) (string, error)) (string, error) {
+	if existing == nil {
+		return create(name)
+	}
+	userId := auth.GetUser(ctx)
+	id, err := create(name + ".copy-" + uuid.NewString())
+	if err != nil {
+		return "", err
+	}
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("call teldrive.delete_files_bulk($1 , $2)", []string{existing.ID}, userId).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.File{}).Where("id = ?", id).Update("name", name).Error
+	})
+	if err != nil {
+		a.db.Exec("call teldrive.delete_files_bulk($1 , $2)", []string{id}, userId)
+		return "", &apiError{err: err}
+	}
+
+	a.events.Record(events.OpDelete, userId, &models.Source{
+		ID:       existing.ID,
+		Type:     existing.Type,
+		Name:     existing.Name,
+		ParentID: *existing.ParentId,
+	})
+	return id, nil
 }
 
 func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.File, error) {
@@ -381,6 +358,15 @@ func (a *apiService) FilesDelete(ctx context.Context, req *api.FileDelete) error
 		return &apiError{err: err}
 	}
 
+	if len(req.Ids) > a.cnf.Jobs.BulkThreshold {
+		job, err := a.jobs.Enqueue(userId, jobDelete, &deleteJob{Ids: req.Ids})
+		if err != nil {
+			return &apiError{err: err}
+		}
+		setQueuedJob(ctx, job)
+		return nil
+	}
+
 	if err := a.db.Exec("call teldrive.delete_files_bulk($1 , $2)", req.Ids, userId).Error; err != nil {
 		return &apiError{err: err}
 	}
@@ -457,7 +443,19 @@ func (a *apiService) FilesGetById(ctx context.Context, params api.FilesGetByIdPa
 func (a *apiService) FilesList(ctx context.Context, params api.FilesListParams) (*api.FileList, error) {
 	userId := auth.GetUser(ctx)
 
-	queryBuilder := &fileQueryBuilder{db: a.db}
+	queryBuilder := &fileQueryBuilder{db: a.db, pgroonga: a.pgroonga, trigram: a.trigram, filters: getFileFilters(ctx)}
+
+	if err := queryBuilder.filters.err; err != nil {
+		return nil, &apiError{err: err, code: http.StatusBadRequest}
+	}
+
+	if queryBuilder.filters.query != "" {
+		q, err := search.Parse(queryBuilder.filters.query)
+		if err != nil {
+			return nil, &apiError{err: err, code: http.StatusBadRequest}
+		}
+		queryBuilder.search = q
+	}
 
 	return queryBuilder.execute(&params, userId)
 }
@@ -482,12 +480,32 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 		req.DestinationParent = r.ID
 	}
 
+	if len(req.Ids) == 0 {
+		return &apiError{err: errors.New("ids should not be empty"), code: 409}
+	}
+
+	if len(req.Ids) > a.cnf.Jobs.BulkThreshold {
+		if err := checkMove(a.db, userId, req.Ids, req.DestinationParent, true); err != nil {
+			return moveError(err)
+		}
+		job, err := a.jobs.Enqueue(userId, jobMove, &moveJob{Ids: req.Ids, DestinationParent: req.DestinationParent})
+		if err != nil {
+			return &apiError{err: err}
+		}
+		setQueuedJob(ctx, job)
+		return nil
+	}
+
 	err := a.db.Transaction(func(tx *gorm.DB) error {
 		var srcFile models.File
 		if err := tx.Where("id = ? AND user_id = ?", req.Ids[0], userId).First(&srcFile).Error; err != nil {
 			return err
 		}
 		if len(req.Ids) == 1 && req.DestinationName.Value != "" {
+			// A file of the new name in the destination is replaced.
+			if err := checkMove(tx, userId, req.Ids, req.DestinationParent, false); err != nil {
+				return err
+			}
 			var existing models.File
 			if err := tx.Where("name = ? AND parent_id = ? AND user_id = ? AND status = 'active'",
 				req.DestinationName.Value, req.DestinationParent, userId).First(&existing).Error; err == nil {
@@ -514,13 +532,7 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 					"name":      req.DestinationName.Value,
 				}).Error
 		}
-		items := pgtype.Array[string]{
-			Elements: req.Ids,
-			Valid:    true,
-			Dims:     []pgtype.ArrayDimension{{Length: int32(len(req.Ids)), LowerBound: 1}},
-		}
-		if err := a.db.Model(&models.File{}).Where("id = any(?)", items).Where("user_id = ?", userId).
-			Update("parent_id", req.DestinationParent).Error; err != nil {
+		if err := moveFiles(tx, userId, req.Ids, req.DestinationParent); err != nil {
 			return err
 		}
 		a.events.Record(events.OpMove, userId, &models.Source{
@@ -534,10 +546,73 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 
 	})
 	if err != nil {
-		return &apiError{err: err}
+		return moveError(err)
+	}
+	return nil
+
+}
+
+var (
+	errMoveDestination = errors.New("destination folder not found")
+	errMoveIntoItself  = errors.New("a folder cannot be moved into itself or its subfolders")
+	errMoveConflict    = errors.New("a file of the same name already exists in the destination")
+)
+
+func moveError(err error) error {
+	switch {
+	case errors.Is(err, errMoveDestination):
+		return &apiError{err: err, code: http.StatusNotFound}
+	case errors.Is(err, errMoveIntoItself), errors.Is(err, errMoveConflict):
+		return &apiError{err: err, code: http.StatusConflict}
+	}
+	return &apiError{err: err}
+}
+
+// checkMove refuses moves the tree cannot take: a destination which is no
+// folder of the user, a folder moved below itself and, with names set, names
+// taken in the destination or by several of the moved files.
+func checkMove(tx *gorm.DB, userId int64, ids []string, destParent string, names bool) error {
+	var count int64
+	if err := tx.Model(&models.File{}).
+		Where("id = ? AND user_id = ? AND type = 'folder' AND status = 'active'", destParent, userId).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return errMoveDestination
+	}
+	if err := tx.Raw(`WITH RECURSIVE ancestors AS (
+		SELECT id, parent_id FROM teldrive.files WHERE id = ?
+		UNION ALL
+		SELECT f.id, f.parent_id FROM teldrive.files f INNER JOIN ancestors a ON f.id = a.parent_id
+	) SELECT count(*) FROM ancestors WHERE id = any(?)`, destParent, stringArray(ids)).Scan(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errMoveIntoItself
+	}
+	if !names {
+		return nil
+	}
+	if err := tx.Raw(`SELECT count(*) FROM (SELECT name FROM teldrive.files
+		WHERE user_id = ? AND status = 'active' AND (id = any(?) OR parent_id = ?)
+		GROUP BY name HAVING count(*) > 1) conflicts`, userId, stringArray(ids), destParent).Scan(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errMoveConflict
 	}
 	return nil
+}
 
+// moveFiles moves files of the user into destParent once checkMove allows it.
+// Bulk moves run it for every batch of their job.
+func moveFiles(tx *gorm.DB, userId int64, ids []string, destParent string) error {
+	if err := checkMove(tx, userId, ids, destParent, true); err != nil {
+		return err
+	}
+	return tx.Model(&models.File{}).Where("id = any(?)", stringArray(ids)).Where("user_id = ?", userId).
+		Update("parent_id", destParent).Error
 }
 
 func (a *apiService) FilesShareByid(ctx context.Context, params api.FilesShareByidParams) (*api.FileShare, error) {
@@ -668,6 +743,7 @@ func (a *apiService) FilesUpdateParts(ctx context.Context, req *api.FilePartsUpd
 		ids := utils.Map(file.Parts, func(part api.Part) int { return part.ID })
 		client, _ := tgc.AuthClient(ctx, &a.cnf.TG, auth.GetJWTUser(ctx).TgSession, a.middlewares...)
 		tgc.DeleteMessages(ctx, client, *file.ChannelId, ids)
+		reader.UnpinParts(*file.ChannelId, ids)
 		keys = append(keys, cache.Key("files", "messages", params.ID))
 		for _, part := range file.Parts {
 			keys = append(keys, cache.Key("files", "location", params.ID, part.ID))
@@ -727,7 +803,14 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 
 	w.Header().Set("Accept-Ranges", "bytes")
 
-	var start, end int64
+	etag := fileETag(file)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	if notModified(r, etag, file.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	rangeHeader := r.Header.Get("Range")
 	contentType := defaultContentType
@@ -736,20 +819,27 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 		contentType = file.MimeType
 	}
 
+	disposition := "inline"
+
+	download := r.URL.Query().Get("download") == "1"
+
+	if download {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}))
+
 	if file.Size == nil || *file.Size == 0 {
 		w.Header().Set("Content-Type", contentType)
 		w.Header().Set("Content-Length", "0")
-		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": file.Name}))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	ranges := []*http_range.Range{{Start: 0, End: *file.Size - 1}}
 	status := http.StatusOK
-	if rangeHeader == "" {
-		start = 0
-		end = *file.Size - 1
-	} else {
-		ranges, err := http_range.Parse(rangeHeader, *file.Size)
+	if rangeHeader != "" && rangeApplies(r, etag, file.UpdatedAt) {
+		parsed, err := http_range.Parse(rangeHeader, *file.Size)
 		if err == http_range.ErrNoOverlap {
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", *file.Size))
 			http.Error(w, http_range.ErrNoOverlap.Error(), http.StatusRequestedRangeNotSatisfiable)
@@ -759,41 +849,37 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if len(ranges) > 1 {
-			http.Error(w, "multiple ranges are not supported", http.StatusRequestedRangeNotSatisfiable)
-			return
+		// More ranges than a client plausibly needs are answered with the whole file.
+		if parsed = coalesceRanges(parsed); len(parsed) <= maxRanges {
+			ranges = parsed
+			status = http.StatusPartialContent
 		}
-		start = ranges[0].Start
-		end = ranges[0].End
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, *file.Size))
-		status = http.StatusPartialContent
-
 	}
 
-	contentLength := end - start + 1
-
-	w.Header().Set("Content-Type", contentType)
-
-	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	w.Header().Set("E-Tag", fmt.Sprintf("\"%s\"", md5.FromString(fileId+strconv.FormatInt(*file.Size, 10))))
-	w.Header().Set("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
-
-	disposition := "inline"
-
-	download := r.URL.Query().Get("download") == "1"
-
-	if download {
-		disposition = "attachment"
+	var multipartRanges *byteRanges
+	if len(ranges) == 1 {
+		if status == http.StatusPartialContent {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ranges[0].Start, ranges[0].End, *file.Size))
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].End-ranges[0].Start+1, 10))
+	} else {
+		multipartRanges = newByteRanges(ranges, contentType, *file.Size)
+		w.Header().Set("Content-Type", multipartRanges.ContentType())
+		w.Header().Set("Content-Length", strconv.FormatInt(multipartRanges.ContentLength(), 10))
 	}
 
-	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}))
-
 	w.WriteHeader(status)
 
 	if r.Method == "HEAD" {
 		return
 	}
 
+	// Players fetch the rest of a file in ranges, only the first read counts as an open.
+	if userId == 0 && ranges[0].Start == 0 && file.UserId == session.UserId {
+		go e.api.recordOpen(session.UserId, file.ID)
+	}
+
 	tokens, err := getBotsToken(e.api.db, e.api.cache, session.UserId, *file.ChannelId)
 
 	if err != nil {
@@ -802,19 +888,15 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 	}
 
 	var (
-		lr           io.ReadCloser
-		client       *telegram.Client
+		client       *tg.Client
+		release      func()
 		multiThreads int
-		token        string
+		streamErr    error
 	)
 
 	multiThreads = e.api.cnf.TG.Stream.MultiThreads
-	middlewares := tgc.NewMiddleware(&e.api.cnf.TG, tgc.WithFloodWait(),
-		tgc.WithRecovery(ctx),
-		tgc.WithRetry(5),
-		tgc.WithRateLimit())
 	if e.api.cnf.TG.DisableStreamBots || len(tokens) == 0 {
-		client, err = tgc.AuthClient(ctx, &e.api.cnf.TG, session.Session, middlewares...)
+		client, release, err = e.api.clients.User(ctx, session.Session)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -824,46 +906,48 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 	} else {
 		e.api.worker.Set(tokens, *file.ChannelId)
 
-		token, _ = e.api.worker.Next(*file.ChannelId)
+		token, _, done := e.api.worker.Acquire(*file.ChannelId)
 
-		client, err = tgc.BotClient(ctx, e.api.tgdb, &e.api.cnf.TG, token, middlewares...)
+		client, release, err = e.api.clients.Bot(ctx, token)
 		if err != nil {
+			done(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer func() { done(streamErr) }()
+		if len(tokens) > 1 {
+			ctx = reader.WithFailover(ctx, e.api.botFailover(ctx, tokens, token))
+		}
 	}
+	defer release()
 	if download {
 		multiThreads = 0
 	}
 
-	if r.Method != "HEAD" {
-		handleStream := func() error {
-			parts, err := getParts(ctx, client, e.api.cache, file)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return nil
-			}
-			lr, err = reader.NewLinearReader(ctx, client.API(), e.api.cache, file, parts, start, end, &e.api.cnf.TG, multiThreads)
+	handleStream := func() error {
+		parts, err := getParts(ctx, client, e.api.cache, file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		copyRange := func(w io.Writer, start, end int64) error {
+			lr, err := reader.NewLinearReader(ctx, client, e.api.cache, file, parts, start, end, &e.api.cnf.TG, multiThreads)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return nil
+				return err
 			}
 			if lr == nil {
-				http.Error(w, "failed to initialise reader", http.StatusInternalServerError)
-				return nil
+				return errors.New("failed to initialise reader")
 			}
-
-			_, err = io.CopyN(w, lr, contentLength)
-			if err != nil {
-				lr.Close()
-			}
-			return nil
+			defer lr.Close()
+			_, err = io.CopyN(w, lr, end-start+1)
+			return err
 		}
-		tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
-			return handleStream()
-		})
-
+		if multipartRanges != nil {
+			return multipartRanges.write(w, copyRange)
+		}
+		return copyRange(w, ranges[0].Start, ranges[0].End)
 	}
+	streamErr = handleStream()
 }
 
 func (e *extendedService) SharesStream(w http.ResponseWriter, r *http.Request, shareId, fileId string) {
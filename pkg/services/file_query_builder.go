@@ -1,23 +1,82 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/WinterYukky/gorm-extra-clause-plugin/exclause"
 	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/search"
 	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/models"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type fileQueryBuilder struct {
-	db *gorm.DB
+	db       *gorm.DB
+	pgroonga bool
+	trigram  bool
+	filters  fileFilters
+	search   *search.Query
+}
+
+type fileFiltersKey struct{}
+
+// fileFilters holds the listing filters which the generated params have no field for.
+type fileFilters struct {
+	tags    []string
+	starred bool
+	recent  bool
+	query   string
+	page    *keysetPage
+	// sorted is set when the listing asks for an order rather than the default.
+	sorted bool
+	// err is an invalid filter, the listing answers it as a bad request.
+	err error
+	// snippets is filled with the snippets of files matching content terms.
+	snippets map[string]string
+}
+
+func newFileFilters(query url.Values) *fileFilters {
+	filters := &fileFilters{
+		starred: query.Get("starred") == "true",
+		recent:  query.Get("recent") == "true",
+		sorted:  query.Has("sort"),
+		query:   query.Get("q"),
+	}
+	if filters.query != "" {
+		filters.snippets = map[string]string{}
+	}
+	if tags := query.Get("tags"); tags != "" {
+		filters.tags, filters.err = normalizeTags(strings.Split(tags, ","))
+	}
+	// An empty cursor asks for the first page of a cursor based listing.
+	if query.Has("cursor") {
+		filters.page = newKeysetPage(query.Get("cursor"))
+	}
+	return filters
+}
+
+func withFileFilters(ctx context.Context, filters *fileFilters) context.Context {
+	return context.WithValue(ctx, fileFiltersKey{}, filters)
+}
+
+func getFileFilters(ctx context.Context) fileFilters {
+	filters, ok := ctx.Value(fileFiltersKey{}).(*fileFilters)
+	if !ok {
+		return fileFilters{}
+	}
+	return *filters
 }
 
 type fileResponse struct {
@@ -29,13 +88,43 @@ var selectedFields = []string{"id", "name", "type", "mime_type", "category", "ch
 
 func (afb *fileQueryBuilder) execute(filesQuery *api.FilesListParams, userId int64) (*api.FileList, error) {
 	query := afb.db.Where("user_id = ?", userId).Where("status = ?", filesQuery.Status.Value)
-	if filesQuery.Operation.Value == api.FileQueryOperationList {
+	if afb.search != nil {
+		query = afb.applySearchTerms(query, userId)
+	} else if filesQuery.Operation.Value == api.FileQueryOperationList {
 		query = afb.applyListFilters(query, filesQuery, userId)
 	} else if filesQuery.Operation.Value == api.FileQueryOperationFind {
 		query = afb.applyFindFilters(query, filesQuery, userId)
 
 	}
+	if afb.filters.recent && afb.search == nil && filesQuery.Operation.Value == api.FileQueryOperationFind {
+		return afb.executeRecent(query, filesQuery, userId)
+	}
+	if afb.filters.page != nil {
+		return afb.executeKeyset(query, filesQuery, userId)
+	}
 	query = afb.buildFileQuery(query, filesQuery, userId)
+	return afb.scanFiles(query, filesQuery)
+}
+
+// executeRecent lists recently opened files, last opened first unless another
+// order is asked for. There are at most maxRecentFiles of them, so plain
+// offsets are fine.
+func (afb *fileQueryBuilder) executeRecent(query *gorm.DB, filesQuery *api.FilesListParams, userId int64) (*api.FileList, error) {
+	if afb.filters.page != nil {
+		return nil, &apiError{err: errors.New("cursors are not supported for recent files"), code: http.StatusBadRequest}
+	}
+	order := clause.Expr{SQL: `(SELECT opened_at FROM teldrive.file_opens o
+		WHERE o.file_id = files.id AND o.user_id = ?) DESC, id`, Vars: []any{userId}}
+	if afb.filters.sorted {
+		order = clause.Expr{SQL: getOrder(filesQuery) + ", id"}
+	}
+	query = afb.buildSubqueryCTE(query, filesQuery, userId).Model(&models.File{}).
+		Select(selectedFields, "count(*) OVER () as total").Where(query).Order(order).
+		Offset(max(filesQuery.Page.Value-1, 0) * filesQuery.Limit.Value).Limit(filesQuery.Limit.Value)
+	return afb.scanFiles(query, filesQuery)
+}
+
+func (afb *fileQueryBuilder) scanFiles(query *gorm.DB, filesQuery *api.FilesListParams) (*api.FileList, error) {
 	res := []fileResponse{}
 	if err := query.Scan(&res).Error; err != nil {
 		if strings.Contains(err.Error(), "file not found") {
@@ -49,6 +138,10 @@ func (afb *fileQueryBuilder) execute(filesQuery *api.FilesListParams, userId int
 		count = res[0].Total
 	}
 
+	if err := afb.contentSnippets(utils.Map(res, func(item fileResponse) string { return item.ID })); err != nil {
+		return nil, &apiError{err: err}
+	}
+
 	files := utils.Map(res, func(item fileResponse) api.File { return *mapper.ToFileOut(item.File) })
 
 	return &api.FileList{Items: files,
@@ -113,6 +206,20 @@ func (afb *fileQueryBuilder) applyFileSpecificFilters(query *gorm.DB, filesQuery
 		query = query.Where("id in (SELECT file_id FROM teldrive.file_shares where user_id = ?)", userId)
 	}
 
+	if len(afb.filters.tags) > 0 {
+		query = query.Where(`id in (SELECT ft.file_id FROM teldrive.file_tags ft JOIN teldrive.tags t ON t.id = ft.tag_id
+		WHERE t.user_id = ? AND t.name = any(?) GROUP BY ft.file_id HAVING count(*) = ?)`,
+			userId, stringArray(afb.filters.tags), len(afb.filters.tags))
+	}
+
+	if afb.filters.starred {
+		query = query.Where("id in (SELECT file_id FROM teldrive.file_stars where user_id = ?)", userId)
+	}
+
+	if afb.filters.recent {
+		query = query.Where("id in (SELECT file_id FROM teldrive.file_opens where user_id = ?)", userId)
+	}
+
 	return query
 }
 
@@ -153,13 +260,44 @@ func (afb *fileQueryBuilder) applySingleDateFilter(query *gorm.DB, dateFilter st
 
 func (afb *fileQueryBuilder) applySearchQuery(query *gorm.DB, filesQuery *api.FilesListParams) *gorm.DB {
 	if filesQuery.SearchType.Value == api.FileQuerySearchTypeText {
-		query = query.Where("name &@~ lower(regexp_replace(?, '[^[:alnum:]\\s]', ' ', 'g'))", filesQuery.Query.Value)
+		clause, args := afb.textSearch(filesQuery.Query.Value)
+		query = query.Where(clause, args...)
 	} else if filesQuery.SearchType.Value == api.FileQuerySearchTypeRegex {
-		query = query.Where("name &~ ?", filesQuery.Query.Value)
+		query = query.Where(afb.regexSearch(), filesQuery.Query.Value)
 	}
 	return query
 }
 
+// textSearch matches names containing every word of the query. Without
+// pgroonga the words are matched with ILIKE, and pg_trgm word similarity
+// catches the near misses the ngram tokenizer would have found.
+func (afb *fileQueryBuilder) textSearch(value string) (string, []any) {
+	if afb.pgroonga {
+		return "name &@~ lower(regexp_replace(?, '[^[:alnum:]\\s]', ' ', 'g'))", []any{value}
+	}
+	words := strings.Fields(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, value))
+	if len(words) == 0 {
+		return "false", nil
+	}
+	patterns := utils.Map(words, func(word string) string { return "%" + word + "%" })
+	if !afb.trigram {
+		return "name ILIKE ALL (?)", []any{stringArray(patterns)}
+	}
+	return "(name ILIKE ALL (?) OR ? <% name)", []any{stringArray(patterns), strings.Join(words, " ")}
+}
+
+func (afb *fileQueryBuilder) regexSearch() string {
+	if afb.pgroonga {
+		return "name &~ ?"
+	}
+	return "name ~* ?"
+}
+
 func (afb *fileQueryBuilder) applyCategoryFilter(query *gorm.DB, categories []api.Category) *gorm.DB {
 	if len(categories) == 0 {
 		return query
@@ -228,3 +366,60 @@ func getOrderOperation(filesQuery *api.FilesListParams) string {
 		}
 	}
 }
+
+// applySearchTerms turns a structured query into the same where clauses the
+// separate list parameters produce, each term is ANDed with the others.
+func (afb *fileQueryBuilder) applySearchTerms(query *gorm.DB, userId int64) *gorm.DB {
+	for _, term := range afb.search.Terms {
+		clause, args := afb.searchTermClause(&term, userId)
+		if term.Negated {
+			clause = fmt.Sprintf("NOT coalesce((%s), false)", clause)
+		}
+		query = query.Where(clause, args...)
+	}
+	return query
+}
+
+func (afb *fileQueryBuilder) searchTermClause(term *search.Term, userId int64) (string, []any) {
+	switch term.Field {
+	case search.FieldName:
+		return "name ILIKE ?", []any{"%" + escapeLike(term.Value) + "%"}
+	case search.FieldExt:
+		return "name ILIKE ?", []any{"%." + escapeLike(term.Value)}
+	case search.FieldType:
+		return "type = ?", []any{term.Value}
+	case search.FieldCategory:
+		return "category = ?", []any{term.Value}
+	case search.FieldSize:
+		return fmt.Sprintf("size %s ?", term.Op), []any{term.Size}
+	case search.FieldUpdated:
+		if term.Day {
+			return "updated_at >= ? AND updated_at < ?", []any{term.Time, term.Time.AddDate(0, 0, 1)}
+		}
+		return fmt.Sprintf("updated_at %s ?", term.Op), []any{term.Time}
+	case search.FieldIn:
+		return `parent_id in (WITH RECURSIVE subdirs AS (SELECT id FROM teldrive.get_file_from_path(?, ?, ?)
+		UNION ALL SELECT f.id FROM teldrive.files f INNER JOIN subdirs ON f.parent_id = subdirs.id) SELECT id FROM subdirs)`,
+			[]any{term.Value, userId, true}
+	case search.FieldTag:
+		return `id in (SELECT ft.file_id FROM teldrive.file_tags ft JOIN teldrive.tags t ON t.id = ft.tag_id
+		WHERE t.user_id = ? AND t.name = ?)`, []any{userId, strings.ToLower(term.Value)}
+	case search.FieldContent:
+		return `id in (SELECT file_id FROM teldrive.file_contents
+		WHERE user_id = ? AND tsv @@ websearch_to_tsquery('simple', ?))`, []any{userId, term.Value}
+	case search.FieldIs:
+		switch term.Value {
+		case "starred":
+			return "id in (SELECT file_id FROM teldrive.file_stars where user_id = ?)", []any{userId}
+		case "shared":
+			return "id in (SELECT file_id FROM teldrive.file_shares where user_id = ?)", []any{userId}
+		default:
+			return "id in (SELECT file_id FROM teldrive.file_opens where user_id = ?)", []any{userId}
+		}
+	}
+	return afb.textSearch(term.Value)
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
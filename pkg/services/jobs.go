@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/pkg/jobs"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+const (
+	jobCopy   = "copy"
+	jobMove   = "move"
+	jobDelete = "delete"
+
+	jobBatchSize = 500
+)
+
+type moveJob struct {
+	Ids               []string `json:"ids"`
+	DestinationParent string   `json:"destinationParent"`
+}
+
+type deleteJob struct {
+	Ids []string `json:"ids"`
+}
+
+type batchState struct {
+	Offset int `json:"offset"`
+}
+
+type queuedJobKey struct{}
+
+// queuedJob carries the job a bulk request was queued as to the middleware,
+// the generated handlers can only answer with no content.
+type queuedJob struct {
+	job *models.Job
+}
+
+func withQueuedJob(ctx context.Context) (context.Context, *queuedJob) {
+	q := &queuedJob{}
+	return context.WithValue(ctx, queuedJobKey{}, q), q
+}
+
+func setQueuedJob(ctx context.Context, job *models.Job) {
+	if q, ok := ctx.Value(queuedJobKey{}).(*queuedJob); ok {
+		q.job = job
+	}
+}
+
+// jobWriter answers 202 with the queued job instead of 204, so clients can
+// follow and cancel it through /jobs/{id}.
+type jobWriter struct {
+	http.ResponseWriter
+	queued *queuedJob
+}
+
+func (w *jobWriter) WriteHeader(code int) {
+	if code != http.StatusNoContent || w.queued.job == nil {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Location", "/api/jobs/"+w.queued.job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w.ResponseWriter).Encode(jobs.ToInfo(w.queued.job))
+}
+
+func (w *jobWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (a *apiService) registerJobs() {
+	a.jobs.Register(jobCopy, a.runCopyJob)
+	a.jobs.Register(jobMove, a.runMoveJob)
+	a.jobs.Register(jobDelete, a.runDeleteJob)
+	a.jobs.Register(jobPin, a.runPinJob)
+	a.jobs.Register(jobReencrypt, a.runReencryptJob)
+	a.jobs.Register(jobMigrate, a.runMigrateJob)
+}
+
+// userSession returns the latest session of the user for jobs running outside a request.
+func (a *apiService) userSession(userId int64) (string, error) {
+	var session models.Session
+	if err := a.db.Where("user_id = ?", userId).Order("created_at desc").First(&session).Error; err != nil {
+		return "", err
+	}
+	return session.Session, nil
+}
+
+// runBatches calls fn for every batch of ids after the last checkpoint.
+func runBatches(ctx context.Context, job *jobs.Job, ids []string, fn func(batch []string) error) error {
+	var state batchState
+	if _, err := job.Restore(&state); err != nil {
+		return err
+	}
+	job.SetTotal(int64(len(ids)))
+	job.SetProgress(int64(state.Offset), 0)
+	for state.Offset < len(ids) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := min(state.Offset+jobBatchSize, len(ids))
+		if err := fn(ids[state.Offset:end]); err != nil {
+			return err
+		}
+		job.Add(int64(end-state.Offset), 0)
+		state.Offset = end
+		if err := job.Checkpoint(&state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *apiService) runMoveJob(ctx context.Context, job *jobs.Job) error {
+	var payload moveJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	err := runBatches(ctx, job, payload.Ids, func(batch []string) error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			return moveFiles(tx, job.UserId(), batch, payload.DestinationParent)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	a.events.Record(events.OpMove, job.UserId(), &models.Source{
+		ID:           payload.DestinationParent,
+		Type:         "folder",
+		DestParentID: payload.DestinationParent,
+	})
+	return nil
+}
+
+func (a *apiService) runDeleteJob(ctx context.Context, job *jobs.Job) error {
+	var payload deleteJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	var fileDB models.File
+	if err := a.db.Where("id = ? AND user_id = ?", payload.Ids[0], job.UserId()).First(&fileDB).Error; err != nil {
+		return err
+	}
+	err := runBatches(ctx, job, payload.Ids, func(batch []string) error {
+		return a.db.Exec("call teldrive.delete_files_bulk($1 , $2)", batch, job.UserId()).Error
+	})
+	if err != nil {
+		return err
+	}
+	a.events.Record(events.OpDelete, job.UserId(), &models.Source{
+		ID:       fileDB.ID,
+		Type:     fileDB.Type,
+		Name:     fileDB.Name,
+		ParentID: *fileDB.ParentId,
+	})
+	return nil
+}
+
+func jobError(err error) error {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		return &apiError{err: err, code: http.StatusNotFound}
+	case errors.Is(err, jobs.ErrFinished):
+		return &apiError{err: err, code: http.StatusConflict}
+	}
+	return &apiError{err: err}
+}
+
+func (e *extendedService) JobsList(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, &apiError{err: errors.New("invalid limit"), code: http.StatusBadRequest})
+			return
+		}
+		limit = min(n, 1000)
+	}
+	res, err := e.api.jobs.List(auth.GetUser(r.Context()), r.URL.Query().Get("status"), limit)
+	if err != nil {
+		writeError(w, r, jobError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs.ToInfos(res))
+}
+
+func (e *extendedService) JobsGet(w http.ResponseWriter, r *http.Request) {
+	job, err := e.api.jobs.Get(auth.GetUser(r.Context()), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, r, jobError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs.ToInfo(job))
+}
+
+func (e *extendedService) JobsCancel(w http.ResponseWriter, r *http.Request) {
+	job, err := e.api.jobs.Cancel(auth.GetUser(r.Context()), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, r, jobError(err))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobs.ToInfo(job))
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/jobs"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+const jobPin = "pin"
+
+type pinJob struct {
+	FileId string `json:"fileId"`
+}
+
+var errChunkCacheDisabled = &apiError{err: errors.New("disk chunk cache is disabled"), code: http.StatusConflict}
+
+func (a *apiService) pinnableFile(userId int64, fileId string) (*models.File, error) {
+	if !isUUID(fileId) {
+		return nil, &apiError{err: errors.New("invalid file id"), code: http.StatusBadRequest}
+	}
+	var file models.File
+	if err := a.db.Where("id = ? AND user_id = ? AND type = 'file' AND status = 'active'", fileId, userId).
+		First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &apiError{err: errors.New("file not found"), code: http.StatusNotFound}
+		}
+		return nil, &apiError{err: err}
+	}
+	if file.ChannelId == nil || len(file.Parts) == 0 {
+		return nil, &apiError{err: errors.New("file has no data"), code: http.StatusBadRequest}
+	}
+	return &file, nil
+}
+
+func pinPrefixes(file *models.File) []string {
+	return utils.Map(file.Parts, func(part api.Part) string {
+		return reader.ChunkCachePrefix(*file.ChannelId, int64(part.ID))
+	})
+}
+
+// runPinJob reads the whole file once so every chunk lands in the disk cache.
+func (a *apiService) runPinJob(ctx context.Context, job *jobs.Job) error {
+	var payload pinJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	file, err := a.pinnableFile(job.UserId(), payload.FileId)
+	if err != nil {
+		return err
+	}
+	if file.Size == nil || *file.Size == 0 {
+		return nil
+	}
+	job.SetTotal(*file.Size)
+	client, release, err := a.channelClient(ctx, file.UserId, *file.ChannelId, "")
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		parts, err := getParts(ctx, client, a.cache, file)
+		if err != nil {
+			return err
+		}
+		lr, err := reader.NewLinearReader(ctx, client, a.cache, file, parts, 0, *file.Size-1, &a.cnf.TG, 0)
+		if err != nil {
+			return err
+		}
+		defer lr.Close()
+		n, err := io.Copy(io.Discard, lr)
+		job.SetProgress(n, 0)
+		return err
+	}()
+	release(err)
+	return err
+}
+
+func (e *extendedService) FilesPin(w http.ResponseWriter, r *http.Request) {
+	if reader.ChunkCache() == nil {
+		writeError(w, r, errChunkCacheDisabled)
+		return
+	}
+	userId := auth.GetUser(r.Context())
+	file, err := e.api.pinnableFile(userId, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := reader.ChunkCache().Pin(pinPrefixes(file)...); err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	job, err := e.api.jobs.Enqueue(userId, jobPin, &pinJob{FileId: file.ID})
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobs.ToInfo(job))
+}
+
+func (e *extendedService) FilesUnpin(w http.ResponseWriter, r *http.Request) {
+	if reader.ChunkCache() == nil {
+		writeError(w, r, errChunkCacheDisabled)
+		return
+	}
+	file, err := e.api.pinnableFile(auth.GetUser(r.Context()), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := reader.ChunkCache().Unpin(pinPrefixes(file)...); err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *extendedService) CacheStats(w http.ResponseWriter, r *http.Request) {
+	if reader.ChunkCache() == nil {
+		writeError(w, r, errChunkCacheDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, reader.ChunkCache().Stats())
+}
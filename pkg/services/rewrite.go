@@ -0,0 +1,298 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/jobs"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	jobReencrypt = "reencrypt"
+	jobMigrate   = "migrate"
+)
+
+type reencryptJob struct {
+	Ids []string `json:"ids"`
+}
+
+type migrateJob struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type migrateState struct {
+	After string `json:"after"`
+}
+
+// userContext authenticates ctx as the user for jobs uploading through the
+// same paths as requests.
+func (a *apiService) userContext(ctx context.Context, userId int64) (context.Context, error) {
+	session, err := a.userSession(userId)
+	if err != nil {
+		return nil, err
+	}
+	return auth.WithUser(ctx, &types.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.FormatInt(userId, 10)},
+		TgSession:        session,
+	}), nil
+}
+
+// replaceParts points the file at new parts in place, so its id and everything
+// hanging off it stays. The old parts move to a row pending deletion and are
+// deleted by the cleanup job.
+func (a *apiService) replaceParts(file *models.File, parts []api.Part, channelId int64, encrypted bool) error {
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		old := models.File{
+			Name:      file.Name,
+			Type:      file.Type,
+			Size:      file.Size,
+			Encrypted: file.Encrypted,
+			UserId:    file.UserId,
+			Status:    "pending_deletion",
+			ParentId:  file.ParentId,
+			Parts:     file.Parts,
+			ChannelId: file.ChannelId,
+		}
+		if err := tx.Create(&old).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.File{}).Where("id = ?", file.ID).Updates(map[string]any{
+			"parts":      datatypes.NewJSONSlice(parts),
+			"channel_id": channelId,
+			"encrypted":  encrypted,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	keys := []string{cache.Key("files", file.ID), cache.Key("files", "messages", file.ID)}
+	for _, part := range file.Parts {
+		keys = append(keys, cache.Key("files", "location", file.ID, part.ID))
+	}
+	a.cache.Delete(keys...)
+	return nil
+}
+
+// runReencryptJob uploads the unencrypted files below the selection again
+// encrypted. Files are picked up by their flag, so a resumed job skips the
+// ones done before.
+func (a *apiService) runReencryptJob(ctx context.Context, job *jobs.Job) error {
+	var payload reencryptJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	if a.cnf.TG.Uploads.EncryptionKey == "" {
+		return errors.New("encryption is not enabled")
+	}
+	entries, err := a.archiveEntries(job.UserId(), payload.Ids)
+	if err != nil {
+		return err
+	}
+	entries = slices.DeleteFunc(entries, func(entry archiveEntry) bool {
+		return entry.Type != "file" || entry.Encrypted || entry.Size == nil || *entry.Size == 0 ||
+			entry.ChannelId == nil || len(entry.Parts) == 0
+	})
+	job.SetTotal(int64(len(entries)))
+
+	userCtx, err := a.userContext(ctx, job.UserId())
+	if err != nil {
+		return err
+	}
+	logger := logging.FromContext(ctx)
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.reencryptFile(userCtx, &entry.File); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Error("reencrypt failed", zap.String("file", entry.ID), zap.Error(err))
+			job.Add(0, 1)
+			continue
+		}
+		job.Add(1, 0)
+	}
+	if failed := job.Failed(); failed > 0 {
+		return fmt.Errorf("failed to reencrypt %d of %d files", failed, len(entries))
+	}
+	return nil
+}
+
+func (a *apiService) reencryptFile(ctx context.Context, file *models.File) error {
+	client, release, err := a.channelClient(ctx, file.UserId, *file.ChannelId, auth.GetJWTUser(ctx).TgSession)
+	if err != nil {
+		return err
+	}
+	var parts []api.Part
+	err = func() error {
+		stored, err := getParts(ctx, client, a.cache, file)
+		if err != nil {
+			return err
+		}
+		lr, err := reader.NewLinearReader(ctx, client, a.cache, file, stored, 0, *file.Size-1, &a.cnf.TG, 0)
+		if err != nil {
+			return err
+		}
+		defer lr.Close()
+		in := &fileUpload{Name: file.Name, Size: *file.Size, Encrypted: true, ChannelId: *file.ChannelId}
+		parts, _, _, err = a.uploadParts(ctx, in, file.ID, lr)
+		return err
+	}()
+	release(err)
+	if err != nil {
+		return err
+	}
+	if err := a.replaceParts(file, parts, *file.ChannelId, true); err != nil {
+		return err
+	}
+	return a.db.Where("upload_id = ?", file.ID).Delete(&models.Upload{}).Error
+}
+
+// runMigrateJob moves the files of one channel to another. The documents are
+// sent to the new channel again rather than uploaded, and files are walked by
+// id so a resumed job continues after the last one moved.
+func (a *apiService) runMigrateJob(ctx context.Context, job *jobs.Job) error {
+	var payload migrateJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	state := migrateState{After: "00000000-0000-0000-0000-000000000000"}
+	if _, err := job.Restore(&state); err != nil {
+		return err
+	}
+	query := a.db.Model(&models.File{}).
+		Where("user_id = ? AND channel_id = ? AND type = 'file' AND status = 'active'", job.UserId(), payload.From)
+	var left int64
+	if err := query.Session(&gorm.Session{}).Where("id > ?", state.After).Count(&left).Error; err != nil {
+		return err
+	}
+	job.SetTotal(left + job.Done() + job.Failed())
+
+	session, err := a.userSession(job.UserId())
+	if err != nil {
+		return err
+	}
+	client, release, err := a.clients.User(ctx, session)
+	if err != nil {
+		return err
+	}
+	defer release()
+	channel, err := tgc.GetChannelById(ctx, client, payload.To)
+	if err != nil {
+		return err
+	}
+
+	logger := logging.FromContext(ctx)
+	for {
+		var files []models.File
+		if err := query.Session(&gorm.Session{}).Where("id > ?", state.After).Order("id").Limit(jobBatchSize).
+			Find(&files).Error; err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := func() error {
+				if len(file.Parts) == 0 {
+					return a.db.Model(&models.File{}).Where("id = ?", file.ID).Update("channel_id", payload.To).Error
+				}
+				parts, err := copyParts(ctx, client, &file, channel)
+				if err != nil {
+					return err
+				}
+				return a.replaceParts(&file, parts, payload.To, file.Encrypted)
+			}()
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logger.Error("migrate failed", zap.String("file", file.ID), zap.Error(err))
+				job.Add(0, 1)
+			} else {
+				job.Add(1, 0)
+			}
+			state.After = file.ID
+			if err := job.Checkpoint(&state); err != nil {
+				return err
+			}
+		}
+	}
+	if failed := job.Failed(); failed > 0 {
+		return fmt.Errorf("failed to migrate %d files", failed)
+	}
+	return nil
+}
+
+func (e *extendedService) FilesReencrypt(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	var req reencryptJob
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Ids) == 0 || slices.ContainsFunc(req.Ids, func(id string) bool { return !isUUID(id) }) {
+		writeError(w, r, &apiError{err: errors.New("invalid file ids"), code: http.StatusBadRequest})
+		return
+	}
+	if e.api.cnf.TG.Uploads.EncryptionKey == "" {
+		writeError(w, r, &apiError{err: errors.New("encryption is not enabled"), code: http.StatusBadRequest})
+		return
+	}
+	job, err := e.api.jobs.Enqueue(userId, jobReencrypt, &req)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobs.ToInfo(job))
+}
+
+func (e *extendedService) ChannelsMigrate(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	var req migrateJob
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if req.From == 0 || req.To == 0 || req.From == req.To {
+		writeError(w, r, &apiError{err: errors.New("invalid channels"), code: http.StatusBadRequest})
+		return
+	}
+	var count int64
+	if err := e.api.db.Model(&models.Channel{}).Where("user_id = ? AND channel_id IN ?", userId,
+		[]int64{req.From, req.To}).Count(&count).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	if count != 2 {
+		writeError(w, r, &apiError{err: errors.New("channel not found"), code: http.StatusNotFound})
+		return
+	}
+	job, err := e.api.jobs.Enqueue(userId, jobMigrate, &req)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobs.ToInfo(job))
+}
@@ -0,0 +1,1027 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/http_range"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/sigv4"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	s3Namespace   = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys     = 1000
+	s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+	s3MaxPartNo   = 10000
+	s3StorageStd  = "STANDARD"
+	s3EmptyETag   = `"d41d8cd98f00b204e9800998ecf8427e"`
+	s3KeyCacheTTL = 5 * time.Minute
+)
+
+type s3Error struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Message
+}
+
+var (
+	errS3AccessDenied       = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey   = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist"}
+	errS3SignatureMismatch  = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+	errS3Expired            = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errS3Skewed             = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errS3Malformed          = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errS3BadDigest          = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match the payload"}
+	errS3NoSuchBucket       = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey          = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errS3NoSuchUpload       = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errS3BucketExists       = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists"}
+	errS3BucketNotEmpty     = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket is not empty"}
+	errS3InvalidBucket      = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	errS3InvalidKey         = &s3Error{http.StatusBadRequest, "InvalidArgument", "The specified key is not valid"}
+	errS3InvalidRange       = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+	errS3InvalidPart        = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errS3InvalidPartOrder   = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errS3MalformedXML       = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	errS3MissingLength      = &s3Error{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header"}
+	errS3PreconditionFailed = &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	errS3NotImplemented     = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or operation you provided is not implemented"}
+)
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+// s3Server serves a subset of the S3 API. Buckets are the top level folders
+// of the user and keys are paths below them, requests must use path style
+// addressing.
+type s3Server struct {
+	api *apiService
+}
+
+func NewS3Handler(api *apiService) http.Handler {
+	return &s3Server{api: api}
+}
+
+// s3Request carries what the handlers need from the signed request.
+type s3Request struct {
+	bucket string
+	key    string
+	body   io.Reader
+	size   int64
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, sig, key, err := s.authenticate(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	r = r.WithContext(ctx)
+
+	req := &s3Request{body: r.Body, size: r.ContentLength}
+	if sigv4.Streaming(sig.PayloadHash) {
+		req.body = sigv4.NewChunkedReader(r.Body, sig, key.SecretKey)
+		req.size = -1
+		if size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			req.size = size
+		}
+	} else {
+		req.body = sigv4.NewHashReader(r.Body, sig.PayloadHash, r.ContentLength)
+	}
+	req.bucket, req.key, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	q := r.URL.Query()
+	switch {
+	case req.bucket == "" && r.Method == http.MethodGet:
+		err = s.listBuckets(w, r)
+	case req.bucket == "":
+		err = errS3NotImplemented
+	case req.key == "":
+		switch {
+		case r.Method == http.MethodGet && q.Has("location"):
+			err = s.bucketLocation(w, r, req)
+		case r.Method == http.MethodGet && q.Has("versioning"):
+			err = s.bucketVersioning(w, r, req)
+		case r.Method == http.MethodGet && !q.Has("uploads"):
+			err = s.listObjects(w, r, req)
+		case r.Method == http.MethodHead:
+			_, err = s.bucket(ctx, req.bucket)
+		case r.Method == http.MethodPut:
+			err = s.createBucket(w, r, req)
+		case r.Method == http.MethodDelete:
+			err = s.deleteBucket(w, r, req)
+		case r.Method == http.MethodPost && q.Has("delete"):
+			err = s.deleteObjects(w, r, req)
+		default:
+			err = errS3NotImplemented
+		}
+	default:
+		switch {
+		case r.Method == http.MethodGet && q.Has("uploadId"):
+			err = s.listParts(w, r, req)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			err = s.getObject(w, r, req)
+		case r.Method == http.MethodPut && q.Has("uploadId"):
+			err = s.uploadPart(w, r, req)
+		case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+			err = s.copyObject(w, r, req)
+		case r.Method == http.MethodPut:
+			err = s.putObject(w, r, req)
+		case r.Method == http.MethodDelete && q.Has("uploadId"):
+			err = s.abortMultipartUpload(w, r, req)
+		case r.Method == http.MethodDelete:
+			err = s.deleteObject(w, r, req)
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			err = s.createMultipartUpload(w, r, req)
+		case r.Method == http.MethodPost && q.Has("uploadId"):
+			err = s.completeMultipartUpload(w, r, req)
+		default:
+			err = errS3NotImplemented
+		}
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+	}
+}
+
+// authenticate verifies the signature with the secret of the access key and
+// returns a context carrying the owner of the key like a logged in request.
+func (s *s3Server) authenticate(r *http.Request) (context.Context, *sigv4.Signature, *models.S3Key, error) {
+	sig, err := sigv4.Parse(r)
+	switch {
+	case errors.Is(err, sigv4.ErrMissing):
+		return nil, nil, nil, errS3AccessDenied
+	case err != nil:
+		return nil, nil, nil, errS3Malformed
+	}
+	key, err := cache.Fetch(s.api.cache, cache.Key("s3keys", sig.AccessKey), s3KeyCacheTTL, func() (*models.S3Key, error) {
+		var key models.S3Key
+		if err := s.api.db.Where("access_key = ?", sig.AccessKey).First(&key).Error; err != nil {
+			return nil, err
+		}
+		return &key, nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil, errS3InvalidAccessKey
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch err := sig.Verify(r, key.SecretKey, time.Now().UTC()); {
+	case errors.Is(err, sigv4.ErrExpired):
+		return nil, nil, nil, errS3Expired
+	case errors.Is(err, sigv4.ErrSkewed):
+		return nil, nil, nil, errS3Skewed
+	case errors.Is(err, sigv4.ErrSignatureMismatch):
+		return nil, nil, nil, errS3SignatureMismatch
+	case err != nil:
+		return nil, nil, nil, errS3Malformed
+	}
+	// Uploads and deletes without bots go through the telegram session of the user.
+	session, _ := s.api.userSession(key.UserId)
+	claims := &types.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.FormatInt(key.UserId, 10)},
+		TgSession:        session,
+	}
+	return auth.WithUser(r.Context(), claims), sig, key, nil
+}
+
+func (s *s3Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.Is(err, sigv4.ErrContentSHA256Mismatch):
+		s3Err = errS3BadDigest
+	case errors.Is(err, sigv4.ErrChunkSignatureMismatch):
+		s3Err = errS3SignatureMismatch
+	case errors.Is(err, sigv4.ErrMalformedChunk):
+		s3Err = &s3Error{http.StatusBadRequest, "IncompleteBody", err.Error()}
+	default:
+		logging.FromContext(r.Context()).Error("s3 error", zap.String("method", r.Method),
+			zap.String("path", r.URL.Path), zap.Error(err))
+		s3Err = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again"}
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.status)
+		return
+	}
+	writeXML(w, s3Err.status, &s3ErrorResponse{Code: s3Err.Code, Message: s3Err.Message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func decodeXML(r io.Reader, v any) error {
+	if err := xml.NewDecoder(io.LimitReader(r, 1<<20)).Decode(v); err != nil {
+		if errors.Is(err, sigv4.ErrContentSHA256Mismatch) || errors.Is(err, sigv4.ErrChunkSignatureMismatch) {
+			return err
+		}
+		return errS3MalformedXML
+	}
+	return nil
+}
+
+// s3ETag is derived from the stored file like the REST API etag. It carries
+// the part count like the etag of a multipart upload, so clients do not
+// mistake it for the MD5 of the content.
+func s3ETag(file *models.File) string {
+	return strings.TrimSuffix(fileETag(file), `"`) + "-" + strconv.Itoa(max(len(file.Parts), 1)) + `"`
+}
+
+func fileSize(file *models.File) int64 {
+	if file.Size == nil {
+		return 0
+	}
+	return *file.Size
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
+
+// objectPath maps a key to the path of the file, keys which would leave the
+// bucket are rejected.
+func objectPath(bucket, key string) (string, error) {
+	p := path.Clean("/" + bucket + "/" + key)
+	if !strings.HasPrefix(p, "/"+bucket+"/") {
+		return "", errS3InvalidKey
+	}
+	return p, nil
+}
+
+func (s *s3Server) lookup(ctx context.Context, p string) (*models.File, error) {
+	file, err := s.api.getFileFromPath(p, auth.GetUser(ctx))
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	}
+	return file, err
+}
+
+func (s *s3Server) bucket(ctx context.Context, name string) (*models.File, error) {
+	if name == "" || name == "." || name == ".." {
+		return nil, errS3InvalidBucket
+	}
+	file, err := s.lookup(ctx, "/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil || file.Type != "folder" {
+		return nil, errS3NoSuchBucket
+	}
+	return file, nil
+}
+
+func (s *s3Server) object(ctx context.Context, req *s3Request) (*models.File, error) {
+	if _, err := s.bucket(ctx, req.bucket); err != nil {
+		return nil, err
+	}
+	p, err := objectPath(req.bucket, req.key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.lookup(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil || file.Type != "file" {
+		return nil, errS3NoSuchKey
+	}
+	return file, nil
+}
+
+// parentFolder returns the folder an object is stored in, creating the
+// folders of the key on the way.
+func (s *s3Server) parentFolder(ctx context.Context, req *s3Request) (string, string, error) {
+	if _, err := s.bucket(ctx, req.bucket); err != nil {
+		return "", "", err
+	}
+	p, err := objectPath(req.bucket, req.key)
+	if err != nil {
+		return "", "", err
+	}
+	parentId, err := s.api.copyDestination(auth.GetUser(ctx), path.Dir(p))
+	if err != nil {
+		return "", "", err
+	}
+	return parentId, path.Base(p), nil
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func (s *s3Server) owner(ctx context.Context) s3Owner {
+	userId := strconv.FormatInt(auth.GetUser(ctx), 10)
+	return s3Owner{ID: userId, DisplayName: userId}
+}
+
+func (s *s3Server) listBuckets(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	root, err := s.lookup(ctx, "/")
+	if err != nil {
+		return err
+	}
+	out := s3ListBucketsResult{Xmlns: s3Namespace, Owner: s.owner(ctx), Buckets: []s3Bucket{}}
+	if root != nil {
+		var folders []models.File
+		if err := s.api.db.Where("parent_id = ? AND user_id = ? AND type = 'folder' AND status = 'active'",
+			root.ID, auth.GetUser(ctx)).Order("name").Find(&folders).Error; err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			out.Buckets = append(out.Buckets, s3Bucket{Name: folder.Name, CreationDate: s3Time(folder.CreatedAt)})
+		}
+	}
+	writeXML(w, http.StatusOK, &out)
+	return nil
+}
+
+type s3LocationResult struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+func (s *s3Server) bucketLocation(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.bucket(r.Context(), req.bucket); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &s3LocationResult{Xmlns: s3Namespace, Location: s.api.cnf.S3.Region})
+	return nil
+}
+
+type s3VersioningResult struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// bucketVersioning reports versioning as never enabled.
+func (s *s3Server) bucketVersioning(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.bucket(r.Context(), req.bucket); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &s3VersioningResult{Xmlns: s3Namespace})
+	return nil
+}
+
+func (s *s3Server) createBucket(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	if _, err := s.bucket(ctx, req.bucket); err == nil {
+		return errS3BucketExists
+	} else if !errors.Is(err, errS3NoSuchBucket) {
+		return err
+	}
+	if err := s.api.FilesMkdir(ctx, &api.FileMkDir{Path: "/" + req.bucket}); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+req.bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Server) deleteBucket(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	bucket, err := s.bucket(ctx, req.bucket)
+	if err != nil {
+		return err
+	}
+	var children int64
+	if err := s.api.db.Model(&models.File{}).Where("parent_id = ? AND status = 'active'", bucket.ID).
+		Count(&children).Error; err != nil {
+		return err
+	}
+	if children > 0 {
+		return errS3BucketNotEmpty
+	}
+	if err := s.api.FilesDelete(ctx, &api.FileDelete{Ids: []string{bucket.ID}}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3Entry is a listed key, folders are only listed one level deep and end
+// with a slash.
+type s3Entry struct {
+	Key  string
+	File models.File
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	Marker                *string    `xml:"Marker"`
+	NextMarker            string     `xml:"NextMarker,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	KeyCount              *int       `xml:"KeyCount"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	EncodingType          string     `xml:"EncodingType,omitempty"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// listBase returns the folder the prefix points into and its key, nil when
+// there is no such folder.
+func (s *s3Server) listBase(ctx context.Context, bucket *models.File, prefix string) (*models.File, string, error) {
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	if dir == "" {
+		return bucket, "", nil
+	}
+	p, err := objectPath(bucket.Name, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	base, err := s.lookup(ctx, p)
+	if err != nil {
+		return nil, "", err
+	}
+	if base == nil || base.Type != "folder" {
+		return nil, "", nil
+	}
+	return base, dir, nil
+}
+
+// listEntries returns the children of the folder below dir sorted by key,
+// folders end with a slash.
+func (s *s3Server) listEntries(ctx context.Context, base *models.File, dir string) ([]s3Entry, error) {
+	var children []models.File
+	if err := s.api.db.Where("parent_id = ? AND user_id = ? AND status = 'active'", base.ID, auth.GetUser(ctx)).
+		Order("name").Find(&children).Error; err != nil {
+		return nil, err
+	}
+
+	entries := []s3Entry{}
+	for _, child := range children {
+		key := dir + child.Name
+		if child.Type == "folder" {
+			key += "/"
+		}
+		entries = append(entries, s3Entry{Key: key, File: child})
+	}
+	slices.SortFunc(entries, func(a, b s3Entry) int { return strings.Compare(a.Key, b.Key) })
+	return entries, nil
+}
+
+// treeEntries returns up to limit files below the folder at dir whose keys
+// start with prefix and sort after the start key. Keys compare bytewise like
+// in Go, and folders which can only hold keys before the start key or
+// outside the prefix are not walked.
+func (s *s3Server) treeEntries(ctx context.Context, base *models.File, dir, prefix, after string, limit int) ([]s3Entry, error) {
+	files := []archiveEntry{}
+	if err := s.api.db.Raw(`WITH RECURSIVE tree AS (
+		SELECT id, type, @dir || name AS path FROM teldrive.files
+		WHERE parent_id = @base AND user_id = @user AND status = 'active'
+		UNION ALL
+		SELECT f.id, f.type, tree.path || '/' || f.name FROM teldrive.files f
+		INNER JOIN tree ON f.parent_id = tree.id WHERE tree.type = 'folder' AND f.status = 'active'
+		AND ((tree.path || '/') COLLATE "C" > @after OR starts_with(@after, tree.path || '/'))
+		AND (starts_with(tree.path || '/', @prefix) OR starts_with(@prefix, tree.path || '/'))
+	) SELECT files.*, tree.path FROM tree INNER JOIN teldrive.files files ON files.id = tree.id
+	WHERE tree.type = 'file' AND starts_with(tree.path, @prefix) AND tree.path COLLATE "C" > @after
+	ORDER BY tree.path COLLATE "C" LIMIT @limit`,
+		map[string]any{"dir": dir, "base": base.ID, "user": auth.GetUser(ctx), "prefix": prefix, "after": after,
+			"limit": limit}).Scan(&files).Error; err != nil {
+		return nil, err
+	}
+	entries := make([]s3Entry, len(files))
+	for i, file := range files {
+		entries[i] = s3Entry{Key: file.Path, File: file.File}
+	}
+	return entries, nil
+}
+
+// listTree pages through the files below base until the page is full. Only
+// the keys of one page and the batch read ahead of it are held at a time.
+func (s *s3Server) listTree(ctx context.Context, base *models.File, dir, prefix, delimiter, after string,
+	maxKeys int) ([]s3Entry, []string, bool, string, error) {
+	var (
+		objects  []s3Entry
+		prefixes []string
+		next     string
+	)
+	cursor, last := after, after
+	for {
+		batch, err := s.treeEntries(ctx, base, dir, prefix, cursor, s3MaxKeys)
+		if err != nil {
+			return nil, nil, false, "", err
+		}
+		o, p, truncated, n := listPage(batch, prefix, delimiter, last, maxKeys-len(objects)-len(prefixes))
+		objects, prefixes = append(objects, o...), append(prefixes, p...)
+		if n != "" {
+			next, last = n, n
+		}
+		if truncated || len(batch) < s3MaxKeys {
+			return objects, prefixes, truncated, next, nil
+		}
+		cursor = batch[len(batch)-1].Key
+	}
+}
+
+// listPage applies prefix, delimiter, the start key and the page size to the
+// sorted entries. Keys sharing a prefix up to the delimiter count once.
+func listPage(entries []s3Entry, prefix, delimiter, after string, maxKeys int) ([]s3Entry, []string, bool, string) {
+	var (
+		objects  []s3Entry
+		prefixes []string
+		next     string
+	)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Key, prefix) || entry.Key <= after {
+			continue
+		}
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(entry.Key[len(prefix):], delimiter); i >= 0 {
+				common = entry.Key[:len(prefix)+i+len(delimiter)]
+				if common <= after || (len(prefixes) > 0 && prefixes[len(prefixes)-1] == common) {
+					continue
+				}
+			}
+		}
+		if len(objects)+len(prefixes) == maxKeys {
+			return objects, prefixes, true, next
+		}
+		if common != "" {
+			prefixes = append(prefixes, common)
+			next = common
+		} else {
+			objects = append(objects, entry)
+			next = entry.Key
+		}
+	}
+	return objects, prefixes, false, next
+}
+
+func (s *s3Server) listObjects(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	q := r.URL.Query()
+	bucket, err := s.bucket(ctx, req.bucket)
+	if err != nil {
+		return err
+	}
+
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		if maxKeys, err = strconv.Atoi(v); err != nil || maxKeys < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid max-keys"}
+		}
+		maxKeys = min(maxKeys, s3MaxKeys)
+	}
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid continuation token"}
+			}
+			after = string(decoded)
+		}
+	}
+
+	var (
+		objects   []s3Entry
+		prefixes  []string
+		truncated bool
+		next      string
+	)
+	base, dir, err := s.listBase(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	if base != nil && delimiter == "/" {
+		entries, err := s.listEntries(ctx, base, dir)
+		if err != nil {
+			return err
+		}
+		objects, prefixes, truncated, next = listPage(entries, prefix, delimiter, after, maxKeys)
+	} else if base != nil {
+		if objects, prefixes, truncated, next, err = s.listTree(ctx, base, dir, prefix, delimiter, after,
+			maxKeys); err != nil {
+			return err
+		}
+	}
+
+	encode := func(s string) string { return s }
+	out := s3ListObjectsResult{
+		Xmlns:       s3Namespace,
+		Name:        req.bucket,
+		MaxKeys:     maxKeys,
+		IsTruncated: truncated,
+	}
+	if q.Get("encoding-type") == "url" {
+		encode = func(s string) string { return sigv4.Escape(s, false) }
+		out.EncodingType = "url"
+	}
+	out.Prefix, out.Delimiter = encode(prefix), encode(delimiter)
+	for _, entry := range objects {
+		out.Contents = append(out.Contents, s3Object{
+			Key:          encode(entry.Key),
+			LastModified: s3Time(entry.File.UpdatedAt),
+			ETag:         s3ETag(&entry.File),
+			Size:         fileSize(&entry.File),
+			StorageClass: s3StorageStd,
+		})
+	}
+	for _, p := range prefixes {
+		out.CommonPrefixes = append(out.CommonPrefixes, s3Prefix{Prefix: encode(p)})
+	}
+	if v2 {
+		count := len(objects) + len(prefixes)
+		out.KeyCount = &count
+		out.ContinuationToken = q.Get("continuation-token")
+		out.StartAfter = encode(q.Get("start-after"))
+		if truncated {
+			out.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+	} else {
+		marker := encode(q.Get("marker"))
+		out.Marker = &marker
+		if truncated {
+			out.NextMarker = encode(next)
+		}
+	}
+	writeXML(w, http.StatusOK, &out)
+	return nil
+}
+
+func (s *s3Server) getObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	file, err := s.object(ctx, req)
+	if err != nil {
+		return err
+	}
+	size := fileSize(file)
+
+	etag := s3ETag(file)
+	if im := r.Header.Get("If-Match"); im != "" && !etagMatches(im, etag, false) {
+		return errS3PreconditionFailed
+	}
+	if ius, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil &&
+		file.UpdatedAt.Truncate(time.Second).After(ius) {
+		return errS3PreconditionFailed
+	}
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if notModified(r, etag, file.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	contentType := file.MimeType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	h.Set("Content-Type", contentType)
+	q := r.URL.Query()
+	for param, header := range map[string]string{
+		"response-content-type":        "Content-Type",
+		"response-content-disposition": "Content-Disposition",
+		"response-content-encoding":    "Content-Encoding",
+		"response-content-language":    "Content-Language",
+		"response-cache-control":       "Cache-Control",
+		"response-expires":             "Expires",
+	} {
+		if v := q.Get(param); v != "" {
+			h.Set(header, v)
+		}
+	}
+
+	start, end, status := int64(0), size-1, http.StatusOK
+	// Like S3 only single ranges are served, a request for several ranges
+	// gets the whole object rather than the ranges that parsed.
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && !strings.Contains(rangeHeader, ",") && size > 0 &&
+		rangeApplies(r, etag, file.UpdatedAt) {
+		ranges, err := http_range.Parse(rangeHeader, size)
+		if err == http_range.ErrNoOverlap {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return errS3InvalidRange
+		}
+		if err == nil && len(ranges) == 1 {
+			start, end, status = ranges[0].Start, ranges[0].End, http.StatusPartialContent
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		}
+	}
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead || size == 0 {
+		return nil
+	}
+
+	client, release, err := s.api.channelClient(ctx, file.UserId, *file.ChannelId, auth.GetJWTUser(ctx).TgSession)
+	if err != nil {
+		logging.FromContext(ctx).Error("s3 get object", zap.Error(err))
+		return nil
+	}
+	err = func() error {
+		parts, err := getParts(ctx, client, s.api.cache, file)
+		if err != nil {
+			return err
+		}
+		lr, err := reader.NewLinearReader(ctx, client, s.api.cache, file, parts, start, end, &s.api.cnf.TG, 0)
+		if err != nil {
+			return err
+		}
+		defer lr.Close()
+		_, err = io.CopyN(w, lr, end-start+1)
+		return err
+	}()
+	release(err)
+	if err != nil {
+		// The status is already sent, the client notices the short body.
+		logging.FromContext(ctx).Error("s3 get object", zap.Error(err))
+	}
+	return nil
+}
+
+func (s *s3Server) storedFile(id string) (*models.File, error) {
+	var file models.File
+	if err := s.api.db.Where("id = ?", id).First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (s *s3Server) putObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	if strings.HasSuffix(req.key, "/") && req.size == 0 {
+		// Folder markers of tools which emulate directories become folders.
+		if _, err := s.bucket(ctx, req.bucket); err != nil {
+			return err
+		}
+		p, err := objectPath(req.bucket, req.key)
+		if err != nil {
+			return err
+		}
+		if err := s.api.FilesMkdir(ctx, &api.FileMkDir{Path: p}); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", s3EmptyETag)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	parentId, name, err := s.parentFolder(ctx, req)
+	if err != nil {
+		return err
+	}
+	out, err := s.api.uploadFile(ctx, &fileUpload{
+		ParentId: parentId,
+		Name:     name,
+		Size:     req.size,
+		MimeType: r.Header.Get("Content-Type"),
+	}, req.body)
+	if err != nil {
+		return err
+	}
+	file, err := s.storedFile(out.ID.Value)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", s3ETag(file))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string
+	ETag         string
+}
+
+// copyObject copies on the server through FilesCopy, the source is given as
+// /bucket/key in X-Amz-Copy-Source.
+func (s *s3Server) copyObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return errS3InvalidKey
+	}
+	source, _, _ = strings.Cut(source, "?")
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	src, err := s.object(ctx, &s3Request{bucket: srcBucket, key: srcKey})
+	if err != nil {
+		return err
+	}
+	parentId, name, err := s.parentFolder(ctx, req)
+	if err != nil {
+		return err
+	}
+	var existing *models.File
+	if p, err := objectPath(req.bucket, req.key); err == nil {
+		if existing, err = s.lookup(ctx, p); err == nil && existing != nil && existing.ID == src.ID {
+			return &s3Error{http.StatusBadRequest, "InvalidRequest", "The source and destination are the same object"}
+		}
+	}
+	id, err := s.api.copyOver(ctx, src.ID, parentId, name, existing)
+	if err != nil {
+		return err
+	}
+	file, err := s.storedFile(id)
+	if err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &s3CopyObjectResult{Xmlns: s3Namespace, LastModified: s3Time(file.UpdatedAt), ETag: s3ETag(file)})
+	return nil
+}
+
+func (s *s3Server) deleteObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	file, err := s.object(ctx, req)
+	if err != nil && !errors.Is(err, errS3NoSuchKey) {
+		return err
+	}
+	if file != nil {
+		if err := s.api.FilesDelete(ctx, &api.FileDelete{Ids: []string{file.ID}}); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3DeleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Deleted []struct {
+		Key string
+	} `xml:"Deleted"`
+}
+
+func (s *s3Server) deleteObjects(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	var in s3DeleteRequest
+	if err := decodeXML(req.body, &in); err != nil {
+		return err
+	}
+	if len(in.Objects) > s3MaxKeys {
+		return errS3MalformedXML
+	}
+	out := s3DeleteResult{Xmlns: s3Namespace}
+	ids := []string{}
+	for _, object := range in.Objects {
+		file, err := s.object(ctx, &s3Request{bucket: req.bucket, key: object.Key})
+		if err != nil && !errors.Is(err, errS3NoSuchKey) {
+			return err
+		}
+		if file != nil {
+			ids = append(ids, file.ID)
+		}
+		if !in.Quiet {
+			out.Deleted = append(out.Deleted, struct{ Key string }{object.Key})
+		}
+	}
+	if len(ids) > 0 {
+		if err := s.api.FilesDelete(ctx, &api.FileDelete{Ids: ids}); err != nil {
+			return err
+		}
+	}
+	writeXML(w, http.StatusOK, &out)
+	return nil
+}
+
+type s3KeyOut struct {
+	AccessKey string    `json:"accessKey"`
+	SecretKey string    `json:"secretKey,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func randomKey(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// S3KeysList returns the access keys of the user, secrets are only shown on
+// creation.
+func (e *extendedService) S3KeysList(w http.ResponseWriter, r *http.Request) {
+	var keys []models.S3Key
+	if err := e.api.db.Where("user_id = ?", auth.GetUser(r.Context())).Order("created_at desc").
+		Find(&keys).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	out := []s3KeyOut{}
+	for _, key := range keys {
+		out = append(out, s3KeyOut{AccessKey: key.AccessKey, Name: key.Name, CreatedAt: key.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (e *extendedService) S3KeysCreate(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(r, &in); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	key := models.S3Key{
+		AccessKey: "TD" + strings.ToUpper(randomKey(9)),
+		SecretKey: randomKey(20),
+		UserId:    auth.GetUser(r.Context()),
+		Name:      in.Name,
+	}
+	if err := e.api.db.Create(&key).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusCreated, &s3KeyOut{AccessKey: key.AccessKey, SecretKey: key.SecretKey, Name: key.Name, CreatedAt: key.CreatedAt})
+}
+
+func (e *extendedService) S3KeysDelete(w http.ResponseWriter, r *http.Request) {
+	accessKey := chi.URLParam(r, "id")
+	res := e.api.db.Where("access_key = ? AND user_id = ?", accessKey, auth.GetUser(r.Context())).Delete(&models.S3Key{})
+	if res.Error != nil {
+		writeError(w, r, &apiError{err: res.Error})
+		return
+	}
+	if res.RowsAffected == 0 {
+		writeError(w, r, &apiError{err: errors.New("access key not found"), code: http.StatusNotFound})
+		return
+	}
+	e.api.cache.Delete(cache.Key("s3keys", accessKey))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/md5"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+// Multipart uploads use the upload rows of the REST API. The upload id is the
+// upload_id of the parts, nothing is stored before the first part arrives.
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type s3Part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type s3ListPartsResult struct {
+	XMLName     xml.Name `xml:"ListPartsResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Bucket      string
+	Key         string
+	UploadId    string
+	Owner       s3Owner
+	IsTruncated bool
+	Parts       []s3Part `xml:"Part"`
+}
+
+func s3PartETag(upload *models.Upload) string {
+	return `"` + md5.FromString(upload.UploadId+strconv.Itoa(upload.PartId)) + `"`
+}
+
+// uploadedParts returns the latest upload of every part number.
+func (s *s3Server) uploadedParts(ctx context.Context, uploadId string) (map[int]models.Upload, []models.Upload, error) {
+	var uploads []models.Upload
+	if err := s.api.db.Where("upload_id = ? AND user_id = ?", uploadId, auth.GetUser(ctx)).
+		Order("part_no, created_at").Find(&uploads).Error; err != nil {
+		return nil, nil, err
+	}
+	latest := map[int]models.Upload{}
+	for _, upload := range uploads {
+		latest[upload.PartNo] = upload
+	}
+	return latest, uploads, nil
+}
+
+func (s *s3Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.bucket(r.Context(), req.bucket); err != nil {
+		return err
+	}
+	if _, err := objectPath(req.bucket, req.key); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &s3InitiateResult{Xmlns: s3Namespace, Bucket: req.bucket, Key: req.key, UploadId: uuid.NewString()})
+	return nil
+}
+
+func (s *s3Server) uploadPart(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	q := r.URL.Query()
+	uploadId := q.Get("uploadId")
+	partNo, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || partNo < 1 || partNo > s3MaxPartNo || uuid.Validate(uploadId) != nil {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid part number or upload id"}
+	}
+	if req.size < 0 {
+		return errS3MissingLength
+	}
+	if _, err := s.bucket(ctx, req.bucket); err != nil {
+		return err
+	}
+	p, err := objectPath(req.bucket, req.key)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	out, err := s.api.UploadsUpload(ctx, &api.UploadsUploadReqWithContentType{
+		ContentType: defaultContentType,
+		Content:     api.UploadsUploadReq{Data: req.body},
+	}, api.UploadsUploadParams{
+		ID:            uploadId,
+		PartName:      fmt.Sprintf("%s.part.%03d", name, partNo),
+		FileName:      name,
+		PartNo:        partNo,
+		ContentLength: req.size,
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", s3PartETag(&models.Upload{UploadId: uploadId, PartId: out.PartId}))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Server) listParts(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	uploadId := r.URL.Query().Get("uploadId")
+	latest, _, err := s.uploadedParts(ctx, uploadId)
+	if err != nil {
+		return err
+	}
+	out := s3ListPartsResult{Xmlns: s3Namespace, Bucket: req.bucket, Key: req.key, UploadId: uploadId, Owner: s.owner(ctx)}
+	for partNo := 1; len(out.Parts) < len(latest); partNo++ {
+		upload, ok := latest[partNo]
+		if !ok {
+			continue
+		}
+		out.Parts = append(out.Parts, s3Part{
+			PartNumber:   partNo,
+			LastModified: s3Time(upload.CreatedAt),
+			ETag:         s3PartETag(&upload),
+			Size:         upload.Size,
+		})
+	}
+	writeXML(w, http.StatusOK, &out)
+	return nil
+}
+
+// completeMultipartUpload creates the file from the listed parts. Parts which
+// were uploaded but not listed are deleted from the channel.
+func (s *s3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	uploadId := r.URL.Query().Get("uploadId")
+	var in s3CompleteRequest
+	if err := decodeXML(req.body, &in); err != nil {
+		return err
+	}
+	latest, uploads, err := s.uploadedParts(ctx, uploadId)
+	if err != nil {
+		return err
+	}
+	if len(uploads) == 0 {
+		return errS3NoSuchUpload
+	}
+	if len(in.Parts) == 0 {
+		return errS3MalformedXML
+	}
+
+	var (
+		parts []api.Part
+		size  int64
+		used  = map[int]bool{}
+	)
+	for i, part := range in.Parts {
+		if i > 0 && part.PartNumber <= in.Parts[i-1].PartNumber {
+			return errS3InvalidPartOrder
+		}
+		upload, ok := latest[part.PartNumber]
+		if !ok || !etagMatches(part.ETag, s3PartETag(&upload), false) || upload.ChannelId != uploads[0].ChannelId {
+			return errS3InvalidPart
+		}
+		p := api.Part{ID: upload.PartId}
+		if upload.Salt != "" {
+			p.Salt = api.NewOptString(upload.Salt)
+		}
+		parts = append(parts, p)
+		size += upload.Size
+		used[upload.PartId] = true
+	}
+
+	parentId, name, err := s.parentFolder(ctx, req)
+	if err != nil {
+		return err
+	}
+	unused := []models.Upload{}
+	for _, upload := range uploads {
+		if !used[upload.PartId] {
+			unused = append(unused, upload)
+		}
+	}
+	out, err := s.api.commitUpload(ctx, &fileUpload{ParentId: parentId, Name: name}, uploadId, parts, size, uploads[0].ChannelId)
+	if err != nil {
+		return err
+	}
+	s.api.deleteUploadedParts(ctx, unused)
+
+	file, err := s.storedFile(out.ID.Value)
+	if err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &s3CompleteResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + req.bucket + "/" + req.key,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		ETag:     s3ETag(file),
+	})
+	return nil
+}
+
+func (s *s3Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	ctx := r.Context()
+	uploadId := r.URL.Query().Get("uploadId")
+	_, uploads, err := s.uploadedParts(ctx, uploadId)
+	if err != nil {
+		return err
+	}
+	if len(uploads) == 0 {
+		return errS3NoSuchUpload
+	}
+	s.api.deleteUploadedParts(ctx, uploads)
+	if err := s.api.db.Where("upload_id = ? AND user_id = ?", uploadId, auth.GetUser(ctx)).
+		Delete(&models.Upload{}).Error; err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
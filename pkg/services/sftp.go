@@ -0,0 +1,377 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/sftp"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// SFTPServer serves the files of users over SFTP. Users log in with any user
+// name and one of the SSH keys added to their account.
+type SFTPServer struct {
+	api      *apiService
+	config   *ssh.ServerConfig
+	addr     string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func NewSFTPServer(api *apiService) (*SFTPServer, error) {
+	signer, err := loadHostKey(api.cnf.SFTP.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("sftp host key: %w", err)
+	}
+	s := &SFTPServer{
+		api:   api,
+		addr:  fmt.Sprintf(":%d", api.cnf.SFTP.Port),
+		conns: map[net.Conn]struct{}{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+	s.config.AddHostKey(signer)
+	return s, nil
+}
+
+// loadHostKey reads the host key, a missing key is generated so clients see
+// the same key across restarts.
+func loadHostKey(file string) (ssh.Signer, error) {
+	if file == "" {
+		file = filepath.Join(utils.DataDir(), "ssh_host_ed25519_key")
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "teldrive")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func (s *SFTPServer) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var stored models.SSHKey
+	if err := s.api.db.Where("fingerprint = ?", ssh.FingerprintSHA256(key)).First(&stored).Error; err != nil {
+		return nil, errors.New("unknown public key")
+	}
+	// Uploads and deletes without bots need the telegram session of the user.
+	if _, err := s.api.userSession(stored.UserId); err != nil {
+		return nil, errors.New("no telegram session, log in to teldrive first")
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"user-id": strconv.FormatInt(stored.UserId, 10)}}, nil
+}
+
+// ListenAndServe accepts connections until Shutdown is called.
+func (s *SFTPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for open sessions to end.
+// Sessions still open when ctx is done are closed, their uploads are aborted.
+func (s *SFTPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.cancel()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+func (s *SFTPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	logger := logging.DefaultLogger().With(zap.String("remote", conn.RemoteAddr().String()))
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		logger.Debug("sftp handshake failed", zap.Error(err))
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+
+	userId, _ := strconv.ParseInt(sc.Permissions.Extensions["user-id"], 10, 64)
+	// Uploads and deletes without bots go through the telegram session of the user.
+	session, err := s.api.userSession(userId)
+	if err != nil {
+		logger.Warn("sftp user has no telegram session", zap.Int64("user", userId), zap.Error(err))
+		return
+	}
+	claims := &types.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.FormatInt(userId, 10)},
+		TgSession:        session,
+	}
+	ctx, cancel := context.WithCancel(logging.WithLogger(auth.WithUser(s.ctx, claims), logger))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveSession(ctx, ch, reqs)
+		}()
+	}
+	wg.Wait()
+}
+
+// serveSession runs the sftp subsystem, shells and commands are refused.
+func (s *SFTPServer) serveSession(ctx context.Context, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	started := false
+	for req := range reqs {
+		var subsystem struct{ Name string }
+		ok := !started && req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+		go func() {
+			fsys := &sftpFS{ctx: ctx, dav: &davFS{api: s.api}, encrypt: s.api.cnf.SFTP.Encrypt}
+			status := uint32(0)
+			if err := sftp.Serve(ch, fsys); err != nil {
+				logging.FromContext(ctx).Debug("sftp session failed", zap.Error(err))
+				status = 1
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			ch.Close()
+		}()
+	}
+}
+
+// sftpFS maps sftp onto the webdav file system of the user in the context.
+type sftpFS struct {
+	ctx     context.Context
+	dav     *davFS
+	encrypt bool
+}
+
+func (f *sftpFS) Stat(name string) (fs.FileInfo, error) {
+	return f.dav.Stat(f.ctx, name)
+}
+
+func (f *sftpFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	file, err := f.dav.lookup(f.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return (&davFile{ctx: f.ctx, api: f.dav.api, file: file}).Readdir(0)
+}
+
+func (f *sftpFS) Open(name string) (io.ReadSeekCloser, error) {
+	return f.dav.OpenFile(f.ctx, name, os.O_RDONLY, 0)
+}
+
+func (f *sftpFS) Create(name string) (io.WriteCloser, error) {
+	parent, err := f.dav.lookup(f.ctx, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	if parent.Type != "folder" {
+		return nil, os.ErrInvalid
+	}
+	return f.dav.api.newUploadWriter(f.ctx, &fileUpload{
+		ParentId:  parent.ID,
+		Name:      path.Base(name),
+		Size:      -1,
+		Encrypted: f.encrypt,
+	}), nil
+}
+
+func (f *sftpFS) Mkdir(name string) error {
+	return f.dav.Mkdir(f.ctx, name, 0)
+}
+
+func (f *sftpFS) Remove(name string) error {
+	return f.dav.RemoveAll(f.ctx, name)
+}
+
+func (f *sftpFS) Rename(oldName, newName string) error {
+	return f.dav.Rename(f.ctx, oldName, newName)
+}
+
+type sshKeyOut struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"publicKey"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func toSSHKeyOut(key *models.SSHKey) *sshKeyOut {
+	return &sshKeyOut{ID: key.ID, Name: key.Name, Fingerprint: key.Fingerprint, PublicKey: key.PublicKey, CreatedAt: key.CreatedAt}
+}
+
+func (e *extendedService) SSHKeysList(w http.ResponseWriter, r *http.Request) {
+	var keys []models.SSHKey
+	if err := e.api.db.Where("user_id = ?", auth.GetUser(r.Context())).Order("created_at desc").
+		Find(&keys).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	out := []*sshKeyOut{}
+	for i := range keys {
+		out = append(out, toSSHKeyOut(&keys[i]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// SSHKeysCreate adds a public key in authorized_keys format. The comment of
+// the key is used as name when none is given.
+func (e *extendedService) SSHKeysCreate(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Name      string `json:"name"`
+		PublicKey string `json:"publicKey"`
+	}
+	if err := decodeJSON(r, &in); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(in.PublicKey))
+	if err != nil {
+		writeError(w, r, &apiError{err: errors.New("invalid public key"), code: http.StatusBadRequest})
+		return
+	}
+	if in.Name == "" {
+		in.Name = comment
+	}
+	key := models.SSHKey{
+		UserId:      auth.GetUser(r.Context()),
+		Name:        in.Name,
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+	}
+	err = e.api.db.Where("fingerprint = ?", key.Fingerprint).First(&models.SSHKey{}).Error
+	if err == nil {
+		writeError(w, r, &apiError{err: errors.New("public key is already in use"), code: http.StatusConflict})
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	if err := e.api.db.Create(&key).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusCreated, toSSHKeyOut(&key))
+}
+
+func (e *extendedService) SSHKeysDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if uuid.Validate(id) != nil {
+		writeError(w, r, &apiError{err: errors.New("ssh key not found"), code: http.StatusNotFound})
+		return
+	}
+	res := e.api.db.Where("id = ? AND user_id = ?", id, auth.GetUser(r.Context())).Delete(&models.SSHKey{})
+	if res.Error != nil {
+		writeError(w, r, &apiError{err: res.Error})
+		return
+	}
+	if res.RowsAffected == 0 {
+		writeError(w, r, &apiError{err: errors.New("ssh key not found"), code: http.StatusNotFound})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
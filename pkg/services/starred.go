@@ -0,0 +1,68 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// maxRecentFiles bounds the recently opened files kept per user.
+const maxRecentFiles = 100
+
+type starredUpdate struct {
+	Ids     []string `json:"ids"`
+	Starred bool     `json:"starred"`
+}
+
+func (a *apiService) recordOpen(userId int64, fileId string) {
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`INSERT INTO teldrive.file_opens (file_id, user_id) VALUES (?, ?)
+		ON CONFLICT (user_id, file_id) DO UPDATE SET opened_at = timezone('utc'::text, now())`, fileId, userId).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM teldrive.file_opens WHERE user_id = ? AND file_id NOT IN
+		(SELECT file_id FROM teldrive.file_opens WHERE user_id = ? ORDER BY opened_at DESC LIMIT ?)`,
+			userId, userId, maxRecentFiles).Error
+	})
+	if err != nil {
+		logging.DefaultLogger().Error("failed to record file open", zap.String("file", fileId), zap.Error(err))
+	}
+}
+
+func (e *extendedService) FilesUpdateStarred(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+
+	var req starredUpdate
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Ids) == 0 {
+		writeError(w, r, &apiError{err: errors.New("ids should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	if slices.ContainsFunc(req.Ids, func(id string) bool { return !isUUID(id) }) {
+		writeError(w, r, &apiError{err: errors.New("invalid file id"), code: http.StatusBadRequest})
+		return
+	}
+
+	var err error
+	if req.Starred {
+		err = e.api.db.Exec(`INSERT INTO teldrive.file_stars (file_id, user_id)
+		SELECT id, user_id FROM teldrive.files WHERE id = any(?) AND user_id = ?
+		ON CONFLICT DO NOTHING`, stringArray(req.Ids), userId).Error
+	} else {
+		err = e.api.db.Exec("DELETE FROM teldrive.file_stars WHERE file_id = any(?) AND user_id = ?",
+			stringArray(req.Ids), userId).Error
+	}
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/http_range"
+	"github.com/tgdrive/teldrive/internal/md5"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+// maxRanges is the most ranges a request is answered with, every range opens
+// its own reader.
+const maxRanges = 16
+
+// fileETag changes whenever the file is replaced or edited.
+func fileETag(file *models.File) string {
+	var size int64
+	if file.Size != nil {
+		size = *file.Size
+	}
+	return fmt.Sprintf("\"%s\"", md5.FromString(file.ID+strconv.FormatInt(size, 10)+
+		strconv.FormatInt(file.UpdatedAt.UnixNano(), 10)))
+}
+
+// etagMatches reports whether one of the comma separated tags in header
+// matches etag. Weak comparison ignores the W/ prefix.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match and, when absent, If-Modified-Since as
+// described in RFC 9110 section 13.2.2.
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag, true)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(ims)
+}
+
+// rangeApplies evaluates If-Range, the range is ignored and the whole file
+// sent when the validator no longer matches.
+func rangeApplies(r *http.Request, etag string, modtime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, "\"") || strings.HasPrefix(ir, "W/") {
+		return etagMatches(ir, etag, false)
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return modtime.Truncate(time.Second).Equal(t)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// byteRanges writes a multipart/byteranges body. Part data comes from read so
+// the Content-Length can be computed upfront by writing the framing alone.
+type byteRanges struct {
+	ranges      []*http_range.Range
+	contentType string
+	size        int64
+	boundary    string
+}
+
+func newByteRanges(ranges []*http_range.Range, contentType string, size int64) *byteRanges {
+	return &byteRanges{ranges: ranges, contentType: contentType, size: size,
+		boundary: multipart.NewWriter(io.Discard).Boundary()}
+}
+
+func (b *byteRanges) ContentType() string {
+	return "multipart/byteranges; boundary=" + b.boundary
+}
+
+func (b *byteRanges) ContentLength() int64 {
+	var w countingWriter
+	b.write(&w, func(io.Writer, int64, int64) error { return nil })
+	return int64(w) + rangesSize(b.ranges)
+}
+
+func (b *byteRanges) write(w io.Writer, read func(w io.Writer, start, end int64) error) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(b.boundary)
+	for _, ra := range b.ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", ra.Start, ra.End, b.size)},
+			"Content-Type":  {b.contentType},
+		})
+		if err != nil {
+			return err
+		}
+		if err := read(part, ra.Start, ra.End); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// rangesSize is the number of bytes all ranges cover.
+func rangesSize(ranges []*http_range.Range) (size int64) {
+	for _, ra := range ranges {
+		size += ra.End - ra.Start + 1
+	}
+	return
+}
+
+// coalesceRanges sorts ranges and merges the ones which overlap or touch, as
+// RFC 9110 section 14.2 allows.
+func coalesceRanges(ranges []*http_range.Range) []*http_range.Range {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b *http_range.Range) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	out := []*http_range.Range{}
+	for _, ra := range sorted {
+		if n := len(out); n > 0 && ra.Start <= out[n-1].End+1 {
+			out[n-1].End = max(out[n-1].End, ra.End)
+			continue
+		}
+		out = append(out, &http_range.Range{Start: ra.Start, End: ra.End})
+	}
+	return out
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/http_range"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"a"`, false, true},
+		{`"b"`, false, false},
+		{`"b", "a"`, false, true},
+		{`*`, false, true},
+		{`W/"a"`, false, false},
+		{`W/"a"`, true, true},
+		{`W/"b" ,W/"a"`, true, true},
+		{``, true, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, etagMatches(tt.header, `"a"`, tt.weak), tt.header)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modtime := time.Date(2026, 10, 18, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", http.MethodGet, nil, false},
+		{"etag matches", http.MethodGet, map[string]string{"If-None-Match": `"a"`}, true},
+		{"weak etag matches", http.MethodHead, map[string]string{"If-None-Match": `W/"a"`}, true},
+		{"etag differs", http.MethodGet, map[string]string{"If-None-Match": `"b"`}, false},
+		{"etag wins over date", http.MethodGet, map[string]string{"If-None-Match": `"b"`,
+			"If-Modified-Since": modtime.Add(time.Hour).Format(http.TimeFormat)}, false},
+		{"not modified since", http.MethodGet, map[string]string{"If-Modified-Since": modtime.Format(http.TimeFormat)}, true},
+		{"modified since", http.MethodGet, map[string]string{"If-Modified-Since": modtime.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"invalid date", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"not a read", http.MethodPost, map[string]string{"If-None-Match": `"a"`}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		assert.Equal(t, tt.want, notModified(r, `"a"`, modtime), tt.name)
+	}
+}
+
+func TestRangeApplies(t *testing.T) {
+	modtime := time.Date(2026, 10, 18, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{`"a"`, true},
+		{`"b"`, false},
+		{`W/"a"`, false},
+		{modtime.Format(http.TimeFormat), true},
+		{modtime.Add(-time.Second).Format(http.TimeFormat), false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		assert.Equal(t, tt.want, rangeApplies(r, `"a"`, modtime), tt.ifRange)
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := []struct {
+		in   []*http_range.Range
+		want []*http_range.Range
+	}{
+		{[]*http_range.Range{{Start: 0, End: 0}, {Start: 1, End: 1}, {Start: 2, End: 2}},
+			[]*http_range.Range{{Start: 0, End: 2}}},
+		{[]*http_range.Range{{Start: 10, End: 19}, {Start: 0, End: 4}, {Start: 15, End: 30}},
+			[]*http_range.Range{{Start: 0, End: 4}, {Start: 10, End: 30}}},
+		{[]*http_range.Range{{Start: 0, End: 99}, {Start: 10, End: 20}},
+			[]*http_range.Range{{Start: 0, End: 99}}},
+		{[]*http_range.Range{{Start: 0, End: 4}, {Start: 6, End: 9}},
+			[]*http_range.Range{{Start: 0, End: 4}, {Start: 6, End: 9}}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, coalesceRanges(tt.in))
+	}
+}
+
+func TestByteRanges(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	ranges := []*http_range.Range{{Start: 0, End: 3}, {Start: 10, End: 19}}
+	b := newByteRanges(ranges, "text/plain", int64(len(content)))
+
+	var body bytes.Buffer
+	err := b.write(&body, func(w io.Writer, start, end int64) error {
+		_, err := w.Write(content[start : end+1])
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(body.Len()), b.ContentLength())
+	assert.Equal(t, int64(14), rangesSize(ranges))
+
+	mediaType, params, err := mime.ParseMediaType(b.ContentType())
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(&body, params["boundary"])
+	for _, ra := range ranges {
+		part, err := mr.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", ra.Start, ra.End, len(content)), part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		data, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, content[ra.Start:ra.End+1], data)
+	}
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+const maxTagLength = 64
+
+var errInvalidTag = errors.New("tags must be non empty, at most 64 characters and not contain commas")
+
+type tagsUpdate struct {
+	Ids    []string `json:"ids"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type tagStats struct {
+	Name       string `json:"name"`
+	TotalFiles int    `json:"totalFiles"`
+	TotalSize  int64  `json:"totalSize"`
+}
+
+// normalizeTags lower cases and dedupes tags so "Final" and "final " are the same tag.
+func normalizeTags(tags []string) ([]string, error) {
+	res := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxTagLength || strings.Contains(tag, ",") {
+			return nil, errInvalidTag
+		}
+		if !slices.Contains(res, tag) {
+			res = append(res, tag)
+		}
+	}
+	return res, nil
+}
+
+func (a *apiService) updateFileTags(userId int64, ids, add, remove []string) error {
+	return a.db.Transaction(func(tx *gorm.DB) error {
+		if len(add) > 0 {
+			if err := tx.Exec(`INSERT INTO teldrive.tags (user_id, name) SELECT ?, unnest(?::text[])
+			ON CONFLICT (user_id, name) DO NOTHING`, userId, stringArray(add)).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec(`INSERT INTO teldrive.file_tags (file_id, tag_id) SELECT f.id, t.id
+			FROM teldrive.files f CROSS JOIN teldrive.tags t
+			WHERE f.id = any(?) AND f.user_id = ? AND t.user_id = ? AND t.name = any(?)
+			ON CONFLICT DO NOTHING`, stringArray(ids), userId, userId, stringArray(add)).Error; err != nil {
+				return err
+			}
+		}
+		if len(remove) > 0 {
+			if err := tx.Exec(`DELETE FROM teldrive.file_tags ft USING teldrive.tags t
+			WHERE ft.tag_id = t.id AND ft.file_id = any(?) AND t.user_id = ? AND t.name = any(?)`,
+				stringArray(ids), userId, stringArray(remove)).Error; err != nil {
+				return err
+			}
+			// Tags are created on first use, so drop them again once nothing carries them.
+			if err := tx.Exec(`DELETE FROM teldrive.tags t WHERE t.user_id = ? AND t.name = any(?)
+			AND NOT EXISTS (SELECT 1 FROM teldrive.file_tags ft WHERE ft.tag_id = t.id)`,
+				userId, stringArray(remove)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *extendedService) FilesTagStats(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	stats := []tagStats{}
+	if err := e.api.db.Table("teldrive.tags as t").
+		Select("t.name", "COUNT(f.id) as total_files", "coalesce(SUM(f.size),0) as total_size").
+		Joins("JOIN teldrive.file_tags as ft ON ft.tag_id = t.id").
+		Joins("JOIN teldrive.files as f ON f.id = ft.file_id AND f.status = 'active'").
+		Where("t.user_id = ?", userId).
+		Group("t.name").Order("t.name ASC").Scan(&stats).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (e *extendedService) FilesUpdateTags(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+
+	var req tagsUpdate
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Ids) == 0 {
+		writeError(w, r, &apiError{err: errors.New("ids should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	if slices.ContainsFunc(req.Ids, func(id string) bool { return !isUUID(id) }) {
+		writeError(w, r, &apiError{err: errors.New("invalid file id"), code: http.StatusBadRequest})
+		return
+	}
+	add, err := normalizeTags(req.Add)
+	if err == nil {
+		req.Remove, err = normalizeTags(req.Remove)
+	}
+	if err != nil {
+		writeError(w, r, &apiError{err: err, code: http.StatusBadRequest})
+		return
+	}
+
+	if err := e.api.updateFileTags(userId, req.Ids, add, req.Remove); err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *extendedService) FilesGetTags(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	id := chi.URLParam(r, "id")
+	if !isUUID(id) {
+		writeError(w, r, &apiError{err: errors.New("file not found"), code: http.StatusNotFound})
+		return
+	}
+	tags := []string{}
+	if err := e.api.db.Model(&models.Tag{}).Select("tags.name").
+		Joins("JOIN teldrive.file_tags as ft ON ft.tag_id = tags.id").
+		Where("ft.file_id = ? AND tags.user_id = ?", id, userId).
+		Order("tags.name").Pluck("tags.name", &tags).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
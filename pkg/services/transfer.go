@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+// Transfer moves files between the local disk and the drive of one user
+// outside of a request. It backs the import, export and watch commands.
+type Transfer struct {
+	api    *apiService
+	userId int64
+	claims *types.JWTClaims
+}
+
+func NewTransfer(api *apiService, userId int64) (*Transfer, error) {
+	session, err := api.userSession(userId)
+	if err != nil {
+		return nil, err
+	}
+	return &Transfer{api: api, userId: userId, claims: &types.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.FormatInt(userId, 10)},
+		TgSession:        session,
+	}}, nil
+}
+
+func (t *Transfer) context(ctx context.Context) context.Context {
+	return auth.WithUser(ctx, t.claims)
+}
+
+// Mkdir creates the folder and its missing parents and returns its id.
+func (t *Transfer) Mkdir(dir string) (string, error) {
+	return t.api.copyDestination(t.userId, path.Clean("/"+dir))
+}
+
+// Stat returns the file or folder at name, os.ErrNotExist when there is none.
+func (t *Transfer) Stat(name string) (*models.File, error) {
+	file, err := t.api.getFileFromPath(path.Clean("/"+name), t.userId)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, os.ErrNotExist
+	}
+	return file, err
+}
+
+// PathOf returns the path of the folder with the given id.
+func (t *Transfer) PathOf(id string) (string, error) {
+	var folder models.File
+	if err := t.api.db.Where("id = ? AND user_id = ? AND type = 'folder'", id, t.userId).First(&folder).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", os.ErrNotExist
+		}
+		return "", err
+	}
+	if folder.ParentId == nil {
+		return "/", nil
+	}
+	var p string
+	if err := t.api.db.Raw("select teldrive.get_path_from_file_id(?)", id).Scan(&p).Error; err != nil {
+		return "", err
+	}
+	return path.Clean(p), nil
+}
+
+// Children returns the active files and folders of a folder.
+func (t *Transfer) Children(folderId string) ([]models.File, error) {
+	var children []models.File
+	if err := t.api.db.Where("parent_id = ? AND user_id = ? AND status = 'active'", folderId, t.userId).
+		Order("name").Find(&children).Error; err != nil {
+		return nil, err
+	}
+	return children, nil
+}
+
+// Upload stores r as name in the folder, replacing the parts of an existing
+// file of that name. The sha256 of the content is stored as hash of the file.
+func (t *Transfer) Upload(ctx context.Context, parentId, name string, r io.Reader, size int64, modTime time.Time, encrypted bool) (*models.File, error) {
+	ctx = t.context(ctx)
+	hash := sha256.New()
+	out, err := t.api.uploadFile(ctx, &fileUpload{
+		ParentId:  parentId,
+		Name:      name,
+		Size:      size,
+		Encrypted: encrypted,
+		UpdatedAt: modTime.UTC(),
+	}, io.TeeReader(r, hash))
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := t.api.db.Model(&models.File{}).Where("id = ?", out.ID.Value).Update("hash", sum).Error; err != nil {
+		return nil, err
+	}
+	var file models.File
+	if err := t.api.db.Where("id = ?", out.ID.Value).First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Delete deletes a file, its messages are removed by the cleanup job.
+func (t *Transfer) Delete(ctx context.Context, id string) error {
+	return t.api.FilesDelete(t.context(ctx), &api.FileDelete{Ids: []string{id}})
+}
+
+// Download writes the content of file to w, decrypted when it is encrypted.
+// threads above one fetch chunks in parallel when the channel has bots.
+func (t *Transfer) Download(ctx context.Context, file *models.File, w io.Writer, threads int) (err error) {
+	if file.Size == nil || *file.Size == 0 {
+		return nil
+	}
+	ctx = t.context(ctx)
+	tokens, err := getBotsToken(t.api.db, t.api.cache, t.userId, *file.ChannelId)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 || t.api.cnf.TG.DisableStreamBots {
+		threads = 0
+	}
+	client, release, err := t.api.channelClient(ctx, t.userId, *file.ChannelId, t.claims.TgSession)
+	if err != nil {
+		return err
+	}
+	defer func() { release(err) }()
+	parts, err := getParts(ctx, client, t.api.cache, file)
+	if err != nil {
+		return err
+	}
+	lr, err := reader.NewLinearReader(ctx, client, t.api.cache, file, parts, 0, *file.Size-1, &t.api.cnf.TG, threads)
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+	_, err = io.CopyN(w, lr, *file.Size)
+	return err
+}
+
+// Recover creates a file from messages of a channel which no file refers to.
+// A file of the same name in the folder is kept, the recovered one gets a
+// unique name like files posted to the channel do.
+func (t *Transfer) Recover(ctx context.Context, parentId, name string, channelId int64, partIds []int, size int64, modTime time.Time) (*models.File, error) {
+	ctx = t.context(ctx)
+	err := t.api.db.Where("name = ? AND parent_id = ? AND user_id = ? AND status = 'active'", name, parentId, t.userId).
+		First(&models.File{}).Error
+	if err == nil {
+		name = tgc.UniqueFileName(name, time.Now())
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	mimeType := mime.TypeByExtension(path.Ext(name))
+	if mimeType == "" {
+		mimeType = defaultContentType
+	}
+	parts := make([]api.Part, 0, len(partIds))
+	for _, id := range partIds {
+		parts = append(parts, api.Part{ID: id})
+	}
+	out, err := t.api.FilesCreate(ctx, &api.File{
+		Name:      name,
+		Type:      "file",
+		ParentId:  api.NewOptString(parentId),
+		MimeType:  api.NewOptString(mimeType),
+		Size:      api.NewOptInt64(size),
+		Parts:     parts,
+		ChannelId: api.NewOptInt64(channelId),
+		UpdatedAt: api.NewOptDateTime(modTime.UTC()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var file models.File
+	if err := t.api.db.Where("id = ?", out.ID.Value).First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// FileHash returns the hex encoded sha256 of a local file, the format of the
+// hashes stored by Upload.
+func FileHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
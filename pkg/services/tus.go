@@ -0,0 +1,571 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io). The
+// body is spooled to disk until a part of the configured part size is
+// complete, the part is then uploaded like any other. The offset of an upload
+// is the size of its uploaded parts plus the spooled remainder, both survive
+// restarts.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusPatchType  = "application/offset+octet-stream"
+)
+
+var (
+	errTusNotFound = &apiError{err: errors.New("upload not found"), code: http.StatusNotFound}
+	errTusExpired  = &apiError{err: errors.New("upload expired"), code: http.StatusGone}
+	errTusLocked   = &apiError{err: errors.New("upload is in use by another request"), code: http.StatusLocked}
+	errTusOffset   = &apiError{err: errors.New("offset does not match the upload"), code: http.StatusConflict}
+)
+
+func (e *extendedService) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusRequest checks the protocol version of a request.
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, &apiError{err: errors.New("unsupported tus version"), code: http.StatusPreconditionFailed})
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes Upload-Metadata, a list of keys with optional
+// base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for pair := range strings.SplitSeq(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+// TusCreate starts an upload. The destination is taken from the path (created
+// when missing) or parentId metadata and defaults to the root folder, the
+// name from filename or name.
+func (e *extendedService) TusCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	ctx := r.Context()
+	userId := auth.GetUser(ctx)
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, r, &apiError{err: errors.New("deferred upload length is not supported"), code: http.StatusBadRequest})
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		writeError(w, r, &apiError{err: errors.New("invalid Upload-Length"), code: http.StatusBadRequest})
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, &apiError{err: errors.New("invalid Upload-Metadata"), code: http.StatusBadRequest})
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		writeError(w, r, &apiError{err: errors.New("missing or invalid filename metadata"), code: http.StatusBadRequest})
+		return
+	}
+	encrypted := meta["encrypted"] == "true"
+	if encrypted && e.api.cnf.TG.Uploads.EncryptionKey == "" {
+		writeError(w, r, &apiError{err: errors.New("encryption is not enabled"), code: http.StatusBadRequest})
+		return
+	}
+
+	parentId, err := e.tusDestination(userId, meta)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	channelId, err := getDefaultChannel(e.api.db, e.api.cache, userId)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	mimeType := meta["filetype"]
+	if mimeType == "" {
+		mimeType = meta["type"]
+	}
+
+	up := &models.TusUpload{
+		ID:        uuid.NewString(),
+		UserId:    userId,
+		ParentId:  parentId,
+		Name:      name,
+		MimeType:  mimeType,
+		Size:      size,
+		PartSize:  e.api.cnf.TG.Uploads.PartSize,
+		ChannelId: channelId,
+		Encrypted: encrypted,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+	}
+	if err := e.api.db.Create(up).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(requestPath(r), "/")+"/"+up.ID)
+	w.Header().Set("Upload-Expires", e.tusExpiry(up).Format(http.TimeFormat))
+
+	if size == 0 || r.Header.Get("Content-Type") == tusPatchType {
+		defer e.tusLocks.lock(up.ID)()
+		offset, err := e.tusAppend(ctx, up, r.Body)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// requestPath returns the path the client requested, before the api prefix
+// was stripped.
+func requestPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+func (e *extendedService) tusDestination(userId int64, meta map[string]string) (string, error) {
+	if parentId := meta["parentId"]; parentId != "" {
+		var parent models.File
+		if err := e.api.db.Where("id = ? AND user_id = ? AND type = 'folder' AND status = 'active'", parentId, userId).
+			First(&parent).Error; err != nil {
+			return "", &apiError{err: errors.New("destination folder not found"), code: http.StatusNotFound}
+		}
+		return parent.ID, nil
+	}
+	dest := meta["path"]
+	if dest == "" {
+		dest = "/"
+	}
+	if !strings.HasPrefix(dest, "/") {
+		return "", &apiError{err: errors.New("path must be absolute"), code: http.StatusBadRequest}
+	}
+	parentId, err := e.api.copyDestination(userId, path.Clean(dest))
+	if err != nil {
+		return "", &apiError{err: err}
+	}
+	return parentId, nil
+}
+
+func (e *extendedService) tusExpiry(up *models.TusUpload) time.Time {
+	return up.CreatedAt.Add(e.api.cnf.TG.Uploads.Retention)
+}
+
+// tusLocks serializes the requests of an upload. A lock only lives while a
+// request holds or waits for it, so expired uploads leave nothing behind.
+type tusLocks struct {
+	mu    sync.Mutex
+	locks map[string]*tusLock
+}
+
+type tusLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (l *tusLocks) get(id string) *tusLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = map[string]*tusLock{}
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &tusLock{}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *tusLocks) put(id string, lock *tusLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, id)
+	}
+}
+
+// lock waits for the upload and returns the func releasing it.
+func (l *tusLocks) lock(id string) func() {
+	lock := l.get(id)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.put(id, lock)
+	}
+}
+
+// tryLock is lock without waiting, it reports whether the upload was free.
+func (l *tusLocks) tryLock(id string) (func(), bool) {
+	lock := l.get(id)
+	if !lock.TryLock() {
+		l.put(id, lock)
+		return nil, false
+	}
+	return func() {
+		lock.Unlock()
+		l.put(id, lock)
+	}, true
+}
+
+func (e *extendedService) tusUpload(r *http.Request) (*models.TusUpload, error) {
+	id := chi.URLParam(r, "id")
+	if uuid.Validate(id) != nil {
+		return nil, errTusNotFound
+	}
+	var up models.TusUpload
+	err := e.api.db.Where("id = ? AND user_id = ?", id, auth.GetUser(r.Context())).First(&up).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errTusNotFound
+	}
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+	if time.Now().UTC().After(e.tusExpiry(&up)) {
+		return nil, errTusExpired
+	}
+	return &up, nil
+}
+
+// tusState is the progress of an upload.
+type tusState struct {
+	parts    []models.Upload
+	uploaded int64
+	spool    string
+	spooled  int64
+}
+
+func (s *tusState) offset() int64 {
+	return s.uploaded + s.spooled
+}
+
+// tusState collects the uploaded parts and the spool of the next part. The
+// spool is named after the part so one left behind by an interrupted part
+// upload is not counted twice.
+func (e *extendedService) tusState(up *models.TusUpload) (*tusState, error) {
+	st := &tusState{}
+	if up.FileId != nil {
+		st.uploaded = up.Size
+		return st, nil
+	}
+	var uploads []models.Upload
+	if err := e.api.db.Where("upload_id = ? AND user_id = ?", up.ID, up.UserId).
+		Order("part_no, created_at").Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	latest := map[int]models.Upload{}
+	for _, upload := range uploads {
+		latest[upload.PartNo] = upload
+	}
+	for partNo := 1; ; partNo++ {
+		upload, ok := latest[partNo]
+		if !ok {
+			break
+		}
+		st.parts = append(st.parts, upload)
+	}
+	st.uploaded = min(int64(len(st.parts))*up.PartSize, up.Size)
+	st.spool = e.tusSpool(up, len(st.parts)+1)
+	fi, err := os.Stat(st.spool)
+	switch {
+	case err == nil:
+		st.spooled = fi.Size()
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	return st, nil
+}
+
+func (e *extendedService) tusSpool(up *models.TusUpload, partNo int) string {
+	return filepath.Join(e.api.cnf.TG.Uploads.SpoolDir, fmt.Sprintf("%s.%d", up.ID, partNo))
+}
+
+func (e *extendedService) TusHead(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	up, err := e.tusUpload(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	st, err := e.tusState(up)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.offset(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Size, 10))
+	w.Header().Set("Upload-Expires", e.tusExpiry(up).Format(http.TimeFormat))
+	if up.Metadata != "" {
+		w.Header().Set("Upload-Metadata", up.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *extendedService) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusPatchType {
+		writeError(w, r, &apiError{err: errors.New("content type must be " + tusPatchType), code: http.StatusUnsupportedMediaType})
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, r, &apiError{err: errors.New("invalid Upload-Offset"), code: http.StatusBadRequest})
+		return
+	}
+	up, err := e.tusUpload(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// A client resuming after a disconnect may arrive before the interrupted
+	// request has let go, it retries on 423.
+	unlock, ok := e.tusLocks.tryLock(up.ID)
+	if !ok {
+		writeError(w, r, errTusLocked)
+		return
+	}
+	defer unlock()
+
+	st, err := e.tusState(up)
+	if err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	if st.offset() != offset {
+		writeError(w, r, errTusOffset)
+		return
+	}
+	newOffset, err := e.tusAppend(r.Context(), up, r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", e.tusExpiry(up).Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusAppend spools body from the current offset, uploads every part it
+// completes and creates the file once all data arrived. It returns the new
+// offset, data received before the body broke off is kept.
+func (e *extendedService) tusAppend(ctx context.Context, up *models.TusUpload, body io.Reader) (int64, error) {
+	st, err := e.tusState(up)
+	if err != nil {
+		return 0, &apiError{err: err}
+	}
+	if err := os.MkdirAll(e.api.cnf.TG.Uploads.SpoolDir, 0700); err != nil {
+		return 0, &apiError{err: err}
+	}
+	totalParts := max(int((up.Size+up.PartSize-1)/up.PartSize), 1)
+
+	for st.uploaded < up.Size {
+		partNo := len(st.parts) + 1
+		partLen := min(up.PartSize, up.Size-st.uploaded)
+		if st.spooled < partLen {
+			f, err := os.OpenFile(st.spool, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return st.offset(), &apiError{err: err}
+			}
+			n, copyErr := io.CopyN(f, body, partLen-st.spooled)
+			st.spooled += n
+			if err := f.Close(); err != nil {
+				return st.offset(), &apiError{err: err}
+			}
+			if st.spooled < partLen {
+				if copyErr != nil && copyErr != io.EOF {
+					return st.offset(), &apiError{err: copyErr, code: http.StatusBadRequest}
+				}
+				return st.offset(), nil
+			}
+		}
+
+		partName := up.Name
+		if totalParts > 1 {
+			partName = fmt.Sprintf("%s.part.%03d", up.Name, partNo)
+		}
+		// The part is uploaded even if the client goes away meanwhile, the
+		// data is complete and a retry would only send it again.
+		upload, err := e.tusUploadPart(context.WithoutCancel(ctx), up, st.spool, partName, partNo, partLen)
+		if err != nil {
+			return st.offset(), err
+		}
+		os.Remove(st.spool)
+		st.parts = append(st.parts, *upload)
+		st.uploaded += partLen
+		st.spool, st.spooled = e.tusSpool(up, partNo+1), 0
+	}
+
+	if up.FileId == nil {
+		if err := e.tusComplete(context.WithoutCancel(ctx), up, st); err != nil {
+			return st.offset(), err
+		}
+	}
+	return st.offset(), nil
+}
+
+func (e *extendedService) tusUploadPart(ctx context.Context, up *models.TusUpload, spool, partName string, partNo int, partLen int64) (*models.Upload, error) {
+	f, err := os.Open(spool)
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+	defer f.Close()
+	out, err := e.api.UploadsUpload(ctx, &api.UploadsUploadReqWithContentType{
+		ContentType: defaultContentType,
+		Content:     api.UploadsUploadReq{Data: f},
+	}, api.UploadsUploadParams{
+		ID:            up.ID,
+		PartName:      partName,
+		FileName:      up.Name,
+		PartNo:        partNo,
+		ChannelId:     api.NewOptInt64(up.ChannelId),
+		Encrypted:     api.NewOptBool(up.Encrypted),
+		ContentLength: partLen,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &models.Upload{PartNo: partNo, PartId: out.PartId, Salt: out.Salt.Value, ChannelId: out.ChannelId}, nil
+}
+
+// tusComplete creates the file. Parts uploaded twice because an earlier
+// request failed after the upload are deleted.
+func (e *extendedService) tusComplete(ctx context.Context, up *models.TusUpload, st *tusState) error {
+	var uploads []models.Upload
+	if err := e.api.db.Where("upload_id = ? AND user_id = ?", up.ID, up.UserId).Find(&uploads).Error; err != nil {
+		return &apiError{err: err}
+	}
+	used := map[int]bool{}
+	parts := []api.Part{}
+	for _, upload := range st.parts {
+		p := api.Part{ID: upload.PartId}
+		if upload.Salt != "" {
+			p.Salt = api.NewOptString(upload.Salt)
+		}
+		parts = append(parts, p)
+		used[upload.PartId] = true
+	}
+	out, err := e.api.commitUpload(ctx, &fileUpload{
+		ParentId:  up.ParentId,
+		Name:      up.Name,
+		Size:      up.Size,
+		MimeType:  up.MimeType,
+		Encrypted: up.Encrypted,
+	}, up.ID, parts, up.Size, up.ChannelId)
+	if err != nil {
+		return err
+	}
+	unused := []models.Upload{}
+	for _, upload := range uploads {
+		if !used[upload.PartId] {
+			unused = append(unused, upload)
+		}
+	}
+	e.api.deleteUploadedParts(ctx, unused)
+
+	up.FileId = &out.ID.Value
+	if err := e.api.db.Model(up).Update("file_id", out.ID.Value).Error; err != nil {
+		return &apiError{err: err}
+	}
+	return nil
+}
+
+// TusDelete terminates an upload and deletes its parts.
+func (e *extendedService) TusDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	up, err := e.tusUpload(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	unlock, ok := e.tusLocks.tryLock(up.ID)
+	if !ok {
+		writeError(w, r, errTusLocked)
+		return
+	}
+	defer unlock()
+
+	if up.FileId == nil {
+		var uploads []models.Upload
+		if err := e.api.db.Where("upload_id = ? AND user_id = ?", up.ID, up.UserId).Find(&uploads).Error; err != nil {
+			writeError(w, r, &apiError{err: err})
+			return
+		}
+		e.api.deleteUploadedParts(r.Context(), uploads)
+		if err := e.api.db.Where("upload_id = ? AND user_id = ?", up.ID, up.UserId).Delete(&models.Upload{}).Error; err != nil {
+			writeError(w, r, &apiError{err: err})
+			return
+		}
+	}
+	removeTusSpools(e.api.cnf.TG.Uploads.SpoolDir, up.ID)
+	if err := e.api.db.Delete(up).Error; err != nil {
+		writeError(w, r, &apiError{err: err})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeTusSpools(dir, id string) {
+	files, _ := filepath.Glob(filepath.Join(dir, id+".*"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
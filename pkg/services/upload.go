@@ -8,19 +8,23 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/tgdrive/teldrive/internal/api"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/crypt"
 	"github.com/tgdrive/teldrive/internal/logging"
-	"github.com/tgdrive/teldrive/internal/pool"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"go.uber.org/zap"
 
-	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/telegram/message"
 	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
@@ -86,7 +90,8 @@ func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadRe
 	var (
 		channelId   int64
 		err         error
-		client      *telegram.Client
+		client      *tg.Client
+		release     func()
 		token       string
 		index       int
 		channelUser string
@@ -119,31 +124,26 @@ func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadRe
 	}
 
 	if len(tokens) == 0 {
-		client, err = tgc.AuthClient(ctx, &a.cnf.TG, auth.GetJWTUser(ctx).TgSession)
+		client, release, err = a.clients.UploadUser(ctx, auth.GetJWTUser(ctx).TgSession)
 		if err != nil {
 			return nil, err
 		}
 		channelUser = strconv.FormatInt(userId, 10)
 	} else {
 		a.worker.Set(tokens, channelId)
-		token, index = a.worker.Next(channelId)
-		client, err = tgc.BotClient(ctx, a.tgdb, &a.cnf.TG, token)
+		var done func(error)
+		token, index, done = a.worker.Acquire(channelId)
+		client, release, err = a.clients.UploadBot(ctx, token)
 
 		if err != nil {
+			done(err)
 			return nil, err
 		}
+		defer func() { done(err) }()
 
 		channelUser = strings.Split(token, ":")[0]
 	}
-
-	middlewares := tgc.NewMiddleware(&a.cnf.TG, tgc.WithFloodWait(),
-		tgc.WithRecovery(ctx),
-		tgc.WithRetry(a.cnf.TG.Uploads.MaxRetries),
-		tgc.WithRateLimit())
-
-	uploadPool := pool.NewPool(client, int64(a.cnf.TG.PoolSize), middlewares...)
-
-	defer uploadPool.Close()
+	defer release()
 
 	logger := logging.FromContext(ctx)
 
@@ -156,9 +156,9 @@ func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadRe
 		zap.Int64("partSize", fileSize),
 	)
 
-	err = tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+	err = func() error {
 
-		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+		channel, err := tgc.GetChannelById(ctx, client, channelId)
 
 		if err != nil {
 			return err
@@ -179,8 +179,6 @@ func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadRe
 			}
 		}
 
-		client := uploadPool.Default(ctx)
-
 		u := uploader.NewUploader(client).WithThreads(a.cnf.TG.Uploads.Threads).WithPartSize(512 * 1024)
 
 		upload, err := u.Upload(ctx, uploader.NewUpload(params.PartName, fileStream, fileSize))
@@ -268,7 +266,7 @@ func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadRe
 		out.SetSalt(api.NewOptString(partUpload.Salt))
 		return nil
 
-	})
+	}()
 
 	if err != nil {
 		logger.Error("upload failed", zap.String("fileName", params.FileName),
@@ -313,3 +311,257 @@ func generateRandomSalt() (string, error) {
 
 	return hashedSalt, nil
 }
+
+// fileUpload describes a file uploaded by the server itself rather than by a
+// client sending the parts one by one.
+type fileUpload struct {
+	ParentId  string
+	Name      string
+	Size      int64 // negative when unknown
+	MimeType  string
+	Encrypted bool
+	ChannelId int64 // the default channel when zero
+	UpdatedAt time.Time
+}
+
+// uploadFile splits r into parts, uploads them and creates the file. An
+// existing file of the same name gets the new parts and its old messages are
+// deleted. Parts of a stream of unknown size are spooled to disk first.
+func (a *apiService) uploadFile(ctx context.Context, in *fileUpload, r io.Reader) (*api.File, error) {
+	uploadId := uuid.NewString()
+	parts, size, channelId, err := a.uploadParts(ctx, in, uploadId, r)
+	if err != nil {
+		return nil, err
+	}
+	return a.commitUpload(ctx, in, uploadId, parts, size, channelId)
+}
+
+// uploadParts uploads r as the parts of upload uploadId and returns them with
+// the size read and the channel they went to.
+func (a *apiService) uploadParts(ctx context.Context, in *fileUpload, uploadId string, r io.Reader) ([]api.Part, int64, int64, error) {
+	partSize := a.cnf.TG.Uploads.PartSize
+	if in.Size >= 0 && in.Size <= partSize {
+		partSize = max(in.Size, 1)
+	}
+
+	var (
+		parts     []api.Part
+		channelId int64
+		size      int64
+	)
+
+	for partNo := 1; ; partNo++ {
+		var (
+			body    io.Reader
+			partLen int64
+			last    bool
+			cleanup = func() {}
+		)
+		if in.Size >= 0 {
+			partLen = min(partSize, in.Size-size)
+			body = io.LimitReader(r, partLen)
+			last = size+partLen == in.Size
+		} else {
+			spool, n, err := spoolPart(r, partSize)
+			if err != nil {
+				return nil, 0, 0, &apiError{err: err}
+			}
+			cleanup = func() {
+				spool.Close()
+				os.Remove(spool.Name())
+			}
+			body, partLen, last = spool, n, n < partSize
+		}
+		if partLen == 0 {
+			cleanup()
+			break
+		}
+
+		partName := in.Name
+		if partNo > 1 || !last {
+			partName = fmt.Sprintf("%s.part.%03d", in.Name, partNo)
+		}
+
+		params := api.UploadsUploadParams{
+			ID:            uploadId,
+			PartName:      partName,
+			FileName:      in.Name,
+			PartNo:        partNo,
+			Encrypted:     api.NewOptBool(in.Encrypted),
+			ContentLength: partLen,
+		}
+		if in.ChannelId != 0 {
+			params.ChannelId = api.NewOptInt64(in.ChannelId)
+		}
+		out, err := a.UploadsUpload(ctx, &api.UploadsUploadReqWithContentType{
+			ContentType: defaultContentType,
+			Content:     api.UploadsUploadReq{Data: body},
+		}, params)
+		cleanup()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		parts = append(parts, api.Part{ID: out.PartId, Salt: out.Salt})
+		channelId = out.ChannelId
+		size += partLen
+		if last {
+			break
+		}
+	}
+
+	return parts, size, channelId, nil
+}
+
+// commitUpload turns the uploaded parts into the file described by in.
+func (a *apiService) commitUpload(ctx context.Context, in *fileUpload, uploadId string, parts []api.Part, size, channelId int64) (*api.File, error) {
+	userId := auth.GetUser(ctx)
+
+	mimeType := in.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(in.Name))
+	}
+	if mimeType == "" {
+		mimeType = defaultContentType
+	}
+	updatedAt := in.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = time.Now().UTC()
+	}
+
+	var existing models.File
+	err := a.db.Where("name = ? AND parent_id = ? AND user_id = ? AND status = 'active'", in.Name, in.ParentId, userId).
+		First(&existing).Error
+	if err == nil && existing.Type == "file" {
+		update := &api.FilePartsUpdate{Parts: parts, Size: size, UploadId: api.NewOptString(uploadId), UpdatedAt: updatedAt}
+		if channelId != 0 {
+			update.ChannelId = api.NewOptInt64(channelId)
+		}
+		if err := a.FilesUpdateParts(ctx, update, api.FilesUpdatePartsParams{ID: existing.ID}); err != nil {
+			return nil, err
+		}
+		if err := a.db.Where("id = ?", existing.ID).First(&existing).Error; err != nil {
+			return nil, &apiError{err: err}
+		}
+		return mapper.ToFileOut(existing), nil
+	}
+	if err == nil {
+		return nil, &apiError{err: errors.New("a folder with the same name exists"), code: http.StatusConflict}
+	}
+
+	file := &api.File{
+		Name:      in.Name,
+		Type:      "file",
+		ParentId:  api.NewOptString(in.ParentId),
+		MimeType:  api.NewOptString(mimeType),
+		Encrypted: api.NewOptBool(in.Encrypted),
+		Size:      api.NewOptInt64(size),
+		Parts:     parts,
+		UpdatedAt: api.NewOptDateTime(updatedAt),
+	}
+	if channelId != 0 {
+		file.ChannelId = api.NewOptInt64(channelId)
+	}
+	out, err := a.FilesCreate(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.db.Where("upload_id = ?", uploadId).Delete(&models.Upload{}).Error; err != nil {
+		return nil, &apiError{err: err}
+	}
+	return out, nil
+}
+
+// deleteUploadedParts removes the messages of uploaded parts. Failures are
+// left to the upload cleanup.
+func (a *apiService) deleteUploadedParts(ctx context.Context, uploads []models.Upload) {
+	channels := map[int64][]int{}
+	for _, upload := range uploads {
+		channels[upload.ChannelId] = append(channels[upload.ChannelId], upload.PartId)
+	}
+	for channelId, ids := range channels {
+		client, err := tgc.AuthClient(ctx, &a.cnf.TG, auth.GetJWTUser(ctx).TgSession, a.middlewares...)
+		if err != nil {
+			continue
+		}
+		tgc.DeleteMessages(ctx, client, channelId, ids)
+	}
+}
+
+// uploadWriter pipes the data written to it into uploadFile, the upload
+// completes when it is closed.
+type uploadWriter struct {
+	ctx     context.Context
+	in      *fileUpload
+	written int64
+	pw      *io.PipeWriter
+	done    chan struct{}
+	file    *models.File
+	err     error
+}
+
+func (a *apiService) newUploadWriter(ctx context.Context, in *fileUpload) *uploadWriter {
+	pr, pw := io.Pipe()
+	w := &uploadWriter{ctx: ctx, in: in, pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		out, err := a.uploadFile(ctx, in, pr)
+		if err == nil {
+			var file models.File
+			if err = a.db.Where("id = ?", out.ID.Value).First(&file).Error; err == nil {
+				w.file = &file
+			}
+		}
+		w.err = err
+		pr.CloseWithError(err)
+	}()
+	return w
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Close finishes the upload. Data which ended early aborts it instead of
+// storing a truncated file.
+func (w *uploadWriter) Close() error {
+	switch {
+	case w.ctx.Err() != nil:
+		w.pw.CloseWithError(w.ctx.Err())
+	case w.in.Size >= 0 && w.written != w.in.Size:
+		w.pw.CloseWithError(io.ErrUnexpectedEOF)
+	default:
+		w.pw.Close()
+	}
+	<-w.done
+	return w.err
+}
+
+// CloseWithError aborts the upload.
+func (w *uploadWriter) CloseWithError(err error) error {
+	w.pw.CloseWithError(err)
+	<-w.done
+	return w.err
+}
+
+// spoolPart copies up to n bytes of r into a temporary file positioned at its
+// start.
+func spoolPart(r io.Reader, n int64) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "teldrive-part-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	written, err := io.CopyN(f, r, n)
+	if err != nil && err != io.EOF {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, written, nil
+}
@@ -375,11 +375,10 @@ func (a *apiService) addBots(c context.Context, client *telegram.Client, userId
 		})
 	}
 
-	a.cache.Delete(cache.Key("users", "bots", userId, channelId))
-
 	if err := a.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&payload).Error; err != nil {
 		return err
 	}
+	a.cache.Delete(cache.Key("users", "bots", userId, channelId))
 	return nil
 
 }
@@ -0,0 +1,553 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/pkg/jobs"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/dav"
+
+var errDavReadOnly = errors.New("file is not open for writing")
+
+func init() {
+	// chi only routes the methods it knows about.
+	for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+		chi.RegisterMethod(method)
+	}
+}
+
+type davSizeKey struct{}
+
+// WebDAV serves the files of the user under /dav. Clients authenticate with
+// basic auth using a session token or API key as the password, the user name
+// is ignored.
+func (e *extendedService) WebDAV() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := auth.VerifyUser(e.api.db, e.api.cache, e.api.cnf.JWT.Secret, davToken(r))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="TelDrive"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := auth.WithUser(r.Context(), claims)
+		if r.Method == http.MethodPut {
+			ctx = context.WithValue(ctx, davSizeKey{}, davContentLength(r))
+		}
+		r = r.WithContext(ctx)
+
+		locks, _ := e.davLocks.LoadOrStore(auth.GetUser(ctx), webdav.NewMemLS())
+		if r.Method == "COPY" {
+			e.davCopy(w, r, locks.(webdav.LockSystem))
+			return
+		}
+
+		h := &webdav.Handler{
+			Prefix:     davPrefix,
+			FileSystem: &davFS{api: e.api},
+			LockSystem: locks.(webdav.LockSystem),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					logging.FromContext(r.Context()).Debug("webdav", zap.String("method", r.Method),
+						zap.String("path", r.URL.Path), zap.Error(err))
+				}
+			},
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func davToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if cookie, err := r.Cookie(authCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// davContentLength returns the size of a PUT body. Finder sends chunked
+// bodies and announces the size in X-Expected-Entity-Length instead.
+func davContentLength(r *http.Request) int64 {
+	if r.ContentLength >= 0 {
+		return r.ContentLength
+	}
+	if size, err := strconv.ParseInt(r.Header.Get("X-Expected-Entity-Length"), 10, 64); err == nil {
+		return size
+	}
+	return -1
+}
+
+func davPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// davCopy copies on the server with FilesCopy instead of the download and
+// upload the webdav package would do. Folders are copied by a job, their COPY
+// is answered with 202 and the job as FilesCopy does.
+func (e *extendedService) davCopy(w http.ResponseWriter, r *http.Request, locks webdav.LockSystem) {
+	ctx, queued := withQueuedJob(r.Context())
+	dfs := &davFS{api: e.api}
+
+	src, err := dfs.lookup(ctx, strings.TrimPrefix(r.URL.Path, davPrefix))
+	if err != nil {
+		http.Error(w, err.Error(), davStatus(err))
+		return
+	}
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(u.Path, davPrefix+"/") {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+	if u.Host != "" && u.Host != r.Host {
+		http.Error(w, "destination is on another server", http.StatusBadGateway)
+		return
+	}
+	dst := davPath(strings.TrimPrefix(u.Path, davPrefix))
+	if dst == "/" || dst == davPath(strings.TrimPrefix(r.URL.Path, davPrefix)) {
+		http.Error(w, "invalid destination", http.StatusForbidden)
+		return
+	}
+	parent, err := dfs.lookup(ctx, path.Dir(dst))
+	if err != nil {
+		http.Error(w, "destination folder does not exist", http.StatusConflict)
+		return
+	}
+
+	release, status := davConfirm(r, locks, dst)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer release()
+
+	status = http.StatusCreated
+	existing, err := dfs.lookup(ctx, dst)
+	if err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		status = http.StatusNoContent
+	} else {
+		existing = nil
+	}
+
+	if src.Type == "folder" && r.Header.Get("Depth") == "0" {
+		_, err = e.api.createOver(ctx, existing, path.Base(dst), func(name string) (string, error) {
+			p := path.Join(path.Dir(dst), name)
+			if err := e.api.FilesMkdir(ctx, &api.FileMkDir{Path: p}); err != nil {
+				return "", err
+			}
+			folder, err := dfs.lookup(ctx, p)
+			if err != nil {
+				return "", err
+			}
+			return folder.ID, nil
+		})
+	} else {
+		_, err = e.api.copyOver(ctx, src.ID, parent.ID, path.Base(dst), existing)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if queued.job != nil {
+		w.Header().Set("Location", "/api/jobs/"+queued.job.ID)
+		writeJSON(w, http.StatusAccepted, jobs.ToInfo(queued.job))
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// davConfirm checks that the destination of a COPY is not locked by another
+// client, the way the webdav handler does for its own methods. Without an If
+// header the destination is locked for the duration of the copy.
+func davConfirm(r *http.Request, locks webdav.LockSystem, name string) (func(), int) {
+	now := time.Now()
+	hdr := r.Header.Get("If")
+	if hdr == "" {
+		token, err := locks.Create(now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+		if errors.Is(err, webdav.ErrLocked) {
+			return nil, http.StatusLocked
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		return func() { locks.Unlock(now, token) }, 0
+	}
+	release, err := locks.Confirm(now, name, "", davConditions(hdr)...)
+	if errors.Is(err, webdav.ErrConfirmationFailed) {
+		return nil, http.StatusPreconditionFailed
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	return release, 0
+}
+
+// davConditions returns the lock tokens listed in an If header. Resource tags
+// and entity tags are ignored, the lock system only matches tokens.
+func davConditions(hdr string) []webdav.Condition {
+	conditions := []webdav.Condition{}
+	inList := false
+	for i := 0; i < len(hdr); i++ {
+		switch hdr[i] {
+		case '(':
+			inList = true
+		case ')':
+			inList = false
+		case '<':
+			end := strings.IndexByte(hdr[i:], '>')
+			if end < 0 {
+				return conditions
+			}
+			if inList {
+				conditions = append(conditions, webdav.Condition{Token: hdr[i+1 : i+end]})
+			}
+			i += end
+		}
+	}
+	return conditions
+}
+
+func davStatus(err error) int {
+	if errors.Is(err, os.ErrNotExist) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// davFS maps webdav onto the file service of the user in the context.
+type davFS struct {
+	api *apiService
+}
+
+func (d *davFS) lookup(ctx context.Context, name string) (*models.File, error) {
+	file, err := d.api.getFileFromPath(davPath(name), auth.GetUser(ctx))
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, os.ErrNotExist
+	}
+	return file, err
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = davPath(name)
+	if _, err := d.lookup(ctx, name); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := d.lookup(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	return d.api.FilesMkdir(ctx, &api.FileMkDir{Path: name})
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davPath(name)
+	file, err := d.lookup(ctx, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if file == nil {
+			return nil, os.ErrNotExist
+		}
+		return &davFile{ctx: ctx, api: d.api, file: file}, nil
+	}
+	if file != nil && file.Type == "folder" {
+		return nil, os.ErrPermission
+	}
+	if file == nil && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	parent, err := d.lookup(ctx, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	size, ok := ctx.Value(davSizeKey{}).(int64)
+	if !ok {
+		size = -1
+	}
+	return &davWriter{d.api.newUploadWriter(ctx, &fileUpload{ParentId: parent.ID, Name: path.Base(name), Size: size})}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if davPath(name) == "/" {
+		return os.ErrPermission
+	}
+	file, err := d.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	return d.api.FilesDelete(ctx, &api.FileDelete{Ids: []string{file.ID}})
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	newName = davPath(newName)
+	if davPath(oldName) == "/" || newName == "/" {
+		return os.ErrPermission
+	}
+	file, err := d.lookup(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	parent, err := d.lookup(ctx, path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	return d.api.FilesMove(ctx, &api.FileMove{
+		Ids:               []string{file.ID},
+		DestinationParent: parent.ID,
+		DestinationName:   api.NewOptString(path.Base(newName)),
+	})
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, err := d.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFileInfo{file: file}, nil
+}
+
+type davFileInfo struct {
+	file *models.File
+}
+
+func (fi *davFileInfo) Name() string {
+	return fi.file.Name
+}
+
+func (fi *davFileInfo) Size() int64 {
+	if fi.file.Size == nil {
+		return 0
+	}
+	return *fi.file.Size
+}
+
+func (fi *davFileInfo) Mode() fs.FileMode {
+	if fi.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *davFileInfo) ModTime() time.Time {
+	return fi.file.UpdatedAt
+}
+
+func (fi *davFileInfo) IsDir() bool {
+	return fi.file.Type == "folder"
+}
+
+func (fi *davFileInfo) Sys() any {
+	return nil
+}
+
+// ContentType keeps the webdav package from sniffing the first bytes of files.
+func (fi *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.file.MimeType == "" || fi.IsDir() {
+		return defaultContentType, nil
+	}
+	return fi.file.MimeType, nil
+}
+
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	return fileETag(fi.file), nil
+}
+
+// davFile reads a stored file. Reads continue a linear reader from the current
+// offset, seeking drops it so range requests only fetch what they need.
+type davFile struct {
+	ctx      context.Context
+	api      *apiService
+	file     *models.File
+	pos      int64
+	rc       io.ReadCloser
+	client   *tg.Client
+	release  func(error)
+	parts    []types.Part
+	err      error
+	children []fs.FileInfo
+	listed   bool
+}
+
+func (f *davFile) open() error {
+	if f.client == nil {
+		client, release, err := f.api.channelClient(f.ctx, f.file.UserId, *f.file.ChannelId, auth.GetJWTUser(f.ctx).TgSession)
+		if err != nil {
+			return err
+		}
+		f.client, f.release = client, release
+		if f.parts, err = getParts(f.ctx, client, f.api.cache, f.file); err != nil {
+			return err
+		}
+	}
+	rc, err := reader.NewLinearReader(f.ctx, f.client, f.api.cache, f.file, f.parts, f.pos, *f.file.Size-1, &f.api.cnf.TG, 0)
+	if err != nil {
+		return err
+	}
+	f.rc = rc
+	return nil
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.file.Type == "folder" {
+		return 0, os.ErrInvalid
+	}
+	if f.file.Size == nil || f.pos >= *f.file.Size {
+		return 0, io.EOF
+	}
+	if f.rc == nil {
+		if err := f.open(); err != nil {
+			f.err = err
+			return 0, err
+		}
+	}
+	n, err := f.rc.Read(p)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	var size int64
+	if f.file.Size != nil {
+		size = *f.file.Size
+	}
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += size
+	}
+	if pos < 0 {
+		return 0, os.ErrInvalid
+	}
+	if pos != f.pos && f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if f.file.Type != "folder" {
+		return nil, os.ErrInvalid
+	}
+	if !f.listed {
+		var children []models.File
+		if err := f.api.db.Where("parent_id = ? AND user_id = ? AND status = 'active'", f.file.ID, f.file.UserId).
+			Order("name").Find(&children).Error; err != nil {
+			return nil, err
+		}
+		for i := range children {
+			f.children = append(f.children, &davFileInfo{file: &children[i]})
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		children := f.children
+		f.children = nil
+		return children, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.children))
+	children := f.children[:n]
+	f.children = f.children[n:]
+	return children, nil
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	return &davFileInfo{file: f.file}, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, errDavReadOnly
+}
+
+func (f *davFile) Close() error {
+	if f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	if f.release != nil {
+		f.release(f.err)
+		f.release = nil
+	}
+	return nil
+}
+
+// davWriter is the file a PUT body is written to.
+type davWriter struct {
+	*uploadWriter
+}
+
+func (w *davWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (w *davWriter) Stat() (fs.FileInfo, error) {
+	return &davWriterInfo{w: w}, nil
+}
+
+// davWriterInfo describes a file being uploaded. The webdav package asks for
+// the ETag after closing the file, by then the stored file is known.
+type davWriterInfo struct {
+	w *davWriter
+}
+
+func (fi *davWriterInfo) Name() string       { return fi.w.in.Name }
+func (fi *davWriterInfo) Size() int64        { return fi.w.written }
+func (fi *davWriterInfo) Mode() fs.FileMode  { return 0644 }
+func (fi *davWriterInfo) ModTime() time.Time { return time.Now() }
+func (fi *davWriterInfo) IsDir() bool        { return false }
+func (fi *davWriterInfo) Sys() any           { return nil }
+
+func (fi *davWriterInfo) ETag(ctx context.Context) (string, error) {
+	if fi.w.file == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	return fileETag(fi.w.file), nil
+}
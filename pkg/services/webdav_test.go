@@ -0,0 +1,23 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func TestDavConditions(t *testing.T) {
+	tests := []struct {
+		hdr  string
+		want []webdav.Condition
+	}{
+		{"(<opaquelocktoken:a>)", []webdav.Condition{{Token: "opaquelocktoken:a"}}},
+		{`<http://host/dav/x> (<t1> ["etag"]) (Not <t2>)`, []webdav.Condition{{Token: "t1"}, {Token: "t2"}}},
+		{"<http://host/dav/x>", []webdav.Condition{}},
+		{"(<broken", []webdav.Condition{}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, davConditions(tt.hdr), tt.hdr)
+	}
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	zipBlockSize = 1 << 20
+	zipBlocks    = 8
+)
+
+type zipEntry struct {
+	Name           string    `json:"name"`
+	Size           uint64    `json:"size"`
+	CompressedSize uint64    `json:"compressedSize"`
+	Modified       time.Time `json:"modified"`
+	IsDir          bool      `json:"isDir"`
+	Encrypted      bool      `json:"encrypted"`
+}
+
+type zipEntries struct {
+	Items   []zipEntry `json:"items"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+// storedReaderAt reads a stored file at arbitrary offsets. archive/zip issues
+// many small reads while parsing the central directory, so whole blocks are
+// fetched and the last few are kept around.
+type storedReaderAt struct {
+	ctx    context.Context
+	client *tg.Client
+	api    *apiService
+	file   *models.File
+	parts  []types.Part
+	blocks map[int64][]byte
+	order  []int64
+}
+
+func (r *storedReaderAt) reader(start, end int64) (io.ReadCloser, error) {
+	return reader.NewLinearReader(r.ctx, r.client, r.api.cache, r.file, r.parts, start, end, &r.api.cnf.TG, 0)
+}
+
+func (r *storedReaderAt) block(idx int64) ([]byte, error) {
+	if block, ok := r.blocks[idx]; ok {
+		return block, nil
+	}
+	start := idx * zipBlockSize
+	lr, err := r.reader(start, min(start+zipBlockSize, *r.file.Size)-1)
+	if err != nil {
+		return nil, err
+	}
+	defer lr.Close()
+	block, err := io.ReadAll(lr)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.order) == zipBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[idx] = block
+	r.order = append(r.order, idx)
+	return block, nil
+}
+
+func (r *storedReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= *r.file.Size {
+			return n, io.EOF
+		}
+		idx := pos / zipBlockSize
+		block, err := r.block(idx)
+		if err != nil {
+			return n, err
+		}
+		rel := pos - idx*zipBlockSize
+		if rel >= int64(len(block)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], block[rel:])
+	}
+	return n, nil
+}
+
+// withZip opens the central directory of a stored zip file and runs fn while
+// a client of the channel is held.
+func (a *apiService) withZip(ctx context.Context, userId int64, session, fileId string,
+	fn func(ctx context.Context, zr *zip.Reader, r *storedReaderAt) error) error {
+	if !isUUID(fileId) {
+		return &apiError{err: errors.New("invalid file id"), code: http.StatusBadRequest}
+	}
+	var file models.File
+	if err := a.db.Where("id = ? AND user_id = ? AND type = 'file' AND status = 'active'", fileId, userId).
+		First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &apiError{err: errors.New("file not found"), code: http.StatusNotFound}
+		}
+		return &apiError{err: err}
+	}
+	if file.Size == nil || *file.Size == 0 || file.ChannelId == nil {
+		return &apiError{err: errors.New("not a zip archive"), code: http.StatusBadRequest}
+	}
+
+	client, release, err := a.channelClient(ctx, userId, *file.ChannelId, session)
+	if err != nil {
+		return &apiError{err: err}
+	}
+	err = func() error {
+		parts, err := getParts(ctx, client, a.cache, &file)
+		if err != nil {
+			return &apiError{err: err}
+		}
+		r := &storedReaderAt{ctx: ctx, client: client, api: a, file: &file, parts: parts, blocks: map[int64][]byte{}}
+		zr, err := zip.NewReader(r, *file.Size)
+		if errors.Is(err, zip.ErrFormat) {
+			return &apiError{err: errors.New("not a zip archive"), code: http.StatusBadRequest}
+		}
+		if err != nil {
+			return &apiError{err: err}
+		}
+		return fn(ctx, zr, r)
+	}()
+	release(err)
+	return err
+}
+
+func (e *extendedService) FilesZipEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	out := zipEntries{Items: []zipEntry{}}
+	err := e.api.withZip(ctx, auth.GetUser(ctx), auth.GetJWTUser(ctx).TgSession, chi.URLParam(r, "id"),
+		func(ctx context.Context, zr *zip.Reader, _ *storedReaderAt) error {
+			for _, f := range zr.File {
+				out.Items = append(out.Items, zipEntry{
+					Name:           f.Name,
+					Size:           f.UncompressedSize64,
+					CompressedSize: f.CompressedSize64,
+					Modified:       f.Modified,
+					IsDir:          strings.HasSuffix(f.Name, "/"),
+					Encrypted:      f.Flags&0x1 != 0,
+				})
+			}
+			out.Comment = zr.Comment
+			return nil
+		})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &out)
+}
+
+// FilesZipEntry streams a single entry. Only the compressed bytes of the entry
+// are read and inflated on the fly.
+func (e *extendedService) FilesZipEntry(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, r, &apiError{err: errors.New("name should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	started := false
+	err := e.api.withZip(ctx, auth.GetUser(ctx), auth.GetJWTUser(ctx).TgSession, chi.URLParam(r, "id"),
+		func(ctx context.Context, zr *zip.Reader, sr *storedReaderAt) error {
+			var f *zip.File
+			for _, entry := range zr.File {
+				if entry.Name == name {
+					f = entry
+					break
+				}
+			}
+			if f == nil || strings.HasSuffix(f.Name, "/") {
+				return &apiError{err: errors.New("entry not found"), code: http.StatusNotFound}
+			}
+			if f.Flags&0x1 != 0 {
+				return &apiError{err: errors.New("password protected entries are not supported"), code: http.StatusBadRequest}
+			}
+			if f.Method != zip.Store && f.Method != zip.Deflate {
+				return &apiError{err: errors.New("unsupported compression method"), code: http.StatusBadRequest}
+			}
+			offset, err := f.DataOffset()
+			if err != nil {
+				return &apiError{err: err}
+			}
+
+			contentType := mime.TypeByExtension(path.Ext(f.Name))
+			if contentType == "" {
+				contentType = defaultContentType
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.FormatUint(f.UncompressedSize64, 10))
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(f.Name)}))
+			w.Header().Set("Last-Modified", f.Modified.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+			started = true
+			if r.Method == http.MethodHead || f.CompressedSize64 == 0 {
+				return nil
+			}
+
+			lr, err := sr.reader(offset, offset+int64(f.CompressedSize64)-1)
+			if err != nil {
+				return err
+			}
+			defer lr.Close()
+			var src io.Reader = lr
+			if f.Method == zip.Deflate {
+				fr := flate.NewReader(lr)
+				defer fr.Close()
+				src = fr
+			}
+			// The declared size is the Content-Length, a stream inflating past it is cut there.
+			src = io.LimitReader(src, int64(f.UncompressedSize64))
+			hash := crc32.NewIEEE()
+			if _, err := io.Copy(io.MultiWriter(w, hash), src); err != nil {
+				return err
+			}
+			if f.CRC32 != 0 && hash.Sum32() != f.CRC32 {
+				return zip.ErrChecksum
+			}
+			return nil
+		})
+	if err != nil && !started {
+		writeError(w, r, err)
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("zip entry stream failed", zap.String("entry", name), zap.Error(err))
+	}
+}